@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNoAccount      = errors.New("no such account")
+	ErrAccountExists  = errors.New("account already exists")
+	ErrAccountLocked  = errors.New("account is temporarily locked")
+	ErrBadCredentials = errors.New("bad credentials")
+	ErrKeyExists      = errors.New("key is already authorized")
+	ErrNoKey          = errors.New("no such key")
+)
+
+// accountIDExtension is the ssh.Permissions extension used to carry the
+// authenticated account's ID from the auth callbacks into the session.
+const accountIDExtension = "account-id"
+
+// authMethodExtension records how the session authenticated, as one of
+// the authMethod constants.
+const authMethodExtension = "auth-method"
+
+const (
+	authPassword  = "password"
+	authPublicKey = "publickey"
+)
+
+// scrypt parameters for password hashing.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+// Account is a player account.
+type Account struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Salt        []byte    `json:"salt"`
+	Hash        []byte    `json:"hash"`
+	Created     time.Time `json:"created"`
+	Failures    int       `json:"failures,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+	Keys        []string  `json:"keys,omitempty"` // authorized_keys format
+	Roles       []string  `json:"roles,omitempty"`
+	Color       string    `json:"color,omitempty"` // colorTrueColor, colorPalette, or empty for the client's say
+}
+
+// Account roles.  Admins have every staff privilege.
+const (
+	roleAdmin = "admin"
+	roleStaff = "staff"
+)
+
+// Account color settings, for players whose clients get it wrong.
+const (
+	colorTrueColor = "truecolor"
+	colorPalette   = "palette"
+)
+
+func (a *Account) hasRole(role string) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaff reports whether the account has the staff or admin role.
+func (a *Account) isStaff() bool {
+	return a.hasRole(roleStaff) || a.hasRole(roleAdmin)
+}
+
+// AccountStore looks up, creates and authenticates accounts.  Account
+// names are case-insensitive.  Implementations must be safe for
+// concurrent use, and return copies rather than their internal state.
+type AccountStore interface {
+	Lookup(name string) (*Account, error)
+	LookupID(id string) (*Account, error)
+	Create(name, password string) (*Account, error)
+	Authenticate(name string, password []byte) (*Account, error)
+	AuthenticateKey(name string, key ssh.PublicKey) (*Account, error)
+	AddKey(id string, key ssh.PublicKey, comment string) error
+	RemoveKey(id string, fingerprint string) error
+	SetRoles(id string, roles []string) error
+	SetColor(id string, color string) error
+	Save() error
+}
+
+func hashPassword(password, salt []byte) ([]byte, error) {
+	return scrypt.Key(password, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkPassword verifies password against the account's hash in constant time.
+func (a *Account) checkPassword(password []byte) bool {
+	hash, err := hashPassword(password, a.Salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, a.Hash) == 1
+}
+
+// findKey returns the index in a.Keys of key, or -1.
+func (a *Account) findKey(key ssh.PublicKey) int {
+	for i, line := range a.Keys {
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(k.Marshal(), key.Marshal()) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *Account) setPassword(password string) error {
+	salt, err := randomBytes(saltLen)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword([]byte(password), salt)
+	if err != nil {
+		return err
+	}
+	a.Salt = salt
+	a.Hash = hash
+	return nil
+}
+
+// fileAccountStore is an AccountStore kept in memory and persisted as a
+// JSON file after every change but failed logins, which wait for Save.
+type fileAccountStore struct {
+	path        string
+	accounts    map[string]*Account // keyed by lowercased name
+	dummy       Account             // hashed against for unknown names
+	maxFailures int
+	lockout     time.Duration
+	sync.Mutex
+}
+
+// NewFileAccountStore loads the accounts in path, which is created on the
+// first write if it doesn't exist yet.  After maxFailures consecutive bad
+// passwords an account is locked for the lockout duration.
+func NewFileAccountStore(path string, maxFailures int, lockout time.Duration) (AccountStore, error) {
+	s := &fileAccountStore{
+		path:        path,
+		accounts:    make(map[string]*Account),
+		maxFailures: maxFailures,
+		lockout:     lockout,
+	}
+	if err := s.dummy.setPassword(""); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		s.accounts[strings.ToLower(a.Name)] = a
+	}
+	return s, nil
+}
+
+// save writes all accounts to disk.  The caller must hold the lock.
+func (s *fileAccountStore) save() error {
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".accounts")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileAccountStore) Save() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.save()
+}
+
+func (s *fileAccountStore) Lookup(name string) (*Account, error) {
+	s.Lock()
+	defer s.Unlock()
+	a, ok := s.accounts[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrNoAccount
+	}
+	acct := *a
+	return &acct, nil
+}
+
+func (s *fileAccountStore) LookupID(id string) (*Account, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.accounts {
+		if a.ID == id {
+			acct := *a
+			return &acct, nil
+		}
+	}
+	return nil, ErrNoAccount
+}
+
+func (s *fileAccountStore) Create(name, password string) (*Account, error) {
+	id, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	a := &Account{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Created: time.Now(),
+	}
+	if err := a.setPassword(password); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	key := strings.ToLower(name)
+	if _, ok := s.accounts[key]; ok {
+		return nil, ErrAccountExists
+	}
+	s.accounts[key] = a
+	if err := s.save(); err != nil {
+		delete(s.accounts, key)
+		return nil, err
+	}
+	acct := *a
+	return &acct, nil
+}
+
+func (s *fileAccountStore) Authenticate(name string, password []byte) (*Account, error) {
+	key := strings.ToLower(name)
+	s.Lock()
+	a, ok := s.accounts[key]
+	var acct Account
+	if ok {
+		acct = *a
+	}
+	s.Unlock()
+
+	if !ok {
+		// Burn the same amount of time as a real check, so response
+		// times don't reveal which names exist.
+		s.dummy.checkPassword(password)
+		return nil, ErrBadCredentials
+	}
+	// Hash outside the lock; it's deliberately slow.  Locked accounts are
+	// hashed against too, so a lockout takes no less time to report.
+	good := acct.checkPassword(password)
+
+	s.Lock()
+	defer s.Unlock()
+	if a, ok = s.accounts[key]; !ok {
+		return nil, ErrBadCredentials
+	}
+	if time.Now().Before(a.LockedUntil) {
+		return nil, ErrAccountLocked
+	}
+	// Failures are only counted in memory, not saved each time, so
+	// guessing passwords doesn't rewrite the file.  They're saved with
+	// the next change to the store, or by Save at shutdown.
+	if !good {
+		a.Failures++
+		if a.Failures >= s.maxFailures {
+			a.Failures = 0
+			a.LockedUntil = time.Now().Add(s.lockout)
+		}
+		return nil, ErrBadCredentials
+	}
+	a.Failures = 0
+	a.LockedUntil = time.Time{}
+	acct = *a
+	return &acct, nil
+}
+
+func (s *fileAccountStore) AuthenticateKey(name string, key ssh.PublicKey) (*Account, error) {
+	s.Lock()
+	defer s.Unlock()
+	a, ok := s.accounts[strings.ToLower(name)]
+	if !ok || a.findKey(key) < 0 {
+		return nil, ErrBadCredentials
+	}
+	acct := *a
+	return &acct, nil
+}
+
+// update applies fn to the account with the given ID and saves the
+// store if it succeeds.
+func (s *fileAccountStore) update(id string, fn func(a *Account) error) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.accounts {
+		if a.ID == id {
+			orig := *a
+			if err := fn(a); err != nil {
+				return err
+			}
+			if err := s.save(); err != nil {
+				*a = orig
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNoAccount
+}
+
+func (s *fileAccountStore) AddKey(id string, key ssh.PublicKey, comment string) error {
+	return s.update(id, func(a *Account) error {
+		if a.findKey(key) >= 0 {
+			return ErrKeyExists
+		}
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if comment != "" {
+			line += " " + comment
+		}
+		a.Keys = append(a.Keys[:len(a.Keys):len(a.Keys)], line)
+		return nil
+	})
+}
+
+func (s *fileAccountStore) RemoveKey(id string, fingerprint string) error {
+	return s.update(id, func(a *Account) error {
+		for i, line := range a.Keys {
+			k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err == nil && ssh.FingerprintSHA256(k) == fingerprint {
+				keys := make([]string, 0, len(a.Keys)-1)
+				a.Keys = append(append(keys, a.Keys[:i]...), a.Keys[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNoKey
+	})
+}
+
+func (s *fileAccountStore) SetRoles(id string, roles []string) error {
+	return s.update(id, func(a *Account) error {
+		a.Roles = append([]string(nil), roles...)
+		return nil
+	})
+}
+
+func (s *fileAccountStore) SetColor(id string, color string) error {
+	return s.update(id, func(a *Account) error {
+		a.Color = color
+		return nil
+	})
+}
+
+// accountPermissions returns the ssh.Permissions granted to a session
+// authenticated as a using method.
+func accountPermissions(a *Account, method string) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			accountIDExtension:  a.ID,
+			authMethodExtension: method,
+		},
+	}
+}
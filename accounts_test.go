@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateLockout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	s, err := NewFileAccountStore(path, 5, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("Alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Authenticate("alice", []byte("correct horse")); err != nil {
+		t.Fatalf("good password: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := s.Authenticate("alice", []byte("wrong")); err != ErrBadCredentials {
+			t.Fatalf("bad password %d: got %v, want %v", i, err, ErrBadCredentials)
+		}
+	}
+	// Now even the right password is refused, until the lockout is over.
+	if _, err := s.Authenticate("alice", []byte("correct horse")); err != ErrAccountLocked {
+		t.Fatalf("locked account: got %v, want %v", err, ErrAccountLocked)
+	}
+	if st, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(st, saved) {
+		t.Error("failed logins rewrote the accounts file")
+	}
+
+	fs := s.(*fileAccountStore)
+	fs.Lock()
+	fs.accounts["alice"].LockedUntil = time.Now().Add(-time.Second)
+	fs.Unlock()
+	if _, err := s.Authenticate("alice", []byte("correct horse")); err != nil {
+		t.Fatalf("after the lockout: %v", err)
+	}
+	if _, err := s.Authenticate("bob", []byte("correct horse")); err != ErrBadCredentials {
+		t.Fatalf("unknown name: got %v, want %v", err, ErrBadCredentials)
+	}
+}
+
+func TestSaveKeepsFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	s, err := NewFileAccountStore(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		s.Authenticate("alice", []byte("wrong"))
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewFileAccountStore(path, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate("alice", []byte("correct horse")); err != ErrAccountLocked {
+		t.Fatalf("after reloading: got %v, want %v", err, ErrAccountLocked)
+	}
+}
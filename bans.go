@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban keeps an address range from connecting.
+type Ban struct {
+	CIDR    string    `json:"cidr"`
+	Reason  string    `json:"reason,omitempty"`
+	By      string    `json:"by,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero for never
+
+	ipnet *net.IPNet
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// parseCIDR accepts either a CIDR range or a single address, returning
+// the canonical range.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// banList is the set of bans, persisted as a JSON file after every change.
+type banList struct {
+	path string
+	bans []*Ban
+	sync.Mutex
+}
+
+// loadBans reads the ban list in path, which is created on the first
+// write if it doesn't exist yet.
+func loadBans(path string) (*banList, error) {
+	l := &banList{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.bans); err != nil {
+		return nil, err
+	}
+	for _, b := range l.bans {
+		if b.ipnet, err = parseCIDR(b.CIDR); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// save writes the ban list to disk, dropping expired bans.  The caller
+// must hold the lock.
+func (l *banList) save() error {
+	now := time.Now()
+	bans := l.bans[:0]
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	l.bans = bans
+	data, err := json.MarshalIndent(l.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), ".bans")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+func (l *banList) Save() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.save()
+}
+
+// Add bans cidr (a range or single address) for d, or forever if d is 0,
+// replacing any existing ban on the same range.
+func (l *banList) Add(cidr string, d time.Duration, reason, by string) (*Ban, error) {
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	b := &Ban{
+		CIDR:    ipnet.String(),
+		Reason:  reason,
+		By:      by,
+		Created: time.Now(),
+		ipnet:   ipnet,
+	}
+	if d > 0 {
+		b.Expires = b.Created.Add(d)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	bans := make([]*Ban, 0, len(l.bans)+1)
+	for _, old := range l.bans {
+		if old.CIDR != b.CIDR {
+			bans = append(bans, old)
+		}
+	}
+	l.bans = append(bans, b)
+	return b, l.save()
+}
+
+// Remove lifts the ban on cidr, reporting whether there was one.
+func (l *banList) Remove(cidr string) (bool, error) {
+	ipnet, err := parseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	l.Lock()
+	defer l.Unlock()
+	for i, b := range l.bans {
+		if b.CIDR == ipnet.String() {
+			l.bans = append(l.bans[:i:i], l.bans[i+1:]...)
+			return true, l.save()
+		}
+	}
+	return false, nil
+}
+
+// Find returns the ban covering ip, or nil.
+func (l *banList) Find(ip net.IP) *Ban {
+	if ip == nil {
+		return nil
+	}
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	for _, b := range l.bans {
+		if !b.expired(now) && b.ipnet.Contains(ip) {
+			ban := *b
+			return &ban
+		}
+	}
+	return nil
+}
+
+// List returns the bans in effect.
+func (l *banList) List() []Ban {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	var bans []Ban
+	for _, b := range l.bans {
+		if !b.expired(now) {
+			bans = append(bans, *b)
+		}
+	}
+	return bans
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in, want string // want empty for an error
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"192.0.2.77/24", "192.0.2.0/24"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8:1::/32", "2001:db8::/32"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32"},
+		{"nonsense", ""},
+		{"192.0.2.1/33", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		ipnet, err := parseCIDR(tt.in)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parseCIDR(%q) = %s, want an error", tt.in, ipnet)
+		case tt.want != "" && err != nil:
+			t.Errorf("parseCIDR(%q): %v", tt.in, err)
+		case tt.want != "" && ipnet.String() != tt.want:
+			t.Errorf("parseCIDR(%q) = %s, want %s", tt.in, ipnet, tt.want)
+		}
+	}
+}
+
+func testBans(t *testing.T) (*banList, string) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	l, err := loadBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, path
+}
+
+func TestBanListFind(t *testing.T) {
+	l, _ := testBans(t)
+	for _, cidr := range []string{"10.0.0.0/8", "192.0.2.5", "2001:db8::/32"} {
+		if _, err := l.Add(cidr, 0, "", "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		ip   string
+		want string // the ban's range, or empty for none
+	}{
+		{"10.0.0.1", "10.0.0.0/8"},
+		{"10.255.255.255", "10.0.0.0/8"},
+		{"11.0.0.0", ""},
+		{"192.0.2.5", "192.0.2.5/32"},
+		{"192.0.2.6", ""},
+		{"::ffff:10.1.1.1", "10.0.0.0/8"},
+		{"2001:db8:ffff::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if b := l.Find(net.ParseIP(tt.ip)); b != nil {
+			got = b.CIDR
+		}
+		if got != tt.want {
+			t.Errorf("Find(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+	if b := l.Find(nil); b != nil {
+		t.Errorf("Find(nil) = %s", b.CIDR)
+	}
+}
+
+func TestBanListAddRemove(t *testing.T) {
+	l, _ := testBans(t)
+	l.Add("192.0.2.0/24", 0, "first", "admin")
+	l.Add("192.0.2.9/24", time.Hour, "second", "admin")
+	bans := l.List()
+	if len(bans) != 1 || bans[0].Reason != "second" || bans[0].Expires.IsZero() {
+		t.Fatalf("banning a range again gave %+v, want the second ban alone", bans)
+	}
+	if found, err := l.Remove("192.0.2.0/24"); err != nil || !found {
+		t.Fatalf("Remove: %v, %v", found, err)
+	}
+	if found, err := l.Remove("192.0.2.0/24"); err != nil || found {
+		t.Fatalf("Remove again: %v, %v", found, err)
+	}
+	if _, err := l.Remove("nonsense"); err == nil {
+		t.Fatal("removed a nonsense range")
+	}
+	if _, err := l.Add("nonsense", 0, "", "admin"); err == nil {
+		t.Fatal("banned a nonsense range")
+	}
+	if bans := l.List(); len(bans) != 0 {
+		t.Fatalf("left %+v", bans)
+	}
+}
+
+func TestBanListExpiry(t *testing.T) {
+	l, path := testBans(t)
+	l.Add("192.0.2.1", time.Hour, "", "admin")
+	l.Add("192.0.2.2", 0, "", "admin")
+	ip := net.ParseIP("192.0.2.1")
+	if l.Find(ip) == nil {
+		t.Fatal("ban not in effect")
+	}
+
+	l.Lock()
+	l.bans[0].Expires = time.Now().Add(-time.Second)
+	l.Unlock()
+	if b := l.Find(ip); b != nil {
+		t.Fatalf("expired ban %s in effect", b.CIDR)
+	}
+	if bans := l.List(); len(bans) != 1 || bans[0].CIDR != "192.0.2.2/32" {
+		t.Fatalf("List() = %+v, want the ban that doesn't expire", bans)
+	}
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.bans) != 1 {
+		t.Fatalf("saved %d bans, want the 1 not expired", len(l.bans))
+	}
+}
+
+func TestBanListRoundTrip(t *testing.T) {
+	l, path := testBans(t)
+	l.Add("10.0.0.0/8", 0, "scanners", "alice")
+	l.Add("2001:db8::1", 24*time.Hour, "spam", "bob")
+	want := l.List()
+
+	l, err := loadBans(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := l.List()
+	if len(got) != len(want) {
+		t.Fatalf("loaded %+v, want %+v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.CIDR != w.CIDR || g.Reason != w.Reason || g.By != w.By ||
+			!g.Created.Equal(w.Created) || !g.Expires.Equal(w.Expires) {
+			t.Errorf("loaded %+v, want %+v", g, w)
+		}
+	}
+	if l.Find(net.ParseIP("10.9.8.7")) == nil || l.Find(net.ParseIP("2001:db8::1")) == nil {
+		t.Error("loaded bans not in effect")
+	}
+}
+
+func TestLoadBansErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"corrupt":   "[{",
+		"bad range": `[{"cidr": "nonsense"}]`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadBans(path); err == nil {
+			t.Errorf("loaded a %s ban list", name)
+		}
+	}
+}
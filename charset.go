@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell"
+	"github.com/gdamore/tcell/encoding"
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+func init() {
+	encoding.Register()
+	// For players on DOS-era terminals and BBS clients.
+	for _, name := range []string{"CP437", "IBM437", "437"} {
+		tcell.RegisterEncoding(name, charmap.CodePage437)
+	}
+	for _, name := range []string{
+		"UTF-8", "US-ASCII", "CP437", "IBM437",
+		"ISO8859-1", "ISO8859-2", "ISO8859-3", "ISO8859-4", "ISO8859-5",
+		"ISO8859-6", "ISO8859-7", "ISO8859-8", "ISO8859-9", "ISO8859-10",
+		"ISO8859-13", "ISO8859-14", "ISO8859-15", "ISO8859-16",
+		"KOI8-R", "KOI8-U", "EUC-JP", "Shift_JIS", "ISO2022JP", "EUC-KR",
+		"GB18030", "GB2312", "GBK", "Big5",
+	} {
+		codesets[normalizeCodeset(name)] = name
+	}
+}
+
+// codesets maps the codesets we have encodings for, normalized, to the
+// names they're registered under.
+var codesets = map[string]string{
+	"ansix341968": "US-ASCII", // as glibc names ASCII
+	"sjis":        "Shift_JIS",
+}
+
+// normalizeCodeset normalizes a locale's codeset as glibc does: lower
+// case, without punctuation.  So ISO-8859-1, ISO8859-1 and iso88591 are
+// all iso88591.
+func normalizeCodeset(codeset string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return -1
+	}, codeset)
+}
+
+// localeCharset returns the character set of the client's locale, taken
+// from LC_ALL, LC_CTYPE or LANG as sent in env requests.  A locale without
+// a codeset, or no locale at all, means UTF-8.  Codesets we don't know
+// get plain ASCII, per the encoding fallback set in main.
+func localeCharset(env map[string]string) string {
+	locale := env["LC_ALL"]
+	if locale == "" {
+		locale = env["LC_CTYPE"]
+	}
+	if locale == "" {
+		locale = env["LANG"]
+	}
+	if locale == "C" || locale == "POSIX" {
+		return "US-ASCII"
+	}
+	if i := strings.IndexByte(locale, '@'); i >= 0 {
+		locale = locale[:i]
+	}
+	i := strings.IndexByte(locale, '.')
+	if i < 0 || i == len(locale)-1 {
+		return "UTF-8"
+	}
+	codeset := locale[i+1:]
+	if name, ok := codesets[normalizeCodeset(codeset)]; ok {
+		return name
+	}
+	return codeset
+}
+
+// maxEnv limits how many variables a client can set.
+const maxEnv = 16
+
+// acceptEnv reports whether we keep an environment variable sent by the
+// client.  Like sshd's usual AcceptEnv, that's the locale, and COLORTERM,
+// which says whether the terminal does 24-bit color.
+func acceptEnv(name string) bool {
+	return name == "LANG" || strings.HasPrefix(name, "LC_") || name == "COLORTERM"
+}
+
+// colortermColor returns what the client's COLORTERM says about 24-bit
+// color.  Only "truecolor" and "24bit" mean anything.
+func colortermColor(env map[string]string) headlesstcell.TrueColorMode {
+	switch env["COLORTERM"] {
+	case "truecolor", "24bit":
+		return headlesstcell.TrueColorOn
+	}
+	return headlesstcell.TrueColorAuto
+}
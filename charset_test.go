@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gdamore/tcell"
+)
+
+func TestLocaleCharset(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"no locale", nil, "UTF-8"},
+		{"no codeset", map[string]string{"LANG": "en_US"}, "UTF-8"},
+		{"empty codeset", map[string]string{"LANG": "en_US."}, "UTF-8"},
+		{"LANG", map[string]string{"LANG": "en_US.UTF-8"}, "UTF-8"},
+		{"LC_CTYPE over LANG", map[string]string{"LANG": "en_US.UTF-8", "LC_CTYPE": "de_DE.ISO-8859-1"}, "ISO8859-1"},
+		{"LC_ALL over LC_CTYPE", map[string]string{"LC_CTYPE": "de_DE.ISO-8859-1", "LC_ALL": "ru_RU.KOI8-R"}, "KOI8-R"},
+		{"empty LC_ALL ignored", map[string]string{"LC_ALL": "", "LANG": "ru_RU.KOI8-R"}, "KOI8-R"},
+		{"other LC_ ignored", map[string]string{"LC_MESSAGES": "ru_RU.KOI8-R"}, "UTF-8"},
+		{"C", map[string]string{"LANG": "C"}, "US-ASCII"},
+		{"POSIX", map[string]string{"LC_ALL": "POSIX", "LANG": "en_US.UTF-8"}, "US-ASCII"},
+		{"C.UTF-8", map[string]string{"LANG": "C.UTF-8"}, "UTF-8"},
+		{"modifier", map[string]string{"LANG": "de_DE.ISO-8859-15@euro"}, "ISO8859-15"},
+		{"modifier without codeset", map[string]string{"LANG": "de_DE@euro"}, "UTF-8"},
+		{"utf8", map[string]string{"LANG": "en_US.utf8"}, "UTF-8"},
+		{"iso88591", map[string]string{"LANG": "de_DE.iso88591"}, "ISO8859-1"},
+		{"iso885915", map[string]string{"LANG": "fr_FR.iso885915@euro"}, "ISO8859-15"},
+		{"koi8r", map[string]string{"LANG": "ru_RU.koi8r"}, "KOI8-R"},
+		{"eucjp", map[string]string{"LANG": "ja_JP.eucJP"}, "EUC-JP"},
+		{"sjis", map[string]string{"LANG": "ja_JP.SJIS"}, "Shift_JIS"},
+		{"glibc ASCII", map[string]string{"LANG": "C.ANSI_X3.4-1968"}, "US-ASCII"},
+		{"CP437", map[string]string{"LANG": "en_US.CP437"}, "CP437"},
+		{"cp437", map[string]string{"LANG": "en_US.cp437"}, "CP437"},
+		{"IBM437", map[string]string{"LANG": "en_US.IBM437"}, "IBM437"},
+		{"unknown", map[string]string{"LANG": "xx_XX.EBCDIC-US"}, "EBCDIC-US"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := localeCharset(tt.env)
+			if got != tt.want {
+				t.Fatalf("localeCharset(%v) = %q, want %q", tt.env, got, tt.want)
+			}
+			if tt.name != "unknown" && tcell.GetEncoding(got) == nil {
+				t.Fatalf("%q isn't registered", got)
+			}
+		})
+	}
+}
+
+func TestCodesetsRegistered(t *testing.T) {
+	for norm, name := range codesets {
+		if tcell.GetEncoding(name) == nil {
+			t.Errorf("%s (%s) isn't registered", name, norm)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// command is something a player can type at the prompt.
+type command struct {
+	usage string
+	help  string
+	role  string // required role, if any
+	run   func(sess *session, args []string, out io.Writer) error
+}
+
+// allowed reports whether the account may use the command.
+func (cmd *command) allowed(a *Account) bool {
+	return cmd.role == "" || a.hasRole(cmd.role) || a.hasRole(roleAdmin)
+}
+
+var (
+	errUsage          = errors.New("usage")
+	errUnknownCommand = errors.New("unknown command")
+)
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help": {
+			usage: "help",
+			help:  "list commands",
+			run:   cmdHelp,
+		},
+		"who": {
+			usage: "who",
+			help:  "list who's online",
+			run:   cmdWho,
+		},
+		"status": {
+			usage: "status",
+			help:  "show how the server is doing",
+			run:   cmdStatus,
+		},
+		"quit": {
+			usage: "quit",
+			help:  "leave the game",
+			run:   cmdQuit,
+		},
+		"takeover": {
+			usage: "takeover",
+			help:  "move your game from your other connection to this one",
+			run:   cmdTakeover,
+		},
+		"color": {
+			usage: "color [auto | truecolor | palette]",
+			help:  "show or set whether colors are sent in 24 bits or from your terminal's palette",
+			run:   cmdColor,
+		},
+		"key": {
+			usage: "key list | key add <type> <base64> [comment] | key revoke <n>",
+			help:  "manage the SSH keys you can log in with",
+			run:   cmdKey,
+		},
+		"ban": {
+			usage: "ban <address or CIDR> [duration] [reason]",
+			help:  "ban an address range, for a time or forever",
+			role:  roleAdmin,
+			run:   cmdBan,
+		},
+		"unban": {
+			usage: "unban <address or CIDR>",
+			help:  "lift a ban",
+			role:  roleAdmin,
+			run:   cmdUnban,
+		},
+		"bans": {
+			usage: "bans",
+			help:  "list bans",
+			role:  roleAdmin,
+			run:   cmdBans,
+		},
+	}
+}
+
+// runCommand parses and runs one line of player input, writing any
+// output or errors to out.  The error is returned too, for exec requests'
+// exit status.
+func runCommand(sess *session, line string, out io.Writer) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+	name := strings.ToLower(args[0])
+	cmd, ok := commands[name]
+	if !ok || !cmd.allowed(sess.account) {
+		fmt.Fprintf(out, "Unknown command %q; try help\n", args[0])
+		return errUnknownCommand
+	}
+	err := cmd.run(sess, args[1:], out)
+	if err == errUsage {
+		fmt.Fprintf(out, "Usage: %s\n", cmd.usage)
+	} else if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", name, err)
+	}
+	return err
+}
+
+func cmdHelp(sess *session, args []string, out io.Writer) error {
+	names := make([]string, 0, len(commands))
+	for name, cmd := range commands {
+		if cmd.allowed(sess.account) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%-8s %s\n", name, commands[name].help)
+	}
+	return nil
+}
+
+func cmdWho(sess *session, args []string, out io.Writer) error {
+	all := sess.srv.sessions.All()
+	for _, other := range all {
+		idle := time.Since(other.LastInput()).Truncate(time.Second)
+		status := ""
+		if other.LinkDead() {
+			status = " (link-dead)"
+		}
+		fmt.Fprintf(out, "%-20s on %-8s idle %s%s\n", other.account.Name,
+			time.Since(other.connected).Truncate(time.Minute), idle, status)
+	}
+	fmt.Fprintf(out, "%d online.\n", len(all))
+	return nil
+}
+
+func cmdStatus(sess *session, args []string, out io.Writer) error {
+	srv := sess.srv
+	fmt.Fprintf(out, "Up %s.\n", time.Since(srv.started).Truncate(time.Second))
+	fmt.Fprintf(out, "%d players online, %d of %d connections in use.\n",
+		srv.sessions.Len(), srv.activeConns(), srv.cfg.Network.MaxSessions)
+	if r, ok := sess.Screen().(headlesstcell.OutputReporter); ok {
+		st := r.OutputStats()
+		fmt.Fprintf(out, "Sent you %d bytes in %d frames, %d dropped; writes take %s on average, %s at most.\n",
+			st.Bytes, st.Frames, st.Dropped, st.AvgWrite().Round(time.Microsecond), st.MaxWrite.Round(time.Microsecond))
+	}
+	if t := sess.Telnet(); t != nil && t.optionEnabled(telnetOptMCCP2) {
+		sent, wire := t.compressionStats()
+		fmt.Fprintf(out, "Compressing your output: %d bytes have gone out as %d (%.0f%%).\n",
+			sent, wire, 100*float64(wire)/float64(sent))
+	}
+	return nil
+}
+
+func cmdQuit(sess *session, args []string, out io.Writer) error {
+	fmt.Fprintln(out, "Goodbye!")
+	sess.close()
+	return nil
+}
+
+func cmdTakeover(sess *session, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if sess.Screen() == nil {
+		return errors.New("you need a terminal to take over a game")
+	}
+	other := sess.playingElsewhere()
+	if other == nil {
+		return errors.New("you aren't playing anywhere else")
+	}
+	fmt.Fprintf(out, "Taking over your game from %s.\n", other.RemoteAddr())
+	sess.handoff(other)
+	return nil
+}
+
+func cmdColor(sess *session, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	acct, err := sess.srv.accounts.LookupID(sess.account.ID)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		switch acct.Color {
+		case "":
+			fmt.Fprintln(out, "Colors are sent however your client says it can take them.")
+		case colorTrueColor:
+			fmt.Fprintln(out, "Colors are sent in 24 bits.")
+		case colorPalette:
+			fmt.Fprintln(out, "Colors are sent from your terminal's palette.")
+		}
+		return nil
+	}
+
+	color := strings.ToLower(args[0])
+	switch color {
+	case "auto":
+		color = ""
+	case colorTrueColor, colorPalette:
+	default:
+		return errUsage
+	}
+	if err := sess.srv.accounts.SetColor(acct.ID, color); err != nil {
+		return err
+	}
+	sess.applyColor(color)
+	fmt.Fprintln(out, "Color setting saved.")
+	return nil
+}
+
+func cmdKey(sess *session, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	acct, err := sess.srv.accounts.LookupID(sess.account.ID)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		if len(acct.Keys) == 0 {
+			fmt.Fprintln(out, "No keys.")
+		}
+		for i, line := range acct.Keys {
+			key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(out, "%d. %s %s %s\n", i+1, key.Type(), ssh.FingerprintSHA256(key), comment)
+		}
+		return nil
+
+	case "add":
+		if len(args) < 3 {
+			return errUsage
+		}
+		if sess.authMethod != authPassword {
+			return errors.New("log in with your password to change keys")
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(args[1:], " ")))
+		if err != nil {
+			return err
+		}
+		if err := sess.srv.accounts.AddKey(acct.ID, key, comment); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Added %s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+		return nil
+
+	case "revoke":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if sess.authMethod != authPassword {
+			return errors.New("log in with your password to change keys")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 || n > len(acct.Keys) {
+			return fmt.Errorf("no key %q; see key list", args[1])
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(acct.Keys[n-1]))
+		if err != nil {
+			return err
+		}
+		fp := ssh.FingerprintSHA256(key)
+		if err := sess.srv.accounts.RemoveKey(acct.ID, fp); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked %s\n", fp)
+		return nil
+	}
+	return errUsage
+}
+
+func cmdBan(sess *session, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	var d time.Duration
+	if len(args) > 1 {
+		if v, err := time.ParseDuration(args[1]); err == nil {
+			d = v
+			args = append(args[:1:1], args[2:]...)
+		}
+	}
+	ban, err := sess.srv.bans.Add(args[0], d, strings.Join(args[1:], " "), sess.account.Name)
+	if err != nil {
+		return err
+	}
+	log.Printf("%q banned %s for %v: %s", sess.account.Name, ban.CIDR, d, ban.Reason)
+	if d > 0 {
+		fmt.Fprintf(out, "Banned %s until %s.\n", ban.CIDR, ban.Expires.Format(time.RFC1123))
+	} else {
+		fmt.Fprintf(out, "Banned %s.\n", ban.CIDR)
+	}
+
+	// Kick anyone already connected from the range, but not whoever
+	// banned it, who may well be connected from it themselves.
+	if ban.ipnet.Contains(remoteIP(sess.RemoteAddr())) {
+		fmt.Fprintln(out, "Your own address is in that range; you won't be able to reconnect.")
+	}
+	sess.srv.sessions.Each(func(other *session) {
+		if other != sess && ban.ipnet.Contains(remoteIP(other.RemoteAddr())) {
+			fmt.Fprintf(out, "Disconnecting %s.\n", other.account.Name)
+			other.notify("You have been banned.")
+			time.AfterFunc(time.Second, other.close)
+		}
+	})
+	return nil
+}
+
+func cmdUnban(sess *session, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	found, err := sess.srv.bans.Remove(args[0])
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s isn't banned", args[0])
+	}
+	log.Printf("%q unbanned %s", sess.account.Name, args[0])
+	fmt.Fprintf(out, "Unbanned %s.\n", args[0])
+	return nil
+}
+
+func cmdBans(sess *session, args []string, out io.Writer) error {
+	bans := sess.srv.bans.List()
+	if len(bans) == 0 {
+		fmt.Fprintln(out, "No bans.")
+	}
+	for _, b := range bans {
+		until := "forever"
+		if !b.Expires.IsZero() {
+			until = "until " + b.Expires.Format(time.RFC1123)
+		}
+		fmt.Fprintf(out, "%s %s by %s: %s\n", b.CIDR, until, b.By, b.Reason)
+	}
+	return nil
+}
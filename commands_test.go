@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell"
+	"golang.org/x/crypto/ssh"
+)
+
+func testSession(t *testing.T, srv *server, name, ip string) *session {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(screen.Fini)
+	acct := &Account{ID: name, Name: name}
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	sess := newSession(srv, acct, authPassword, addr, "xterm", 80, 24, screen)
+	srv.sessions.Add(sess)
+	return sess
+}
+
+func TestBanSparesBanner(t *testing.T) {
+	bans, err := loadBans(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(DefaultConfig(), nil, bans, &ssh.ServerConfig{})
+	admin := testSession(t, srv, "admin", "192.0.2.1")
+	other := testSession(t, srv, "other", "192.0.2.2")
+	outside := testSession(t, srv, "outside", "198.51.100.1")
+
+	var out strings.Builder
+	if err := cmdBan(admin, []string{"192.0.2.0/24", "1h", "scanning"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Disconnecting other.") {
+		t.Errorf("didn't disconnect a player in the range:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "Disconnecting admin.") {
+		t.Errorf("disconnected the admin who banned the range:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "Your own address is in that range") {
+		t.Errorf("didn't warn the admin:\n%s", out.String())
+	}
+
+	select {
+	case <-other.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session in the range still open")
+	}
+	for _, sess := range []*session{admin, outside} {
+		select {
+		case <-sess.done:
+			t.Errorf("%s's session closed", sess.account.Name)
+		default:
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// Config is the server configuration.  It's read from a YAML file, then
+// overridden by MUDENGINE_* environment variables, then by flags.
+type Config struct {
+	Network NetworkConfig `yaml:"network"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Render  RenderConfig  `yaml:"render"`
+	World   WorldConfig   `yaml:"world"`
+	Log     LogConfig     `yaml:"log"`
+}
+
+type NetworkConfig struct {
+	Listen            string        `yaml:"listen"`
+	TelnetListen      string        `yaml:"telnet_listen"`      // empty disables telnet
+	TelnetCompression bool          `yaml:"telnet_compression"` // offer MCCP2
+	WebListen         string        `yaml:"web_listen"`         // empty disables the browser client
+	ProxyProtocol     []string      `yaml:"proxy_protocol"`     // upstreams trusted to send PROXY headers
+	ShutdownWarning   time.Duration `yaml:"shutdown_warning"`   // countdown players see before shutdown
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`   // how long sessions get to end cleanly
+	HandshakeTimeout  time.Duration `yaml:"handshake_timeout"`
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"` // 0 disables keepalives
+	KeepaliveMissed   int           `yaml:"keepalive_missed"`   // unanswered keepalives before disconnecting
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`       // 0 disables; staff are exempt
+	IdleWarning       time.Duration `yaml:"idle_warning"`       // how long before the idle timeout players are warned
+	LinkDeadGrace     time.Duration `yaml:"link_dead_grace"`    // how long a dropped player's game waits for them; 0 disables
+	MaxSessions       int           `yaml:"max_sessions"`       // connections allowed at once
+	ConnBurst         int           `yaml:"conn_burst"`         // connections an IP can make at once...
+	ConnInterval      time.Duration `yaml:"conn_interval"`      // ...and then one per interval
+}
+
+type AuthConfig struct {
+	HostKeys    []string      `yaml:"host_keys"` // ed25519, ecdsa, rsa
+	MaxFailures int           `yaml:"max_failures"`
+	Lockout     time.Duration `yaml:"lockout"`
+
+	// Each IP may fail to log in FailureBurst times, and then once per
+	// FailureInterval, before its logins are refused.
+	FailureBurst    int           `yaml:"failure_burst"`
+	FailureInterval time.Duration `yaml:"failure_interval"`
+}
+
+type RenderConfig struct {
+	FrameInterval time.Duration `yaml:"frame_interval"`
+	LogPane       Rect          `yaml:"log_pane"`
+	DefaultTerm   string        `yaml:"default_term"`  // for clients whose TERM we don't know
+	TerminfoDirs  []string      `yaml:"terminfo_dirs"` // compiled terminfo databases to search
+	MaxFPS        int           `yaml:"max_fps"`       // frames a client is sent a second, at most
+	WriteTimeout  time.Duration `yaml:"write_timeout"` // before a client that's stopped reading is dropped
+	OutputBudget  int           `yaml:"output_budget"` // bytes queued for a client before frames are dropped
+}
+
+type WorldConfig struct {
+	DataDir  string `yaml:"data_dir"`
+	Accounts string `yaml:"accounts"` // relative to DataDir
+	Bans     string `yaml:"bans"`     // relative to DataDir
+}
+
+type LogConfig struct {
+	File string `yaml:"file"` // empty for stderr
+}
+
+// Rect is a screen rectangle.
+type Rect struct {
+	X      int `yaml:"x"`
+	Y      int `yaml:"y"`
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+}
+
+func (r Rect) Rectangle() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// DefaultConfig returns the configuration used for anything a config file
+// doesn't set.
+func DefaultConfig() *Config {
+	return &Config{
+		Network: NetworkConfig{
+			Listen:            "0.0.0.0:2022",
+			TelnetCompression: true,
+			ShutdownWarning:   10 * time.Second,
+			ShutdownTimeout:   5 * time.Second,
+			HandshakeTimeout:  30 * time.Second,
+			KeepaliveInterval: 30 * time.Second,
+			KeepaliveMissed:   3,
+			IdleTimeout:       30 * time.Minute,
+			IdleWarning:       5 * time.Minute,
+			LinkDeadGrace:     2 * time.Minute,
+			MaxSessions:       200,
+			ConnBurst:         5,
+			ConnInterval:      6 * time.Second,
+		},
+		Auth: AuthConfig{
+			HostKeys:    []string{"ed25519"},
+			MaxFailures: 5,
+			Lockout:     15 * time.Minute,
+
+			FailureBurst:    10,
+			FailureInterval: time.Minute,
+		},
+		Render: RenderConfig{
+			FrameInterval: 50 * time.Millisecond,
+			LogPane:       Rect{X: 5, Y: 5, Width: 45, Height: 15},
+			DefaultTerm:   "xterm",
+			TerminfoDirs:  headlesstcell.DefaultTerminfoDirs,
+			MaxFPS:        30,
+			WriteTimeout:  30 * time.Second,
+			OutputBudget:  64 << 10,
+		},
+		World: WorldConfig{
+			DataDir:  "data",
+			Accounts: "accounts.json",
+			Bans:     "bans.json",
+		},
+	}
+}
+
+// Path resolves name relative to the data directory.
+func (c *Config) Path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(c.World.DataDir, name)
+}
+
+// setting is a config value that can be set from a flag or environment
+// variable.
+type setting struct {
+	name  string
+	usage string
+	set   func(string) error
+}
+
+func stringSetting(p *string) func(string) error {
+	return func(s string) error {
+		*p = s
+		return nil
+	}
+}
+
+func listSetting(p *[]string) func(string) error {
+	return func(s string) error {
+		*p = strings.Split(s, ",")
+		return nil
+	}
+}
+
+func boolSetting(p *bool) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseBool(s)
+		*p = v
+		return err
+	}
+}
+
+func intSetting(p *int) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		*p = v
+		return err
+	}
+}
+
+func durationSetting(p *time.Duration) func(string) error {
+	return func(s string) error {
+		v, err := time.ParseDuration(s)
+		*p = v
+		return err
+	}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", "address to listen for SSH on", stringSetting(&c.Network.Listen)},
+		{"telnet-listen", "address to listen for telnet on (empty to disable)", stringSetting(&c.Network.TelnetListen)},
+		{"telnet-compression", "offer MCCP2 compression to telnet clients", boolSetting(&c.Network.TelnetCompression)},
+		{"web-listen", "address to serve the browser client on (empty to disable)", stringSetting(&c.Network.WebListen)},
+		{"proxy-protocol", "comma-separated load balancers trusted to send PROXY headers", listSetting(&c.Network.ProxyProtocol)},
+		{"shutdown-warning", "countdown players get before a shutdown", durationSetting(&c.Network.ShutdownWarning)},
+		{"shutdown-timeout", "how long sessions get to end cleanly at shutdown", durationSetting(&c.Network.ShutdownTimeout)},
+		{"handshake-timeout", "time allowed for the SSH handshake and login", durationSetting(&c.Network.HandshakeTimeout)},
+		{"keepalive-interval", "time between SSH keepalives (0 to disable)", durationSetting(&c.Network.KeepaliveInterval)},
+		{"keepalive-missed", "unanswered keepalives before disconnecting", intSetting(&c.Network.KeepaliveMissed)},
+		{"idle-timeout", "disconnect players idle this long (0 to disable)", durationSetting(&c.Network.IdleTimeout)},
+		{"idle-warning", "warn idle players this long before disconnecting them", durationSetting(&c.Network.IdleWarning)},
+		{"link-dead-grace", "how long a dropped player's game waits for them to reconnect (0 to disable)", durationSetting(&c.Network.LinkDeadGrace)},
+		{"max-sessions", "connections allowed at once", intSetting(&c.Network.MaxSessions)},
+		{"conn-burst", "connections one IP can make at once", intSetting(&c.Network.ConnBurst)},
+		{"conn-interval", "after the burst, how often one IP can connect", durationSetting(&c.Network.ConnInterval)},
+		{"host-keys", "comma-separated host key algorithms: ed25519, ecdsa, rsa", listSetting(&c.Auth.HostKeys)},
+		{"max-failures", "failed logins before an account is locked", intSetting(&c.Auth.MaxFailures)},
+		{"lockout", "how long accounts stay locked", durationSetting(&c.Auth.Lockout)},
+		{"failure-burst", "failed logins one IP can make at once", intSetting(&c.Auth.FailureBurst)},
+		{"failure-interval", "after the burst, how often one IP can fail to log in", durationSetting(&c.Auth.FailureInterval)},
+		{"frame-interval", "time between game frames", durationSetting(&c.Render.FrameInterval)},
+		{"default-term", "terminal type to assume for unknown TERMs", stringSetting(&c.Render.DefaultTerm)},
+		{"terminfo-dirs", "comma-separated terminfo database directories", listSetting(&c.Render.TerminfoDirs)},
+		{"max-fps", "frames a client is sent a second, at most (0 for no limit)", intSetting(&c.Render.MaxFPS)},
+		{"write-timeout", "how long a write to a client may take before they're dropped (0 for no limit)", durationSetting(&c.Render.WriteTimeout)},
+		{"output-budget", "bytes queued for a client before frames are dropped (0 for no limit)", intSetting(&c.Render.OutputBudget)},
+		{"data", "directory for accounts, host keys and world data", stringSetting(&c.World.DataDir)},
+		{"accounts", "accounts file, relative to the data directory", stringSetting(&c.World.Accounts)},
+		{"bans", "ban list file, relative to the data directory", stringSetting(&c.World.Bans)},
+		{"log", "log file (default stderr)", stringSetting(&c.Log.File)},
+	}
+}
+
+// envName returns the environment variable for a setting, e.g.
+// MUDENGINE_HOST_KEYS for host-keys.
+func envName(name string) string {
+	return "MUDENGINE_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// LoadConfig builds the configuration from the config file named by the
+// -config flag, the environment and the rest of args, then validates it.
+func LoadConfig(args []string) (*Config, []string, error) {
+	c := DefaultConfig()
+	fs := flag.NewFlagSet("mudengine", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("MUDENGINE_CONFIG"), "YAML config file (env MUDENGINE_CONFIG)")
+	flags := make(map[string]*string)
+	for _, s := range c.settings() {
+		flags[s.name] = fs.String(s.name, "", s.usage+" (env "+envName(s.name)+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return nil, nil, err
+		}
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+
+	var errs []string
+	for _, s := range c.settings() {
+		if v, ok := os.LookupEnv(envName(s.name)); ok {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", envName(s.name), err))
+			}
+		}
+	}
+	settings := make(map[string]setting)
+	for _, s := range c.settings() {
+		settings[s.name] = s
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := settings[f.Name]; ok {
+			if err := s.set(*flags[f.Name]); err != nil {
+				errs = append(errs, fmt.Sprintf("-%s: %v", f.Name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, nil, errors.New(strings.Join(errs, "\n"))
+	}
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+// Validate returns an error listing every problem with the configuration.
+func (c *Config) Validate() error {
+	var errs []string
+	if err := checkListen(c.Network.Listen); err != nil {
+		errs = append(errs, fmt.Sprintf("network.listen: %v", err))
+	}
+	if c.Network.TelnetListen != "" {
+		if err := checkListen(c.Network.TelnetListen); err != nil {
+			errs = append(errs, fmt.Sprintf("network.telnet_listen: %v", err))
+		}
+	}
+	if c.Network.WebListen != "" {
+		if err := checkListen(c.Network.WebListen); err != nil {
+			errs = append(errs, fmt.Sprintf("network.web_listen: %v", err))
+		}
+	}
+	if _, err := parseTrusted(c.Network.ProxyProtocol); err != nil {
+		errs = append(errs, fmt.Sprintf("network.proxy_protocol: %v", err))
+	}
+	if c.Network.ShutdownWarning < 0 {
+		errs = append(errs, "network.shutdown_warning: must not be negative")
+	}
+	if c.Network.ShutdownTimeout <= 0 {
+		errs = append(errs, "network.shutdown_timeout: must be positive")
+	}
+	if c.Network.HandshakeTimeout <= 0 {
+		errs = append(errs, "network.handshake_timeout: must be positive")
+	}
+	if c.Network.KeepaliveInterval < 0 {
+		errs = append(errs, "network.keepalive_interval: must not be negative")
+	}
+	if c.Network.KeepaliveInterval > 0 && c.Network.KeepaliveMissed < 1 {
+		errs = append(errs, "network.keepalive_missed: must be at least 1")
+	}
+	if c.Network.IdleTimeout < 0 {
+		errs = append(errs, "network.idle_timeout: must not be negative")
+	}
+	if c.Network.IdleWarning < 0 || c.Network.IdleTimeout > 0 && c.Network.IdleWarning >= c.Network.IdleTimeout {
+		errs = append(errs, "network.idle_warning: must be at least 0 and less than the idle timeout")
+	}
+	if c.Network.LinkDeadGrace < 0 {
+		errs = append(errs, "network.link_dead_grace: must not be negative")
+	}
+	if c.Network.MaxSessions < 1 {
+		errs = append(errs, "network.max_sessions: must be at least 1")
+	}
+	if c.Network.ConnBurst < 1 {
+		errs = append(errs, "network.conn_burst: must be at least 1")
+	}
+	if c.Network.ConnInterval <= 0 {
+		errs = append(errs, "network.conn_interval: must be positive")
+	}
+	if len(c.Auth.HostKeys) == 0 {
+		errs = append(errs, "auth.host_keys: at least one host key is required")
+	}
+	for _, alg := range c.Auth.HostKeys {
+		switch alg {
+		case "ed25519", "ecdsa", "rsa":
+		default:
+			errs = append(errs, fmt.Sprintf("auth.host_keys: unknown algorithm %q", alg))
+		}
+	}
+	if c.Auth.MaxFailures < 1 {
+		errs = append(errs, "auth.max_failures: must be at least 1")
+	}
+	if c.Auth.Lockout < 0 {
+		errs = append(errs, "auth.lockout: must not be negative")
+	}
+	if c.Auth.FailureBurst < 1 {
+		errs = append(errs, "auth.failure_burst: must be at least 1")
+	}
+	if c.Auth.FailureInterval <= 0 {
+		errs = append(errs, "auth.failure_interval: must be positive")
+	}
+	if c.Render.FrameInterval <= 0 {
+		errs = append(errs, "render.frame_interval: must be positive")
+	}
+	if p := c.Render.LogPane; p.X < 0 || p.Y < 0 || p.Width < 1 || p.Height < 1 {
+		errs = append(errs, "render.log_pane: must have a non-negative position and positive size")
+	}
+	if c.Render.MaxFPS < 0 {
+		errs = append(errs, "render.max_fps: must not be negative")
+	}
+	if c.Render.WriteTimeout < 0 {
+		errs = append(errs, "render.write_timeout: must not be negative")
+	}
+	if c.Render.OutputBudget < 0 {
+		errs = append(errs, "render.output_budget: must not be negative")
+	}
+	if c.World.DataDir == "" {
+		errs = append(errs, "world.data_dir: must not be empty")
+	}
+	if c.World.Accounts == "" {
+		errs = append(errs, "world.accounts: must not be empty")
+	}
+	if c.World.Bans == "" {
+		errs = append(errs, "world.bans: must not be empty")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// checkListen checks addr is a host and port that can be listened on.
+func checkListen(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = net.LookupPort("tcp", port)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mudengine.yaml")
+	yaml := "network:\n  listen: 127.0.0.1:3000\nauth:\n  lockout: 1m\n  max_failures: 3\n"
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		listen      string
+		lockout     time.Duration
+		maxFailures int
+		rest        []string
+	}{
+		{
+			name:        "defaults",
+			listen:      "0.0.0.0:2022",
+			lockout:     15 * time.Minute,
+			maxFailures: 5,
+		},
+		{
+			name:        "file",
+			args:        []string{"-config", file},
+			listen:      "127.0.0.1:3000",
+			lockout:     time.Minute,
+			maxFailures: 3,
+		},
+		{
+			name:        "file from env",
+			env:         map[string]string{"MUDENGINE_CONFIG": file},
+			listen:      "127.0.0.1:3000",
+			lockout:     time.Minute,
+			maxFailures: 3,
+		},
+		{
+			name:        "env over file",
+			env:         map[string]string{"MUDENGINE_LOCKOUT": "2m"},
+			args:        []string{"-config", file},
+			listen:      "127.0.0.1:3000",
+			lockout:     2 * time.Minute,
+			maxFailures: 3,
+		},
+		{
+			name:        "flags over env",
+			env:         map[string]string{"MUDENGINE_LOCKOUT": "2m", "MUDENGINE_LISTEN": ":4000"},
+			args:        []string{"-config", file, "-lockout", "3m", "extra"},
+			listen:      ":4000",
+			lockout:     3 * time.Minute,
+			maxFailures: 3,
+			rest:        []string{"extra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, rest, err := LoadConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Network.Listen != tt.listen {
+				t.Errorf("listen %q, want %q", c.Network.Listen, tt.listen)
+			}
+			if c.Auth.Lockout != tt.lockout {
+				t.Errorf("lockout %v, want %v", c.Auth.Lockout, tt.lockout)
+			}
+			if c.Auth.MaxFailures != tt.maxFailures {
+				t.Errorf("max failures %d, want %d", c.Auth.MaxFailures, tt.maxFailures)
+			}
+			if strings.Join(rest, " ") != strings.Join(tt.rest, " ") {
+				t.Errorf("args left %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, yaml string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"bad duration flag", nil, []string{"-lockout", "soon"}, "-lockout: "},
+		{"bad duration env", map[string]string{"MUDENGINE_FRAME_INTERVAL": "50"}, nil, "MUDENGINE_FRAME_INTERVAL: "},
+		{"bad duration file", nil, []string{"-config", write("d.yaml", "auth:\n  lockout: soon\n")}, "d.yaml: "},
+		{"bad int env", map[string]string{"MUDENGINE_MAX_FAILURES": "many"}, nil, "MUDENGINE_MAX_FAILURES: "},
+		{"unknown field", nil, []string{"-config", write("u.yaml", "network:\n  port: 22\n")}, "field port not found"},
+		{"missing file", nil, []string{"-config", filepath.Join(dir, "none.yaml")}, "no such file"},
+		{"unknown flag", nil, []string{"-port", "22"}, "not defined"},
+		{"invalid after loading", nil, []string{"-listen", ":99999"}, "network.listen: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, _, err := LoadConfig(append([]string{}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string // in the error; empty for none
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"named port", func(c *Config) { c.Network.Listen = "localhost:ssh" }, ""},
+		{"no port", func(c *Config) { c.Network.Listen = "localhost" }, "network.listen: "},
+		{"port too big", func(c *Config) { c.Network.Listen = ":65536" }, "network.listen: "},
+		{"negative port", func(c *Config) { c.Network.Listen = ":-1" }, "network.listen: "},
+		{"unknown port name", func(c *Config) { c.Network.Listen = ":nonesuch" }, "network.listen: "},
+		{"telnet disabled", func(c *Config) { c.Network.TelnetListen = "" }, ""},
+		{"bad telnet port", func(c *Config) { c.Network.TelnetListen = ":70000" }, "network.telnet_listen: "},
+		{"web port", func(c *Config) { c.Network.WebListen = "127.0.0.1:8080" }, ""},
+		{"bad web port", func(c *Config) { c.Network.WebListen = "127.0.0.1:http-ish" }, "network.web_listen: "},
+		{"no host keys", func(c *Config) { c.Auth.HostKeys = nil }, "auth.host_keys: "},
+		{"unknown host key", func(c *Config) { c.Auth.HostKeys = []string{"dsa"} }, `unknown algorithm "dsa"`},
+		{"no failures allowed", func(c *Config) { c.Auth.MaxFailures = 0 }, "auth.max_failures: "},
+		{"negative lockout", func(c *Config) { c.Auth.Lockout = -time.Second }, "auth.lockout: "},
+		{"zero frame interval", func(c *Config) { c.Render.FrameInterval = 0 }, "render.frame_interval: "},
+		{"empty log pane", func(c *Config) { c.Render.LogPane.Width = 0 }, "render.log_pane: "},
+		{"no data dir", func(c *Config) { c.World.DataDir = "" }, "world.data_dir: "},
+		{"every problem", func(c *Config) {
+			c.Network.Listen = ""
+			c.Auth.Lockout = -1
+		}, "network.listen: missing port in address\nauth.lockout: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.modify(c)
+			err := c.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Fatalf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// telnetOptGMCP is the Generic MUD Communication Protocol, which carries
+// JSON messages like `Char.Vitals {"hp": 10}` alongside the text.
+const telnetOptGMCP = 201
+
+// gmcpPackage is a GMCP package the server speaks.  Clients enable the
+// ones they want with Core.Supports.Set; Core is always enabled.
+type gmcpPackage struct {
+	name    string
+	version int
+	// receive handles a message from the client in this package, if
+	// the package takes any.
+	receive func(g *gmcpState, message string, data json.RawMessage) error
+}
+
+var gmcpPackages = make(map[string]*gmcpPackage)
+
+// registerGMCP adds a package the server speaks.
+func registerGMCP(pkg *gmcpPackage) {
+	gmcpPackages[strings.ToLower(pkg.name)] = pkg
+}
+
+func init() {
+	registerGMCP(&gmcpPackage{name: "Core", version: 1, receive: gmcpCore})
+	registerGMCP(&gmcpPackage{name: "Char", version: 1})
+	registerGMCP(&gmcpPackage{name: "Comm", version: 1})
+	// No Room yet: there are no rooms to send Room.Info about, and
+	// clients that saw it offered would wait for messages that never come.
+}
+
+// gmcpState is a telnet connection's GMCP session.
+type gmcpState struct {
+	t *telnetConn
+
+	// guarded by the mutex
+	supports      map[string]int // enabled packages and their versions, by lower-case name
+	client        string         // from Core.Hello
+	clientVersion string
+	sync.Mutex
+}
+
+func newGMCPState(t *telnetConn) *gmcpState {
+	return &gmcpState{t: t, supports: make(map[string]int)}
+}
+
+// enabled reports whether the client has enabled message's package.
+func (g *gmcpState) enabled(message string) bool {
+	if !g.t.optionEnabled(telnetOptGMCP) {
+		return false
+	}
+	name := strings.ToLower(message)
+	if strings.HasPrefix(name, "core.") {
+		return true
+	}
+	g.Lock()
+	defer g.Unlock()
+	// Clients may enable a whole package or just part, like Comm.Channel.
+	for {
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+		if _, ok := g.supports[name]; ok {
+			return true
+		}
+	}
+}
+
+// send sends message with data marshalled as JSON, or with no data if
+// data is nil, if the client has enabled its package.
+func (g *gmcpState) send(message string, data interface{}) error {
+	if !g.enabled(message) {
+		return nil
+	}
+	payload := []byte(message)
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		payload = append(append(payload, ' '), b...)
+	}
+	return g.t.subnegotiate(telnetOptGMCP, payload)
+}
+
+// receive handles a message from the client.
+func (g *gmcpState) receive(b []byte) error {
+	message, data := b, []byte(nil)
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		message, data = b[:i], bytes.TrimSpace(b[i+1:])
+	}
+	name := string(message)
+	pkgName := strings.ToLower(name)
+	if i := strings.IndexByte(pkgName, '.'); i >= 0 {
+		pkgName = pkgName[:i]
+	}
+	pkg, ok := gmcpPackages[pkgName]
+	if !ok || pkg.receive == nil {
+		// Clients send all sorts; ignore what we don't speak.
+		return nil
+	}
+	return pkg.receive(g, name, json.RawMessage(data))
+}
+
+// gmcpCore handles the Core package: the client's hello, pings, and the
+// packages it wants.
+func gmcpCore(g *gmcpState, message string, data json.RawMessage) error {
+	switch strings.ToLower(message) {
+	case "core.hello":
+		var hello struct {
+			Client  string `json:"client"`
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(data, &hello); err != nil {
+			return fmt.Errorf("%s: %v", message, err)
+		}
+		g.Lock()
+		g.client, g.clientVersion = hello.Client, hello.Version
+		g.Unlock()
+	case "core.ping":
+		return g.send("Core.Ping", nil)
+	case "core.supports.set", "core.supports.add", "core.supports.remove":
+		var list []string
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("%s: %v", message, err)
+		}
+		g.Lock()
+		defer g.Unlock()
+		switch strings.ToLower(message) {
+		case "core.supports.set":
+			g.supports = make(map[string]int)
+			fallthrough
+		case "core.supports.add":
+			for _, s := range list {
+				// "Char 1" or "Comm.Channel 1"
+				fields := strings.Fields(s)
+				if len(fields) == 0 {
+					continue
+				}
+				name := strings.ToLower(fields[0])
+				top := name
+				if i := strings.IndexByte(top, '.'); i >= 0 {
+					top = top[:i]
+				}
+				if _, ok := gmcpPackages[top]; !ok {
+					continue
+				}
+				version := 1
+				if len(fields) > 1 {
+					if v, err := strconv.Atoi(fields[1]); err == nil {
+						version = v
+					}
+				}
+				g.supports[name] = version
+			}
+		case "core.supports.remove":
+			for _, s := range list {
+				if fields := strings.Fields(s); len(fields) > 0 {
+					delete(g.supports, strings.ToLower(fields[0]))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SendGMCP sends a GMCP message to the player, with data marshalled as
+// JSON, if their client speaks GMCP and has enabled the message's
+// package.  Otherwise it does nothing.
+func (sess *session) SendGMCP(message string, data interface{}) error {
+	sess.mu.Lock()
+	g := sess.gmcp
+	sess.mu.Unlock()
+	if g == nil {
+		return nil
+	}
+	return g.send(message, data)
+}
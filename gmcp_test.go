@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+// gmcpMessage frames payload as a GMCP subnegotiation, as the client
+// would.
+func gmcpMessage(payload string) string {
+	return "\xff\xfa\xc9" + payload + "\xff\xf0"
+}
+
+// newGMCPTelnet returns a telnet connection whose client has agreed to
+// GMCP and sent the messages in input.
+func newGMCPTelnet(t *testing.T, input string) (*telnetConn, *pipeConn) {
+	tc, c := newTestTelnet("\xff\xfd\xc9" + input)
+	if err := tc.negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(tc)
+	c.out.Reset()
+	return tc, c
+}
+
+func TestGMCPSubnegotiate(t *testing.T) {
+	tc, c := newTestTelnet("")
+	if err := tc.subnegotiate(telnetOptGMCP, []byte("Comm.Channel.Text \xff\xff")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\xff\xfa\xc9Comm.Channel.Text \xff\xff\xff\xff\xff\xf0"; c.out.String() != want {
+		t.Errorf("sent %q, want %q", c.out.String(), want)
+	}
+}
+
+func TestGMCPSend(t *testing.T) {
+	tc, c := newGMCPTelnet(t, gmcpMessage(`Core.Supports.Set ["Char 1", "Comm.Channel 1", "Room 1"]`))
+	g := tc.gmcp
+	for _, m := range []struct {
+		message string
+		data    interface{}
+	}{
+		{"Char.Name", map[string]string{"name": "ÿ"}},
+		{"Comm.Channel.Text", map[string]string{"text": "hi"}},
+		{"Comm.Channel.List", nil}, // only Comm.Channel is enabled
+		{"Room.Info", nil},         // not a package we speak
+		{"Core.Goodbye", nil},      // Core needn't be enabled
+	} {
+		if err := g.send(m.message, m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := gmcpMessage(`Char.Name {"name":"ÿ"}`) +
+		gmcpMessage(`Comm.Channel.Text {"text":"hi"}`) +
+		gmcpMessage(`Comm.Channel.List`) +
+		gmcpMessage(`Core.Goodbye`)
+	if c.out.String() != want {
+		t.Errorf("sent %q, want %q", c.out.String(), want)
+	}
+
+	c.out.Reset()
+	tc, c = newGMCPTelnet(t, gmcpMessage(`Core.Supports.Set ["Char 1"]`)+
+		gmcpMessage(`Core.Supports.Remove ["Char"]`)+
+		gmcpMessage(`Core.Supports.Add ["Comm 1"]`))
+	tc.gmcp.send("Char.Name", nil)
+	tc.gmcp.send("Comm.Channel.Text", nil)
+	if want := gmcpMessage("Comm.Channel.Text"); c.out.String() != want {
+		t.Errorf("sent %q, want %q", c.out.String(), want)
+	}
+}
+
+func TestGMCPNotEnabled(t *testing.T) {
+	// The client never agrees to GMCP.
+	tc, c := newTestTelnet(gmcpMessage(`Core.Supports.Set ["Char 1"]`))
+	io.ReadAll(tc)
+	tc.gmcp.send("Char.Name", nil)
+	tc.gmcp.send("Core.Ping", nil)
+	if c.out.Len() != 0 {
+		t.Errorf("sent %q", c.out.String())
+	}
+}
+
+func TestGMCPReceive(t *testing.T) {
+	// An escaped IAC in the client's name reaches the JSON decoder as
+	// one invalid byte.
+	tc, c := newGMCPTelnet(t, gmcpMessage("Core.Hello {\"client\": \"Mud\xff\xfflet\", \"version\": \"4.17\"}"))
+	g := tc.gmcp
+	if g.client != "Mud�let" || g.clientVersion != "4.17" {
+		t.Errorf("client %q %q", g.client, g.clientVersion)
+	}
+
+	logOut := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(logOut)
+	tc.r.Reset(&pipeConn{in: strings.NewReader(gmcpMessage("Core.Ping") +
+		gmcpMessage("Core.Hello not json") +
+		gmcpMessage("External.Discord.Hello {}") +
+		gmcpMessage("") +
+		gmcpMessage("Core.Supports.Set {}"))})
+	io.ReadAll(tc)
+	if want := gmcpMessage("Core.Ping"); c.out.String() != want {
+		t.Errorf("sent %q, want %q", c.out.String(), want)
+	}
+}
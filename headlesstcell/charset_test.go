@@ -0,0 +1,72 @@
+package headlesstcell
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/gdamore/tcell"
+	"github.com/gdamore/tcell/encoding"
+)
+
+// recordConn is a client that sends nothing and records what it's sent.
+type recordConn struct {
+	closed chan struct{}
+	mu     sync.Mutex
+	out    bytes.Buffer
+}
+
+func newRecordConn(t *testing.T) *recordConn {
+	c := &recordConn{closed: make(chan struct{})}
+	t.Cleanup(func() { close(c.closed) })
+	return c
+}
+
+func (c *recordConn) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, nil
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(b)
+}
+
+func (c *recordConn) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.out.Bytes()...)
+}
+
+func TestCharsetEncoding(t *testing.T) {
+	encoding.Register()
+	tests := []struct {
+		charset string
+		want    string
+	}{
+		{"UTF-8", "café ж"},
+		{"ISO8859-1", "caf\xe9 ?"},
+		{"KOI8-R", "caf? \xd6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.charset, func(t *testing.T) {
+			c := newRecordConn(t)
+			s, err := NewScreen(c, "xterm", 20, 2, Options{Charset: tt.charset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			for x, r := range []rune("café ж") {
+				s.SetContent(x, 0, r, nil, tcell.StyleDefault)
+			}
+			s.Show()
+			s.Fini()
+			if out := c.Bytes(); !bytes.Contains(out, []byte(tt.want)) {
+				t.Fatalf("sent %q, want %q in it", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package headlesstcell
+
+import (
+	"time"
+)
+
+// EventHangup is posted when the connection behind a screen is closed or
+// fails.  No further input events will arrive; the application should
+// call Fini and release the session.
+type EventHangup struct {
+	t time.Time
+}
+
+// When returns the time the hangup was detected.
+func (ev *EventHangup) When() time.Time {
+	return ev.t
+}
@@ -36,11 +36,12 @@ import (
 )
 
 // NewScreen returns a new screen
-func NewScreen(c io.ReadWriter, term string, columns, lines int) (tcell.Screen, error) {
-	ti, e := terminfo.LookupTerminfo(term)
+func NewScreen(c io.ReadWriter, term string, columns, lines int, opts Options) (tcell.Screen, error) {
+	ent, e := findTerminfo(term, opts)
 	if e != nil {
 		return nil, e
 	}
+	ti := ent.ti
 	ti.Lines = lines
 	ti.Columns = columns
 	t := &tScreen{
@@ -49,6 +50,24 @@ func NewScreen(c io.ReadWriter, term string, columns, lines int) (tcell.Screen,
 		winW: columns,
 		winH: lines,
 	}
+	t.setTrueColor(opts.TrueColor)
+	t.sgr = isSGR(ti)
+	t.caps = ent.caps
+	if opts.ExtendedSGR && t.sgr {
+		t.caps = ecmaStyleCaps
+	}
+	t.dcaps = ent.draw
+	if opts.MaxFPS > 0 {
+		t.frameGap = time.Second / time.Duration(opts.MaxFPS)
+	}
+	t.out = newOutput(c, opts.WriteTimeout, opts.OutputBudget, t.hangup, t.resync)
+	for i := range t.ulcolors {
+		t.ulcolors[i] = tcell.ColorDefault
+	}
+	t.charset = opts.Charset
+	if t.charset == "" {
+		t.charset = "UTF-8"
+	}
 
 	t.keyexist = make(map[tcell.Key]bool)
 	t.keycodes = make(map[string]*tKeyCode)
@@ -56,6 +75,7 @@ func NewScreen(c io.ReadWriter, term string, columns, lines int) (tcell.Screen,
 		t.mouse = []byte(ti.Mouse)
 	}
 	t.prepareKeys()
+	t.applyModes(opts.Modes)
 	t.buildAcsMap()
 	t.sigwinch = make(chan os.Signal, 10)
 	t.fallback = make(map[rune]string)
@@ -82,11 +102,17 @@ type tScreen struct {
 	c         io.ReadWriter
 	buffering bool // true if we are collecting writes to buf instead of sending directly to out
 	buf       bytes.Buffer
+	out       *output
+	frameGap  time.Duration // the least time between frames
+	lastFrame time.Time
+	drawTimer *time.Timer // to draw a frame put off for frameGap
 	curstyle  tcell.Style
 	style     tcell.Style
 	evch      chan tcell.Event
 	sigwinch  chan os.Signal
 	quit      chan struct{}
+	hangupq   chan struct{}
+	hungup    sync.Once
 	indoneq   chan struct{}
 	keyexist  map[tcell.Key]bool
 	keycodes  map[string]*tKeyCode
@@ -102,11 +128,19 @@ type tScreen struct {
 	wasbtn    bool
 	acs       map[rune]string
 	charset   string
+	utf8      bool // runes can be written as they are
 	encoder   transform.Transformer
 	decoder   transform.Transformer
 	fallback  map[rune]string
 	colors    map[tcell.Color]tcell.Color
 	palette   []tcell.Color
+	truecolor bool
+	sgr       bool
+	caps      styleCaps
+	dcaps     drawCaps
+	scrolls   []scroll
+	ulcolors  [4]tcell.Color // by UnderlineStyle
+	curulc    tcell.Color
 	escaped   bool
 	buttondn  bool
 
@@ -118,29 +152,36 @@ func (t *tScreen) Init() error {
 	t.indoneq = make(chan struct{})
 	t.keychan = make(chan []byte, 10)
 	t.keytimer = time.NewTimer(time.Millisecond * 50)
-	t.charset = "UTF-8"
 	if enc := tcell.GetEncoding(t.charset); enc != nil {
 		t.encoder = enc.NewEncoder()
 		t.decoder = enc.NewDecoder()
+		t.utf8 = enc == tcell.GetEncoding("UTF-8")
 	} else {
 		return tcell.ErrNoCharset
 	}
 
 	t.colors = make(map[tcell.Color]tcell.Color)
-	t.palette = make([]tcell.Color, t.Colors())
-	for i := 0; i < t.Colors(); i++ {
+	n := t.ti.Colors
+	if n > 256 {
+		n = 256
+	}
+	t.palette = make([]tcell.Color, n)
+	for i := range t.palette {
 		t.palette[i] = tcell.Color(i)
 		// identity map for our builtin colors
 		t.colors[tcell.Color(i)] = tcell.Color(i)
 	}
 
+	// The output can hang up as soon as it starts writing.
+	t.quit = make(chan struct{})
+	t.hangupq = make(chan struct{})
+	t.out.start()
+
 	t.TPuts(t.ti.EnterCA)
 	t.TPuts(t.ti.HideCursor)
 	t.TPuts(t.ti.EnableAcs)
 	t.TPuts(t.ti.Clear)
 
-	t.quit = make(chan struct{})
-
 	t.Lock()
 	t.cx = -1
 	t.cy = -1
@@ -363,9 +404,12 @@ outer:
 
 func (t *tScreen) Fini() {
 	t.Lock()
-	defer t.Unlock()
 
 	ti := t.ti
+	if t.drawTimer != nil {
+		t.drawTimer.Stop()
+		t.drawTimer = nil
+	}
 	t.cells.Resize(0, 0)
 	t.TPuts(ti.ShowCursor)
 	t.TPuts(ti.AttrOff)
@@ -384,6 +428,10 @@ func (t *tScreen) Fini() {
 	default:
 		close(t.quit)
 	}
+	t.Unlock()
+
+	// Let the above go before the connection does.
+	t.out.close()
 }
 
 func (t *tScreen) SetStyle(style tcell.Style) {
@@ -458,9 +506,47 @@ func (t *tScreen) encodeRune(r rune, buf []byte) []byte {
 	return buf
 }
 
+// setTrueColor sets whether 24-bit colors are sent.
+func (t *tScreen) setTrueColor(mode TrueColorMode) {
+	switch mode {
+	case TrueColorOn:
+		addTrueColor(t.ti)
+		t.truecolor = t.ti.Colors > 0
+	case TrueColorOff:
+		t.truecolor = false
+	default:
+		t.truecolor = t.ti.Colors > 0 && t.ti.SetFgRGB != "" && t.ti.SetBgRGB != ""
+	}
+}
+
+// SetTrueColor changes whether 24-bit colors are sent, redrawing the
+// screen with the next Show.
+func (t *tScreen) SetTrueColor(mode TrueColorMode) {
+	t.Lock()
+	t.setTrueColor(mode)
+	t.curstyle = tcell.Style(-1)
+	t.cells.Invalidate()
+	t.Unlock()
+}
+
+// rgb returns c's red, green and blue, if it's sent as a 24-bit color.
+// The palette's own colors are sent from the palette either way.
+func (t *tScreen) rgb(c tcell.Color) (r, g, b int, ok bool) {
+	if !t.truecolor || c == tcell.ColorDefault || (c >= 0 && int(c) < len(t.palette)) {
+		return 0, 0, 0, false
+	}
+	r32, g32, b32 := c.RGB()
+	if r32 < 0 {
+		return 0, 0, 0, false
+	}
+	return int(r32), int(g32), int(b32), true
+}
+
 func (t *tScreen) sendFg(fg tcell.Color) {
 	if t.ti.Colors == 0 {
 		return
+	} else if r, g, b, ok := t.rgb(fg); ok {
+		t.TPuts(t.ti.TParm(t.ti.SetFgRGB, r, g, b))
 	} else if fg != tcell.ColorDefault {
 		if v, ok := t.colors[fg]; ok {
 			fg = v
@@ -478,6 +564,8 @@ func (t *tScreen) sendFg(fg tcell.Color) {
 func (t *tScreen) sendBg(bg tcell.Color) {
 	if t.ti.Colors == 0 {
 		return
+	} else if r, g, b, ok := t.rgb(bg); ok {
+		t.TPuts(t.ti.TParm(t.ti.SetBgRGB, r, g, b))
 	} else if bg != tcell.ColorDefault {
 		if v, ok := t.colors[bg]; ok {
 			bg = v
@@ -498,6 +586,17 @@ func (t *tScreen) sendFgBg(fg tcell.Color, bg tcell.Color) {
 		return
 	}
 
+	rf, gf, bf, fok := t.rgb(fg)
+	rb, gb, bb, bok := t.rgb(bg)
+	if fok && bok && ti.SetFgBgRGB != "" {
+		t.TPuts(ti.TParm(ti.SetFgBgRGB, rf, gf, bf, rb, gb, bb))
+		return
+	} else if fok || bok {
+		t.sendFg(fg)
+		t.sendBg(bg)
+		return
+	}
+
 	if fg != tcell.ColorDefault {
 		if v, ok := t.colors[fg]; ok {
 			fg = v
@@ -530,50 +629,32 @@ func (t *tScreen) sendFgBg(fg tcell.Color, bg tcell.Color) {
 	}
 }
 
-func (t *tScreen) drawCell(x, y int) int {
+// drawCell draws the cell at x, y if it's dirty, along with as many of
+// the same cells following it before end as it can repeat, returning how
+// many cells it covered.
+func (t *tScreen) drawCell(x, y, end int) int {
 	mainc, combc, style, width := t.cells.GetContent(x, y)
 	if !t.cells.Dirty(x, y) {
 		return width
 	}
 
-	if t.cy != y || t.cx != x {
-		t.TPuts(t.ti.TGoto(x, y))
-		t.cx = x
-		t.cy = y
-	}
+	t.moveTo(x, y)
 
-	if style == tcell.StyleDefault {
-		style = t.style
-	}
+	style = t.styleOf(style)
 	if style != t.curstyle {
-		fg, bg, attrs := style.Decompose()
-		curfg, curbg, curattrs := t.curstyle.Decompose()
-
-		t.TPuts(t.ti.AttrOff)
+		t.sendStyle(style)
+	}
 
-		if fg != curfg && bg != curbg {
-			t.sendFgBg(fg, bg)
-		} else if fg != curfg {
-			t.sendFg(fg)
-		} else if bg != curbg {
-			t.sendBg(bg)
-		}
-		if attrs&tcell.AttrBold != 0 && curattrs&tcell.AttrBold == 0 {
-			t.TPuts(t.ti.Bold)
-		}
-		if attrs&tcell.AttrUnderline != 0 && curattrs&tcell.AttrUnderline == 0 {
-			t.TPuts(t.ti.Underline)
-		}
-		if attrs&tcell.AttrReverse != 0 && curattrs&tcell.AttrReverse == 0 {
-			t.TPuts(t.ti.Reverse)
-		}
-		if attrs&tcell.AttrBlink != 0 && curattrs&tcell.AttrBlink == 0 {
-			t.TPuts(t.ti.Blink)
-		}
-		if attrs&tcell.AttrDim != 0 && curattrs&tcell.AttrDim == 0 {
-			t.TPuts(t.ti.Dim)
+	if width == 1 && len(combc) == 0 && t.dcaps.repeatRun != "" {
+		n := t.repeats(x, y, end)
+		if s, ok := t.repeatRun(mainc, n); ok {
+			t.TPuts(s)
+			for i := 0; i < n; i++ {
+				t.cells.SetDirty(x+i, y, false)
+			}
+			t.cx += n
+			return n
 		}
-		t.curstyle = style
 	}
 	// now emit runes - taking care to not overrun width with a
 	// wide character, and to ensure that we emit exactly one regular
@@ -585,7 +666,7 @@ func (t *tScreen) drawCell(x, y int) int {
 
 	var str string
 
-	if width == 1 && len(combc) == 0 && t.buffering {
+	if width == 1 && len(combc) == 0 && t.buffering && t.utf8 {
 		t.buf.WriteRune(mainc)
 	} else {
 		buf := make([]byte, 0, 6)
@@ -613,6 +694,12 @@ func (t *tScreen) drawCell(x, y int) int {
 	t.cells.SetDirty(x, y, false)
 	if width > 1 {
 		t.cx = -1
+		if x+1 < t.w {
+			// this is necessary so that if we ever
+			// go back to drawing that cell, we
+			// actually will *draw* it.
+			t.cells.SetDirty(x+1, y, true)
+		}
 	}
 
 	return width
@@ -636,10 +723,8 @@ func (t *tScreen) showCursor() {
 		t.hideCursor()
 		return
 	}
-	t.TPuts(t.ti.TGoto(x, y))
+	t.moveTo(x, y)
 	t.TPuts(t.ti.ShowCursor)
-	t.cx = x
-	t.cy = y
 }
 
 // writeString sends a string to the terminal. The string is sent as-is and
@@ -652,7 +737,7 @@ func (t *tScreen) writeString(s string) {
 	if t.buffering {
 		io.WriteString(&t.buf, s)
 	} else {
-		io.WriteString(t.c, s)
+		io.WriteString(t.out, s)
 	}
 }
 
@@ -660,7 +745,7 @@ func (t *tScreen) TPuts(s string) {
 	if t.buffering {
 		t.ti.TPuts(&t.buf, s)
 	} else {
-		t.ti.TPuts(t.c, s)
+		t.ti.TPuts(t.out, s)
 	}
 }
 
@@ -668,14 +753,15 @@ func (t *tScreen) Show() {
 	t.Lock()
 	if !t.fini {
 		t.resize()
-		t.draw()
+		t.frame()
 	}
 	t.Unlock()
 }
 
 func (t *tScreen) clearScreen() {
 	fg, bg, _ := t.style.Decompose()
-	t.sendFgBg(fg, bg)
+	t.curstyle = tcell.Style(-1)
+	t.sendStyle(tcell.StyleDefault.Foreground(fg).Background(bg))
 	t.TPuts(t.ti.Clear)
 	t.clear = false
 }
@@ -707,28 +793,39 @@ func (t *tScreen) draw() {
 	t.hideCursor()
 
 	if t.clear {
+		t.scrolls = nil
 		t.clearScreen()
+		if _, bg, _ := t.style.Decompose(); bg == tcell.ColorDefault {
+			// no need to draw what the clear already did
+			for y := 0; y < t.h; y++ {
+				for x := 0; x < t.w; x++ {
+					if t.blank(x, y) {
+						t.cells.SetDirty(x, y, false)
+					}
+				}
+			}
+		}
 	}
 
+	for _, sc := range t.scrolls {
+		t.sendScroll(sc)
+	}
+	t.scrolls = nil
+
 	for y := 0; y < t.h; y++ {
-		for x := 0; x < t.w; x++ {
-			width := t.drawCell(x, y)
-			if width > 1 {
-				if x+1 < t.w {
-					// this is necessary so that if we ever
-					// go back to drawing that cell, we
-					// actually will *draw* it.
-					t.cells.SetDirty(x+1, y, true)
-				}
-			}
-			x += width - 1
+		eol := t.blankTail(y)
+		for x := 0; x < eol; {
+			x += t.drawCell(x, y, eol)
+		}
+		if eol < t.w {
+			t.clearToEOL(eol, y)
 		}
 	}
 
 	// restore the cursor
 	t.showCursor()
 
-	t.buf.WriteTo(t.c)
+	t.out.frame(t.buf.Bytes())
 }
 
 func (t *tScreen) EnableMouse() {
@@ -757,6 +854,7 @@ func (t *tScreen) resize() {
 
 		t.cells.Resize(t.winW, t.winH)
 		t.cells.Invalidate()
+		t.scrolls = nil
 		t.h = t.winH
 		t.w = t.winW
 		t.PostEvent(tcell.NewEventResize(t.winW, t.winH))
@@ -764,9 +862,10 @@ func (t *tScreen) resize() {
 }
 
 func (t *tScreen) Colors() int {
-	// this doesn't change, no need for lock
-	if t.ti.Colors > 256 {
-		return 256
+	t.Lock()
+	defer t.Unlock()
+	if t.truecolor {
+		return 1 << 24
 	}
 	return t.ti.Colors
 }
@@ -1280,13 +1379,16 @@ func (t *tScreen) mainLoop() {
 		case <-t.quit:
 			close(t.indoneq)
 			return
+		case <-t.hangupq:
+			close(t.indoneq)
+			return
 		case <-t.sigwinch:
 			t.Lock()
 			t.cx = -1
 			t.cy = -1
 			t.resize()
 			t.cells.Invalidate()
-			t.draw()
+			t.frame()
 			t.Unlock()
 			continue
 		case <-t.keytimer.C:
@@ -1330,17 +1432,36 @@ func (t *tScreen) inputLoop() {
 	for {
 		chunk := make([]byte, 128)
 		n, e := t.c.Read(chunk)
-		switch e {
-		case io.EOF:
-		case nil:
-		default:
-			t.PostEvent(tcell.NewEventError(e))
+		if n > 0 {
+			select {
+			case t.keychan <- chunk[:n]:
+			case <-t.quit:
+				return
+			}
+		}
+		if e != nil {
+			if e != io.EOF {
+				t.PostEvent(tcell.NewEventError(e))
+			}
+			t.hangup()
 			return
 		}
-		t.keychan <- chunk[:n]
 	}
 }
 
+// hangup stops mainLoop and tells the application the connection is gone,
+// unless it has already called Fini.  Reads and writes can both find that
+// out, so only the first call does anything.
+func (t *tScreen) hangup() {
+	t.hungup.Do(func() {
+		close(t.hangupq)
+		select {
+		case t.evch <- &EventHangup{t: time.Now()}:
+		case <-t.quit:
+		}
+	})
+}
+
 func (t *tScreen) Sync() {
 	t.Lock()
 	t.cx = -1
@@ -1349,7 +1470,7 @@ func (t *tScreen) Sync() {
 		t.resize()
 		t.clear = true
 		t.cells.Invalidate()
-		t.draw()
+		t.frame()
 	}
 	t.Unlock()
 }
@@ -1414,19 +1535,51 @@ func (t *tScreen) Winch(w, h int) {
 	t.winW = w
 	t.winH = h
 	t.Unlock()
-	t.sigwinch <- nil
+	select {
+	case t.sigwinch <- nil:
+	default:
+		// a resize is already pending
+	}
 }
 
-func (t *tScreen) ScrollRegion(x, y, w, h int) {
+// ScrollRegion scrolls the w by h cells at x, y up n rows, or down if n
+// is negative, leaving blank rows behind.  Regions as wide as the screen
+// are scrolled by the terminal, if it can, when next shown, so only the
+// new rows need drawing.
+func (t *tScreen) ScrollRegion(x, y, w, h, n int) {
 	t.Lock()
-	for i := 0; i < h-1; i++ {
+	defer t.Unlock()
+	if w <= 0 || h <= 0 || n == 0 {
+		return
+	}
+	hw := t.canScroll(x, y, w, h, n)
+	if hw {
+		t.queueScroll(y, h, n)
+	}
+
+	// Rows are moved in the order that doesn't overwrite any before
+	// they're moved.  When the terminal will do the moving, the cells
+	// that were clean stay clean, as it will show them already.
+	for i := 0; i < h; i++ {
+		row := y + i
+		if n < 0 {
+			row = y + h - 1 - i
+		}
+		from := row + n
 		for j := 0; j < w; j++ {
-			mainc, combc, style, _ := t.cells.GetContent(x+j, y+i+1)
-			t.cells.SetContent(x+j, y+i, mainc, combc, style)
+			if from >= y && from < y+h {
+				mainc, combc, style, _ := t.cells.GetContent(x+j, from)
+				dirty := t.cells.Dirty(x+j, from)
+				t.cells.SetContent(x+j, row, mainc, combc, style)
+				if hw {
+					t.cells.SetDirty(x+j, row, dirty)
+				}
+			} else {
+				t.cells.SetContent(x+j, row, ' ', nil, t.style)
+				if hw {
+					t.cells.SetDirty(x+j, row, !t.blank(x+j, row))
+				}
+			}
 		}
 	}
-	for j := 0; j < w; j++ {
-		t.cells.SetContent(x+j, y+h, ' ', nil, t.style)
-	}
-	t.Unlock()
 }
@@ -0,0 +1,113 @@
+package headlesstcell
+
+import (
+	"time"
+
+	"github.com/gdamore/tcell"
+)
+
+// Options carries the per-client settings that tcell would normally get
+// from the environment and the tty.
+type Options struct {
+	// Modes are the terminal modes the client asked for.
+	Modes TermModes
+
+	// Charset is the client's character set, which must be registered
+	// with tcell.RegisterEncoding.  The default is UTF-8.
+	Charset string
+
+	// DefaultTerm is the terminal to assume when the client's isn't
+	// known, before giving up and using plain ANSI.
+	DefaultTerm string
+
+	// TerminfoDirs are searched for compiled terminfo entries, after
+	// tcell's built-in terminals.  Nil means DefaultTerminfoDirs.
+	TerminfoDirs []string
+
+	// TrueColor says whether to send 24-bit colors.  The default is to
+	// if the client's terminfo entry says it can.
+	TrueColor TrueColorMode
+
+	// ExtendedSGR says the client understands the SGR codes of modern
+	// emulators for strikethrough, overlines, and styled and colored
+	// underlines, whatever its terminfo entry says.
+	ExtendedSGR bool
+
+	// MaxFPS is how many frames a second Show and Sync draw at most;
+	// those called sooner are drawn together once one may be.  0 means
+	// no limit.
+	MaxFPS int
+
+	// WriteTimeout is how long a write to the connection may take before
+	// the client is given up on and the screen hangs up.  0 means no
+	// limit.
+	WriteTimeout time.Duration
+
+	// OutputBudget is how many bytes may wait to be written before the
+	// frames among them are dropped, and the screen synced once the
+	// client catches up.  0 means no limit.
+	OutputBudget int
+}
+
+// TrueColorMode says whether a screen sends 24-bit colors, or finds the
+// nearest in the terminal's palette.
+type TrueColorMode int
+
+const (
+	// TrueColorAuto sends 24-bit colors if the terminfo entry has
+	// setrgbf and setrgbb, or the Tc or RGB flags.
+	TrueColorAuto TrueColorMode = iota
+
+	// TrueColorOn sends 24-bit colors, as xterm does if the terminfo
+	// entry doesn't say how, for clients known to support them.
+	TrueColorOn
+
+	// TrueColorOff always uses the palette.
+	TrueColorOff
+)
+
+// TrueColorSetter is implemented by our screens, so a player can change
+// their mind about 24-bit color.
+type TrueColorSetter interface {
+	SetTrueColor(mode TrueColorMode)
+}
+
+// RegionScroller is implemented by our screens, so panes that scroll
+// don't have to be drawn again.
+type RegionScroller interface {
+	// ScrollRegion scrolls the w by h cells at x, y up n rows, or down
+	// if n is negative.
+	ScrollRegion(x, y, w, h, n int)
+}
+
+// OutputReporter is implemented by our screens, to say how their
+// clients are keeping up.
+type OutputReporter interface {
+	OutputStats() OutputStats
+}
+
+// TermModes are terminal modes keyed by their RFC 4254 opcodes, which are
+// the same as the mode constants in golang.org/x/crypto/ssh.
+type TermModes map[uint8]uint32
+
+// Opcodes of the modes we honor.
+const (
+	ModeVERASE = 3
+	ModeIGNCR  = 35
+	ModeICRNL  = 36
+)
+
+// applyModes adjusts the key map for the client's terminal modes.  A
+// control character set as VERASE means backspace (DEL already does), and
+// if the client's line discipline would treat CR and NL alike (ICRNL or
+// IGNCR), so do we.
+func (t *tScreen) applyModes(modes TermModes) {
+	if v, ok := modes[ModeVERASE]; ok && v != 0 && v < ' ' {
+		t.keyexist[tcell.KeyBackspace2] = true
+		t.keycodes[string(rune(v))] = &tKeyCode{key: tcell.KeyBackspace2, mod: tcell.ModNone}
+	}
+	if modes[ModeICRNL] != 0 || modes[ModeIGNCR] != 0 {
+		t.keyexist[tcell.KeyEnter] = true
+		t.keycodes["\n"] = &tKeyCode{key: tcell.KeyEnter, mod: tcell.ModNone}
+	}
+}
@@ -0,0 +1,288 @@
+package headlesstcell
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// OutputStats are counts of what a screen has sent its client.
+type OutputStats struct {
+	Bytes     int64         // written to the connection
+	Frames    int           // drawn and written
+	Dropped   int           // drawn, then dropped unsent as the client fell behind
+	Writes    int           // writes to the connection
+	WriteTime time.Duration // spent in all of them
+	MaxWrite  time.Duration // spent in the slowest
+}
+
+// AvgWrite returns the mean time a write to the connection took.
+func (s OutputStats) AvgWrite() time.Duration {
+	if s.Writes == 0 {
+		return 0
+	}
+	return s.WriteTime / time.Duration(s.Writes)
+}
+
+// output writes what a screen sends to its connection from a goroutine of
+// its own, so a slow client holds up nothing but that.  Frames queue up to
+// a budget; past it, those not yet being written are dropped, being out of
+// date anyway, and the screen is synced once the client has caught up.
+type output struct {
+	w        io.Writer
+	timeout  time.Duration // for one write; 0 for none
+	budget   int           // bytes queued before frames are dropped; 0 for no limit
+	stalled  func()        // called if a write fails or times out
+	caughtUp func()        // called once the queue drains after frames were dropped
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	queue   []chunk
+	queued  int  // bytes in queue
+	behind  bool // frames were dropped and the client hasn't caught up
+	started bool
+	closing bool
+	failed  bool
+	done    chan struct{}
+	stats   OutputStats
+}
+
+// chunk is something queued to write.  Only frames are ever dropped; the
+// rest changes the terminal's modes rather than what's on it.
+type chunk struct {
+	b     []byte
+	frame bool
+}
+
+func newOutput(w io.Writer, timeout time.Duration, budget int, stalled, caughtUp func()) *output {
+	o := &output{
+		w:        w,
+		timeout:  timeout,
+		budget:   budget,
+		stalled:  stalled,
+		caughtUp: caughtUp,
+		done:     make(chan struct{}),
+	}
+	o.cond.L = &o.mu
+	return o
+}
+
+// start starts writing.
+func (o *output) start() {
+	o.mu.Lock()
+	o.started = true
+	o.mu.Unlock()
+	go o.run()
+}
+
+// Write queues b, so the screen can TPuts to an output.
+func (o *output) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	o.push(chunk{b: append([]byte(nil), b...)})
+	o.mu.Unlock()
+	return len(b), nil
+}
+
+// frame queues a drawn frame, unless the client is too far behind for it.
+// Then it, and the frames queued before it, are dropped.
+func (o *output) frame(b []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failed || o.closing {
+		return
+	}
+	if o.budget > 0 && o.queued > 0 && o.queued+len(b) > o.budget {
+		kept := o.queue[:0]
+		o.queued = 0
+		for _, c := range o.queue {
+			if c.frame {
+				o.stats.Dropped++
+				continue
+			}
+			kept = append(kept, c)
+			o.queued += len(c.b)
+		}
+		for i := len(kept); i < len(o.queue); i++ {
+			o.queue[i] = chunk{}
+		}
+		o.queue = kept
+		o.stats.Dropped++
+		o.behind = true
+		return
+	}
+	o.push(chunk{b: append([]byte(nil), b...), frame: true})
+}
+
+func (o *output) push(c chunk) {
+	if o.failed || o.closing || len(c.b) == 0 {
+		return
+	}
+	o.queue = append(o.queue, c)
+	o.queued += len(c.b)
+	o.cond.Signal()
+}
+
+// skip reports whether frames have been dropped and the client is yet to
+// catch up, so there's no use drawing another, and counts it dropped if so.
+func (o *output) skip() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.behind {
+		o.stats.Dropped++
+	}
+	return o.behind
+}
+
+func (o *output) run() {
+	defer close(o.done)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		for len(o.queue) == 0 && !o.closing && !o.failed {
+			o.cond.Wait()
+		}
+		if len(o.queue) == 0 || o.failed {
+			return
+		}
+		c := o.queue[0]
+		o.queue[0] = chunk{}
+		o.queue = o.queue[1:]
+		o.queued -= len(c.b)
+
+		o.mu.Unlock()
+		d, err := o.write(c.b)
+		o.mu.Lock()
+
+		o.stats.Bytes += int64(len(c.b))
+		o.stats.Writes++
+		o.stats.WriteTime += d
+		if d > o.stats.MaxWrite {
+			o.stats.MaxWrite = d
+		}
+		if c.frame {
+			o.stats.Frames++
+		}
+		if err != nil {
+			o.fail()
+			o.mu.Unlock()
+			o.stalled()
+			o.mu.Lock()
+			return
+		}
+		if len(o.queue) == 0 && o.behind && !o.closing {
+			o.behind = false
+			o.mu.Unlock()
+			o.caughtUp()
+			o.mu.Lock()
+		}
+	}
+}
+
+// write writes b, calling stalled if it takes longer than the timeout.
+// The write carries on until the connection is closed.
+func (o *output) write(b []byte) (time.Duration, error) {
+	start := time.Now()
+	if o.timeout > 0 {
+		deadline := time.AfterFunc(o.timeout, func() {
+			o.mu.Lock()
+			o.fail()
+			o.mu.Unlock()
+			o.stalled()
+		})
+		defer deadline.Stop()
+	}
+	_, err := o.w.Write(b)
+	return time.Since(start), err
+}
+
+// fail gives up on the connection, discarding what's queued.
+func (o *output) fail() {
+	o.failed = true
+	o.queue = nil
+	o.queued = 0
+	o.cond.Signal()
+}
+
+// closeWait is how long close waits for what's queued to be written when
+// writes have no timeout, so a client that's stopped reading can't hold up
+// Fini forever.
+var closeWait = 10 * time.Second
+
+// close stops writing once what's queued is written, waiting for that as
+// long as the timeout allows, or closeWait if there's none.
+func (o *output) close() {
+	o.mu.Lock()
+	waiting := o.started && !o.failed
+	o.closing = true
+	o.cond.Signal()
+	o.mu.Unlock()
+	if !waiting {
+		return
+	}
+	d := o.timeout
+	if d <= 0 {
+		d = closeWait
+	}
+	wait := time.NewTimer(d)
+	defer wait.Stop()
+	select {
+	case <-o.done:
+	case <-wait.C:
+	}
+}
+
+// Stats returns counts of what has been written.
+func (o *output) Stats() OutputStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stats
+}
+
+// OutputStats returns counts of what has been sent to the client.
+func (t *tScreen) OutputStats() OutputStats {
+	return t.out.Stats()
+}
+
+// frame draws the screen, unless a frame went less than the frame gap ago.
+// Then it's drawn once one may be, with whatever's changed by then.  Nor
+// is it drawn while the client is catching up; it's synced after.
+func (t *tScreen) frame() {
+	if t.out.skip() {
+		return
+	}
+	if t.frameGap > 0 {
+		if wait := time.Until(t.lastFrame.Add(t.frameGap)); wait > 0 {
+			if t.drawTimer == nil {
+				t.drawTimer = time.AfterFunc(wait, t.deferredFrame)
+			}
+			return
+		}
+	}
+	t.lastFrame = time.Now()
+	t.draw()
+}
+
+func (t *tScreen) deferredFrame() {
+	t.Lock()
+	t.drawTimer = nil
+	if !t.fini {
+		t.resize()
+		t.frame()
+	}
+	t.Unlock()
+}
+
+// resync draws the whole screen again for a client that's caught up after
+// frames were dropped.
+func (t *tScreen) resync() {
+	t.Lock()
+	if !t.fini {
+		t.cx = -1
+		t.cy = -1
+		t.resize()
+		t.clear = true
+		t.cells.Invalidate()
+		t.frame()
+	}
+	t.Unlock()
+}
@@ -0,0 +1,263 @@
+package headlesstcell
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell"
+)
+
+// gateConn is a client whose writes wait to be let through, one at a
+// time, or all of them once it's opened up.
+type gateConn struct {
+	writes chan []byte   // each write, as it starts
+	next   chan bool     // lets one write through
+	opened chan struct{} // closed to let them all through
+	closed chan struct{}
+
+	mu   sync.Mutex
+	open bool
+	out  bytes.Buffer
+}
+
+func newGateConn(t *testing.T) *gateConn {
+	c := &gateConn{
+		writes: make(chan []byte, 100),
+		next:   make(chan bool),
+		opened: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	t.Cleanup(func() { close(c.closed) })
+	return c
+}
+
+func (c *gateConn) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, nil
+}
+
+func (c *gateConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	open := c.open
+	c.mu.Unlock()
+	if !open {
+		c.writes <- append([]byte(nil), b...)
+		select {
+		case <-c.next:
+		case <-c.opened:
+		case <-c.closed:
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(b)
+}
+
+// started waits for the next write to start, checking it's want.
+func (c *gateConn) started(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case b := <-c.writes:
+		if string(b) != want {
+			t.Fatalf("wrote %q, want %q", b, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("never wrote %q", want)
+	}
+}
+
+// let lets the next write through, checking it's want.
+func (c *gateConn) let(t *testing.T, want string) {
+	t.Helper()
+	c.started(t, want)
+	c.next <- true
+}
+
+// openUp lets every write through from now on.
+func (c *gateConn) openUp() {
+	c.mu.Lock()
+	c.open = true
+	c.mu.Unlock()
+	close(c.opened)
+}
+
+func (c *gateConn) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.out.Bytes()...)
+}
+
+func TestOutputWrites(t *testing.T) {
+	c := newGateConn(t)
+	o := newOutput(c, 0, 0, func() { t.Error("stalled") }, func() { t.Error("caught up") })
+	o.Write([]byte("mode"))
+	o.start()
+	o.frame([]byte("frame one"))
+	o.frame(nil)
+	o.frame([]byte("frame two"))
+	c.let(t, "mode")
+	c.let(t, "frame one")
+	c.let(t, "frame two")
+	o.close()
+	if got := string(c.Bytes()); got != "modeframe oneframe two" {
+		t.Errorf("wrote %q", got)
+	}
+	st := o.Stats()
+	if st.Bytes != 22 || st.Frames != 2 || st.Writes != 3 || st.Dropped != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestOutputDropsFrames(t *testing.T) {
+	c := newGateConn(t)
+	caughtUp := make(chan bool, 1)
+	o := newOutput(c, 0, 10, func() { t.Error("stalled") }, func() { caughtUp <- true })
+	o.start()
+
+	// The first frame is being written when the rest are queued.  The
+	// last goes over the budget, so it and the one before are dropped,
+	// but not the mode change between them.
+	o.frame([]byte("one"))
+	c.started(t, "one")
+	o.frame([]byte("two"))
+	o.Write([]byte("mode"))
+	if o.skip() {
+		t.Fatal("skipping frames before any were dropped")
+	}
+	o.frame([]byte("three"))
+	if !o.skip() {
+		t.Fatal("not skipping frames after some were dropped")
+	}
+
+	c.next <- true
+	c.let(t, "mode")
+	select {
+	case <-caughtUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never caught up")
+	}
+	if o.skip() {
+		t.Error("skipping frames after catching up")
+	}
+	o.frame([]byte("four"))
+	c.let(t, "four")
+	o.close()
+
+	st := o.Stats()
+	if st.Frames != 2 || st.Dropped != 3 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestOutputTimeout(t *testing.T) {
+	c := newGateConn(t)
+	stalled := make(chan bool, 1)
+	o := newOutput(c, 10*time.Millisecond, 0, func() { stalled <- true }, func() {})
+	o.start()
+	o.frame([]byte("stuck"))
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never stalled")
+	}
+	o.frame([]byte("more"))
+	// It's given up on the client, so there's nothing to wait for.
+	start := time.Now()
+	o.close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("close took %s", d)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queued != 0 {
+		t.Errorf("%d bytes queued after stalling", o.queued)
+	}
+}
+
+func TestOutputCloseWithoutTimeout(t *testing.T) {
+	defer func(d time.Duration) { closeWait = d }(closeWait)
+	closeWait = 10 * time.Millisecond
+
+	c := newGateConn(t)
+	o := newOutput(c, 0, 0, func() {}, func() {})
+	o.start()
+	o.frame([]byte("stuck"))
+	c.started(t, "stuck")
+	done := make(chan bool)
+	go func() {
+		o.close()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited for a write that never finished")
+	}
+}
+
+// TestOutputResync checks a screen whose client fell behind draws all of
+// itself again once the client has caught up.
+func TestOutputResync(t *testing.T) {
+	c := newGateConn(t)
+	s, err := NewScreen(c, "xterm-256color", 20, 4, Options{
+		TerminfoDirs: []string{filepath.Join("testdata", "terminfo")},
+		OutputBudget: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Fini()
+
+	// Frames pile up behind Init's first write until some are dropped.
+	ts := s.(*tScreen)
+	for i := 0; !ts.out.skip(); i++ {
+		put(ts, 0, i%4, fmt.Sprintf("frame %d", i), tcell.StyleDefault)
+		s.Show()
+	}
+	put(ts, 0, 0, "the latest", tcell.StyleDefault)
+	s.Show()
+	c.openUp()
+
+	// rows returns what's on the screen, and what's on the terminal.
+	v := newVT(20, 4)
+	sent := 0
+	rows := func() (screen, term string) {
+		b := c.Bytes()
+		v.Write(b[sent:])
+		sent = len(b)
+		if v.err != nil {
+			t.Fatalf("%v in %q", v.err, b)
+		}
+		ts.Lock()
+		defer ts.Unlock()
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 20; x++ {
+				mainc, _, _, _ := ts.cells.GetContent(x, y)
+				screen += string(mainc)
+				term += string(v.cells[y][x].r)
+			}
+			screen += "\n"
+			term += "\n"
+		}
+		return screen, term
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		screen, term := rows()
+		if screen == term {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("terminal shows\n%s\nnot\n%s", term, screen)
+		}
+	}
+	if st := s.(OutputReporter).OutputStats(); st.Dropped == 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
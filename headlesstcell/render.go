@@ -0,0 +1,336 @@
+package headlesstcell
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell"
+)
+
+// drawCaps are the capabilities for drawing cheaply that tcell's Terminfo
+// has no fields for.
+type drawCaps struct {
+	cr        string // cr
+	down1     string // cud1
+	clrEOL    string // el
+	right     string // cuf, taking a count
+	left      string // cub, taking a count
+	up        string // cuu, taking a count
+	down      string // cud, taking a count
+	repeatRun string // rep, taking the character and a count
+	setRegion string // csr, taking the top and bottom rows
+	index     string // ind
+	revIndex  string // ri
+	indexN    string // indn, taking a count
+	revIndexN string // rin, taking a count
+	insLine1  string // il1
+	delLine1  string // dl1
+	insLine   string // il, taking a count
+	delLine   string // dl, taking a count
+}
+
+// ecmaDrawCaps are what any terminal with ECMA-48 cursor addressing
+// understands.  REP isn't among them; plenty of emulators ignore it.  Nor
+// are scrolling regions, which are DEC's.
+var ecmaDrawCaps = drawCaps{
+	cr:       "\r",
+	down1:    "\n",
+	clrEOL:   "\x1b[K",
+	right:    "\x1b[%p1%dC",
+	left:     "\x1b[%p1%dD",
+	up:       "\x1b[%p1%dA",
+	down:     "\x1b[%p1%dB",
+	insLine1: "\x1b[L",
+	delLine1: "\x1b[M",
+	insLine:  "\x1b[%p1%dL",
+	delLine:  "\x1b[%p1%dM",
+}
+
+// isECMA reports whether a terminal addresses the cursor with ECMA-48
+// sequences.
+func isECMA(setCursor string) bool {
+	return strings.HasPrefix(setCursor, "\x1b[")
+}
+
+// repeatCap returns the shorter of one repeated n times or many with n
+// as its parameter, or "" if the terminal has neither.
+func (t *tScreen) repeatCap(one, many string, n int) string {
+	s := ""
+	if one != "" {
+		s = strings.Repeat(one, n)
+	}
+	if many != "" {
+		if m := t.ti.TParm(many, n); s == "" || len(m) < len(s) {
+			s = m
+		}
+	}
+	return s
+}
+
+// moveTo moves the cursor to x, y the cheapest way it can: addressing it
+// directly, moving it relative to where it is, or writing again the cells
+// it would pass over.  Where it is isn't known after the last column is
+// written, as terminals differ in whether that wraps.
+func (t *tScreen) moveTo(x, y int) {
+	if t.cx == x && t.cy == y {
+		return
+	}
+	move, text := t.ti.TGoto(x, y), ""
+	if t.cx >= 0 && t.cx < t.w && t.cy >= 0 && t.cy < t.h {
+		vert, ok := "", true
+		if y > t.cy {
+			vert = t.repeatCap(t.dcaps.down1, t.dcaps.down, y-t.cy)
+			ok = vert != ""
+		} else if y < t.cy {
+			vert = t.repeatCap(t.ti.CursorUp1, t.dcaps.up, t.cy-y)
+			ok = vert != ""
+		}
+		if horiz, txt, hok := t.horizontal(t.cx, x, y); ok && hok &&
+			len(vert)+len(horiz)+len(txt) < len(move) {
+			move, text = vert+horiz, txt
+		}
+	}
+	t.TPuts(move)
+	t.writeString(text)
+	t.cx = x
+	t.cy = y
+}
+
+// horizontal returns how to move the cursor from column from to column to
+// in row y: a capability to send, followed by text to write.
+func (t *tScreen) horizontal(from, to, y int) (string, string, bool) {
+	if to >= from {
+		return t.right(from, to, y)
+	}
+	move := t.repeatCap(t.ti.CursorBack1, t.dcaps.left, from-to)
+	if t.dcaps.cr != "" {
+		if right, text, ok := t.right(0, to, y); ok &&
+			(move == "" || len(t.dcaps.cr)+len(right)+len(text) < len(move)) {
+			return t.dcaps.cr + right, text, true
+		}
+	}
+	return move, "", move != ""
+}
+
+func (t *tScreen) right(from, to, y int) (string, string, bool) {
+	if from == to {
+		return "", "", true
+	}
+	move := t.repeatCap("", t.dcaps.right, to-from)
+	if move == "" || to-from < len(move) {
+		if text, ok := t.rewrite(from, to, y); ok {
+			return "", text, true
+		}
+	}
+	return move, "", move != ""
+}
+
+// rewrite returns the cells from column from up to column to in row y, if
+// they can be written again as they are: clean, plain ASCII and in the
+// current style.
+func (t *tScreen) rewrite(from, to, y int) (string, bool) {
+	b := make([]byte, 0, to-from)
+	for x := from; x < to; x++ {
+		mainc, combc, style, width := t.cells.GetContent(x, y)
+		if t.cells.Dirty(x, y) || width != 1 || len(combc) != 0 ||
+			mainc < ' ' || mainc > '~' || t.styleOf(style) != t.curstyle {
+			return "", false
+		}
+		b = append(b, byte(mainc))
+	}
+	return string(b), true
+}
+
+// styleOf returns the style a cell is drawn in.
+func (t *tScreen) styleOf(style tcell.Style) tcell.Style {
+	if style == tcell.StyleDefault {
+		return t.style
+	}
+	return style
+}
+
+// repeats returns how many cells from x on in row y, stopping before end,
+// are the same as the one at x, up to the last of them that's dirty.
+func (t *tScreen) repeats(x, y, end int) int {
+	mainc, _, style, _ := t.cells.GetContent(x, y)
+	n := 1
+	for i := x + 1; i < end; i++ {
+		m, combc, st, width := t.cells.GetContent(i, y)
+		if m != mainc || len(combc) != 0 || width != 1 || t.styleOf(st) != t.styleOf(style) {
+			break
+		}
+		if t.cells.Dirty(i, y) {
+			n = i - x + 1
+		}
+	}
+	return n
+}
+
+// repeatRun returns the sequence writing c n times, if the terminal can
+// repeat characters and that's shorter than writing them out.  tcell's
+// TParm writes %c as a number, so the character is put in by hand.
+func (t *tScreen) repeatRun(c rune, n int) (string, bool) {
+	if t.dcaps.repeatRun == "" || n < 2 || c < ' ' || c > '~' {
+		return "", false
+	}
+	lit := string(c)
+	if c == '%' {
+		lit = "%%"
+	}
+	s := t.ti.TParm(strings.Replace(t.dcaps.repeatRun, "%p1%c", lit, 1), int(c), n)
+	return s, len(s) < n
+}
+
+// blank reports whether the cell at x, y looks the same as one erased to
+// the default background.
+func (t *tScreen) blank(x, y int) bool {
+	mainc, combc, style, width := t.cells.GetContent(x, y)
+	if mainc != ' ' || len(combc) != 0 || width != 1 {
+		return false
+	}
+	if _, _, _, w := t.cells.GetContent(x-1, y); w > 1 {
+		// the right half of a wide character
+		return false
+	}
+	style = t.styleOf(style)
+	_, bg, attrs := style.Decompose()
+	return bg == tcell.ColorDefault && attrs&(tcell.AttrReverse|tcell.AttrUnderline) == 0 &&
+		t.extraAttrs(style)&(styleStrikeThrough|styleOverline) == 0
+}
+
+// blankTail returns where in row y to erase to the end of the line from,
+// or t.w if it's cheaper to draw the cells: the first dirty cell of the
+// blank ones ending the row, if there are enough dirty ones.
+func (t *tScreen) blankTail(y int) int {
+	if t.dcaps.clrEOL == "" {
+		return t.w
+	}
+	from, dirty := t.w, 0
+	for x := t.w - 1; x >= 0 && t.blank(x, y); x-- {
+		if t.cells.Dirty(x, y) {
+			from = x
+			dirty++
+		}
+	}
+	if dirty < len(t.dcaps.clrEOL) {
+		return t.w
+	}
+	return from
+}
+
+// clearToEOL erases row y from x on, which blankTail has found is blank.
+func (t *tScreen) clearToEOL(x, y int) {
+	t.moveTo(x, y)
+	_, _, style, _ := t.cells.GetContent(x, y)
+	t.readyErase(t.styleOf(style))
+	t.TPuts(t.dcaps.clrEOL)
+	for ; x < t.w; x++ {
+		t.cells.SetDirty(x, y, false)
+	}
+}
+
+// readyErase makes what's erased next erased to the default background,
+// changing to style, which has it, if the current style hasn't.  Most
+// terminals erase in the current background.
+func (t *tScreen) readyErase(style tcell.Style) {
+	_, bg, attrs := t.curstyle.Decompose()
+	if t.curstyle == tcell.Style(-1) || bg != tcell.ColorDefault || attrs&tcell.AttrReverse != 0 {
+		t.sendStyle(style)
+	}
+}
+
+// scroll is a scroll of the rows from y to y+h the terminal is yet to do:
+// up n rows, or down if n is negative.
+type scroll struct {
+	y, h, n int
+}
+
+// canScroll reports whether the terminal can scroll the w by h cells at
+// x, y by n rows itself.  It can only scroll whole rows.
+func (t *tScreen) canScroll(x, y, w, h, n int) bool {
+	if x != 0 || w != t.w || y < 0 || y+h > t.h || n >= h || -n >= h ||
+		t.winW != t.w || t.winH != t.h {
+		return false
+	}
+	d := &t.dcaps
+	ins := d.insLine != "" || d.insLine1 != ""
+	del := d.delLine != "" || d.delLine1 != ""
+	if d.setRegion != "" {
+		if n > 0 {
+			return d.index != "" || d.indexN != "" || del
+		}
+		return d.revIndex != "" || d.revIndexN != "" || ins
+	}
+	return ins && del
+}
+
+// queueScroll has the terminal scroll rows when the screen is next shown,
+// along with the last scroll queued if that's of the same rows the same
+// way, as a log's are.
+func (t *tScreen) queueScroll(y, h, n int) {
+	if i := len(t.scrolls) - 1; i >= 0 {
+		last := &t.scrolls[i]
+		if sum := last.n + n; last.y == y && last.h == h && (last.n > 0) == (n > 0) &&
+			sum < h && -sum < h {
+			last.n = sum
+			return
+		}
+	}
+	t.scrolls = append(t.scrolls, scroll{y: y, h: h, n: n})
+}
+
+// sendScroll has the terminal scroll rows, with a scrolling region if it
+// has them, or by deleting and inserting lines if not.
+func (t *tScreen) sendScroll(sc scroll) {
+	d := &t.dcaps
+	top, bot := sc.y, sc.y+sc.h-1
+	n := sc.n
+	if n < 0 {
+		n = -n
+	}
+	del := t.repeatCap(d.delLine1, d.delLine, n)
+	ins := t.repeatCap(d.insLine1, d.insLine, n)
+
+	t.readyErase(tcell.StyleDefault)
+	if d.setRegion != "" {
+		t.TPuts(t.ti.TParm(d.setRegion, top, bot))
+		t.cx, t.cy = -1, -1
+		if sc.n > 0 {
+			if s := t.repeatCap(d.index, d.indexN, n); s != "" {
+				t.moveTo(0, bot)
+				t.TPuts(s)
+			} else {
+				t.moveTo(0, top)
+				t.TPuts(del)
+			}
+		} else {
+			if s := t.repeatCap(d.revIndex, d.revIndexN, n); s != "" {
+				t.moveTo(0, top)
+				t.TPuts(s)
+			} else {
+				t.moveTo(0, top)
+				t.TPuts(ins)
+			}
+		}
+		t.TPuts(t.ti.TParm(d.setRegion, 0, t.h-1))
+	} else if sc.n > 0 {
+		// Deleting lines pulls up those below the region too, so as
+		// many are put back under it.
+		t.moveTo(0, top)
+		t.TPuts(del)
+		if bot < t.h-1 {
+			t.cx, t.cy = -1, -1
+			t.moveTo(0, bot-n+1)
+			t.TPuts(ins)
+		}
+	} else {
+		if bot < t.h-1 {
+			t.moveTo(0, bot-n+1)
+			t.TPuts(del)
+			t.cx, t.cy = -1, -1
+		}
+		t.moveTo(0, top)
+		t.TPuts(ins)
+	}
+	// Where the cursor ends up differs between terminals.
+	t.cx, t.cy = -1, -1
+}
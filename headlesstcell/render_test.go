@@ -0,0 +1,582 @@
+package headlesstcell
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell"
+)
+
+// Bytes per frame of some typical scenes, on an 80 by 24 screen.
+
+const benchW, benchH = 80, 24
+
+var benchTerms = []string{"xterm-256color", "screen", "ansi"}
+
+// nullConn is a client that sends nothing and takes everything.
+type nullConn struct {
+	closed chan struct{}
+}
+
+func (c *nullConn) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, nil
+}
+
+func (c *nullConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func newBenchScreen(b *testing.B, term string) *tScreen {
+	c := &nullConn{closed: make(chan struct{})}
+	s, err := NewScreen(c, term, benchW, benchH, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		s.Fini()
+		close(c.closed)
+	})
+	t := s.(*tScreen)
+	drawn(t)
+	return t
+}
+
+// drawn draws what's changed on t, returning how many bytes it took.
+func drawn(t *tScreen) int {
+	t.Lock()
+	defer t.Unlock()
+	t.resize()
+	t.draw()
+	return t.buf.Len()
+}
+
+// eachTerm runs scene on each of benchTerms, reporting the mean of the
+// bytes it returns for frames 1 to b.N.
+func eachTerm(b *testing.B, scene func(b *testing.B, t *tScreen, n int) int) {
+	for _, term := range benchTerms {
+		b.Run(term, func(b *testing.B) {
+			t := newBenchScreen(b, term)
+			b.ResetTimer()
+			total := 0
+			for n := 1; n <= b.N; n++ {
+				total += scene(b, t, n)
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "bytes/frame")
+		})
+	}
+}
+
+var logWords = strings.Fields("the goblin hits you for damage misses sword north torch a rat flees gold coins")
+
+// logLine returns line n of a log.
+func logLine(n int) string {
+	r := rand.New(rand.NewSource(int64(n)))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%02d:%02d] ", n/60%60, n%60)
+	for l := 18 + r.Intn(55); sb.Len() < l; {
+		sb.WriteString(logWords[r.Intn(len(logWords))])
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+// put writes s at x, y, returning the column after it.
+func put(t *tScreen, x, y int, s string, style tcell.Style) int {
+	for _, c := range s {
+		t.SetContent(x, y, c, nil, style)
+		x++
+	}
+	return x
+}
+
+// putLogLine writes a log line in row y, its timestamp colored, and blanks
+// the rest of the row.
+func putLogLine(t *tScreen, y int, line string) {
+	x := put(t, 0, y, line[:8], tcell.StyleDefault.Foreground(tcell.ColorTeal))
+	x = put(t, x, y, line[8:], tcell.StyleDefault)
+	for ; x < benchW; x++ {
+		t.SetContent(x, y, ' ', nil, tcell.StyleDefault)
+	}
+}
+
+// BenchmarkScrollingLog adds a line to a log filling the screen above a
+// status line each frame, scrolling it with ScrollRegion.
+func BenchmarkScrollingLog(b *testing.B) {
+	eachTerm(b, func(b *testing.B, t *tScreen, n int) int {
+		t.ScrollRegion(0, 0, benchW, benchH-1, 1)
+		putLogLine(t, benchH-2, logLine(n))
+		put(t, 0, benchH-1, fmt.Sprintf("HP %3d/100", 100-n%50), tcell.StyleDefault.Reverse(true))
+		return drawn(t)
+	})
+}
+
+// BenchmarkRepaintedLog is the same log without a status line, drawn
+// again in full each frame by an application that doesn't scroll it.
+func BenchmarkRepaintedLog(b *testing.B) {
+	eachTerm(b, func(b *testing.B, t *tScreen, n int) int {
+		for y := 0; y < benchH; y++ {
+			putLogLine(t, y, logLine(n+y))
+		}
+		return drawn(t)
+	})
+}
+
+var terrain = []struct {
+	r     rune
+	style tcell.Style
+}{
+	{'.', tcell.StyleDefault.Foreground(tcell.ColorGreen)},
+	{'"', tcell.StyleDefault.Foreground(tcell.ColorOlive)},
+	{'~', tcell.StyleDefault.Foreground(tcell.ColorBlue).Background(tcell.ColorNavy)},
+	{'#', tcell.StyleDefault.Foreground(tcell.ColorGray)},
+	{'^', tcell.StyleDefault.Foreground(tcell.ColorWhite)},
+}
+
+// benchWorld returns a terrain map with regions, some screens wide.
+func benchWorld() [][]int {
+	r := rand.New(rand.NewSource(2))
+	world := make([][]int, benchH)
+	for y := range world {
+		world[y] = make([]int, benchW*4)
+		tr := r.Intn(len(terrain))
+		for x := range world[y] {
+			if r.Intn(12) == 0 {
+				tr = r.Intn(len(terrain))
+			}
+			if y > 0 && r.Intn(3) > 0 {
+				tr = world[y-1][x]
+			}
+			world[y][x] = tr
+		}
+	}
+	return world
+}
+
+func putMap(t *tScreen, world [][]int, off int) {
+	for y := range world {
+		for x := 0; x < benchW; x++ {
+			tr := terrain[world[y][(x+off)%len(world[y])]]
+			t.SetContent(x, y, tr.r, nil, tr.style)
+		}
+	}
+	t.SetContent(benchW/2, benchH/2, '@', nil, tcell.StyleDefault.Foreground(tcell.ColorYellow).Bold(true))
+}
+
+// BenchmarkMapFirst draws a terrain map on a screen that's been cleared.
+func BenchmarkMapFirst(b *testing.B) {
+	world := benchWorld()
+	eachTerm(b, func(b *testing.B, t *tScreen, n int) int {
+		b.StopTimer()
+		t.Clear()
+		t.Sync()
+		b.StartTimer()
+		putMap(t, world, 0)
+		return drawn(t)
+	})
+}
+
+// BenchmarkMapWalk moves the view of the map a column a frame, as the
+// player walks east.
+func BenchmarkMapWalk(b *testing.B) {
+	world := benchWorld()
+	eachTerm(b, func(b *testing.B, t *tScreen, n int) int {
+		putMap(t, world, n)
+		return drawn(t)
+	})
+}
+
+// BenchmarkClear clears a screen full of text to show a short menu.
+func BenchmarkClear(b *testing.B) {
+	eachTerm(b, func(b *testing.B, t *tScreen, n int) int {
+		b.StopTimer()
+		for y := 0; y < benchH; y++ {
+			putLogLine(t, y, logLine(n+y))
+		}
+		drawn(t)
+		b.StartTimer()
+		t.Clear()
+		put(t, 30, 10, "1) Play", tcell.StyleDefault.Bold(true))
+		put(t, 30, 11, "2) Quit", tcell.StyleDefault)
+		return drawn(t)
+	})
+}
+
+// BenchmarkSync draws the menu again from scratch, as after a resize.
+func BenchmarkSync(b *testing.B) {
+	eachTerm(b, func(b *testing.B, t *tScreen, n int) int {
+		put(t, 30, 10, "1) Play", tcell.StyleDefault.Bold(true))
+		put(t, 30, 11, "2) Quit", tcell.StyleDefault)
+		t.Lock()
+		t.clear = true
+		t.cells.Invalidate()
+		t.Unlock()
+		return drawn(t)
+	})
+}
+
+// renderTerms are the terminals correctness is checked on: xterm-256color
+// from the test database, which has rep and scrolling regions, and tcell's
+// screen and ansi, which get the ECMA-48 capabilities without them.  The
+// ways to scroll are taken away from xterm-256color too, to check the
+// screen gets by without.
+var renderTerms = []struct {
+	name, term string
+	strip      func(d *drawCaps)
+}{
+	{"xterm-256color", "xterm-256color", nil},
+	{"screen", "screen", nil},
+	{"ansi", "ansi", nil},
+	{"no csr", "xterm-256color", func(d *drawCaps) {
+		d.setRegion, d.index, d.indexN, d.revIndex, d.revIndexN = "", "", "", "", ""
+	}},
+	{"no scrolling", "xterm-256color", func(d *drawCaps) {
+		*d = drawCaps{cr: d.cr, down1: d.down1, clrEOL: d.clrEOL}
+	}},
+}
+
+// renderScreen is a screen drawing to a model terminal.
+type renderScreen struct {
+	*tScreen
+	vts []*vt
+}
+
+func newRenderScreen(t *testing.T, term string, w, h int) *renderScreen {
+	s, err := NewScreen(newRecordConn(t), term, w, h, Options{TerminfoDirs: []string{filepath.Join("testdata", "terminfo")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Fini)
+	rs := &renderScreen{tScreen: s.(*tScreen)}
+	for _, wrapNow := range []bool{false, true} {
+		v := newVT(w, h)
+		v.wrapNow = wrapNow
+		rs.vts = append(rs.vts, v)
+	}
+	return rs
+}
+
+// frame draws what's changed, and returns what was sent.
+func (rs *renderScreen) frame() []byte {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.resize()
+	rs.draw()
+	return append([]byte(nil), rs.buf.Bytes()...)
+}
+
+// check draws what's changed, and checks the model terminals show what
+// the screen has, with the cursor where it should be.
+func (rs *renderScreen) check(t *testing.T) {
+	t.Helper()
+	b := rs.frame()
+	for _, v := range rs.vts {
+		v.Write(b)
+		if v.err != nil {
+			t.Fatalf("%v in %q", v.err, b)
+		}
+		for y := 0; y < rs.h; y++ {
+			for x := 0; x < rs.w; x++ {
+				mainc, _, style, width := rs.cells.GetContent(x, y)
+				if width == 2 && x+1 < rs.w && v.cells[y][x+1].r != 0 {
+					t.Fatalf("wrap %v: wide %q at %d, %d has %q after it, in %q",
+						v.wrapNow, mainc, x, y, v.cells[y][x+1].r, b)
+				}
+				if width == 2 && x == rs.w-1 {
+					// It doesn't fit, and is drawn as a space.
+					mainc = ' '
+				}
+				if !v.cells[y][x].looksLike(mainc, rs.styleOf(style)) {
+					t.Fatalf("wrap %v: %d, %d is %q %+v, want %q %v, after %q",
+						v.wrapNow, x, y, v.cells[y][x].r, v.cells[y][x].style, mainc, style, b)
+				}
+				if width == 2 {
+					x++
+				}
+			}
+		}
+		if x, y := rs.cursorx, rs.cursory; x >= 0 && y >= 0 && (v.x != x || v.y != y) {
+			t.Fatalf("wrap %v: cursor at %d, %d, want %d, %d, after %q", v.wrapNow, v.x, v.y, x, y, b)
+		}
+	}
+}
+
+// renderStyles are in the colors every terminal has, so the model sees
+// them as they were set.
+var renderStyles = []tcell.Style{
+	tcell.StyleDefault,
+	tcell.StyleDefault.Bold(true),
+	tcell.StyleDefault.Foreground(tcell.ColorMaroon),
+	tcell.StyleDefault.Foreground(tcell.ColorOlive).Background(tcell.ColorNavy),
+	tcell.StyleDefault.Background(tcell.ColorGreen),
+	tcell.StyleDefault.Reverse(true),
+	tcell.StyleDefault.Underline(true).Foreground(tcell.ColorTeal),
+}
+
+// scribble makes random changes to rs, of the kinds the renderer takes
+// shortcuts with: runs of one character, blank line ends, text in the
+// last column, wide characters, clears and scrolls.
+func scribble(r *rand.Rand, rs *renderScreen) {
+	w, h := rs.w, rs.h
+	style := func() tcell.Style { return renderStyles[r.Intn(len(renderStyles))] }
+	for n := 1 + r.Intn(6); n > 0; n-- {
+		y := r.Intn(h)
+		switch r.Intn(10) {
+		case 0, 1:
+			// a run of one character, maybe to the margin
+			x, c, st := r.Intn(w), rune("ab .%"[r.Intn(5)]), style()
+			for i := 1 + r.Intn(w); i > 0 && x < w; i-- {
+				rs.SetContent(x, y, c, nil, st)
+				x++
+			}
+		case 2:
+			// text
+			x, st := r.Intn(w), style()
+			for _, c := range logLine(r.Int())[:1+r.Intn(12)] {
+				rs.SetContent(x, y, c, nil, st)
+				if x++; x == w {
+					break
+				}
+			}
+		case 3:
+			// a blank end to the line
+			for x := r.Intn(w); x < w; x++ {
+				rs.SetContent(x, y, ' ', nil, tcell.StyleDefault)
+			}
+		case 4:
+			// the last column
+			rs.SetContent(w-1, y, rune('A'+r.Intn(26)), nil, style())
+		case 5:
+			// wide characters, which don't fit in the last column
+			x := r.Intn(w)
+			if r.Intn(3) == 0 {
+				x = w - 1 - r.Intn(2)
+			}
+			rs.SetContent(x, y, []rune("世界ｗ")[r.Intn(3)], nil, style())
+		case 6:
+			switch r.Intn(10) {
+			case 0:
+				rs.Clear()
+			case 1:
+				rs.Lock()
+				rs.clear = true
+				rs.cells.Invalidate()
+				rs.Unlock()
+			}
+		case 7:
+			if r.Intn(3) == 0 {
+				rs.HideCursor()
+			} else {
+				rs.ShowCursor(r.Intn(w), y)
+			}
+		case 8, 9:
+			// a scroll, usually of whole rows, up or down by up to
+			// the region's height
+			x, rw := 0, w
+			if r.Intn(4) == 0 {
+				x = r.Intn(w)
+				rw = 1 + r.Intn(w-x)
+			}
+			rh := 1 + r.Intn(h-y)
+			rs.ScrollRegion(x, y, rw, rh, r.Intn(2*rh+1)-rh)
+		}
+	}
+}
+
+// TestRenderRandom draws random changes, checking what's sent is drawn
+// right by terminals that wrap at the margin either way.  Screens narrow
+// enough for runs to reach the margin often are drawn too.
+func TestRenderRandom(t *testing.T) {
+	for _, term := range renderTerms {
+		for _, size := range [][2]int{{80, 24}, {13, 5}, {2, 2}} {
+			t.Run(fmt.Sprintf("%s %dx%d", term.name, size[0], size[1]), func(t *testing.T) {
+				rs := newRenderScreen(t, term.term, size[0], size[1])
+				if term.strip != nil {
+					term.strip(&rs.dcaps)
+				}
+				rs.check(t)
+				r := rand.New(rand.NewSource(1))
+				// Big screens are slow to check, and their margins
+				// are reached less often anyway.
+				frames := 500
+				if size[0] > 20 {
+					frames = 100
+				}
+				for i := 0; i < frames; i++ {
+					scribble(r, rs)
+					rs.check(t)
+				}
+			})
+		}
+	}
+}
+
+// TestRenderSequences checks what's sent for a few changes, each on a
+// 20 by 4 screen that's drawn nothing but spaces, with the cursor hidden.
+func TestRenderSequences(t *testing.T) {
+	plain := tcell.StyleDefault
+	red := plain.Foreground(tcell.ColorMaroon)
+	tests := []struct {
+		name, term string
+		change     func(s *renderScreen)
+		want       string
+	}{
+		{
+			name: "rep", term: "xterm-256color",
+			change: func(s *renderScreen) { put(s.tScreen, 3, 1, "aaaaaaaa", plain) },
+			want:   "\x1b[2;4Ha\x1b[7b",
+		},
+		{
+			name: "short run", term: "xterm-256color",
+			change: func(s *renderScreen) { put(s.tScreen, 3, 1, "aaa", plain) },
+			want:   "\x1b[2;4Haaa",
+		},
+		{
+			name: "no rep", term: "screen",
+			change: func(s *renderScreen) { put(s.tScreen, 3, 1, "aaaaaaaa", plain) },
+			want:   "\x1b[2;4Haaaaaaaa",
+		},
+		{
+			// The cursor is lost past the margin, and addressed again.
+			name: "margin", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 18, 0, "xy", plain)
+				put(s.tScreen, 0, 1, "z", plain)
+			},
+			want: "\x1b[1;19Hxy\x1b[2;1Hz",
+		},
+		{
+			// A run repeated to the margin is as lost.
+			name: "rep to the margin", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 10, 0, "aaaaaaaaaa", plain)
+				put(s.tScreen, 0, 1, "z", plain)
+			},
+			want: "\x1b[1;11Ha\x1b[9b\x1b[2;1Hz",
+		},
+		{
+			name: "wide at the margin", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 17, 0, "世", plain)
+				put(s.tScreen, 19, 0, "界", plain)
+			},
+			want: "\x1b[1;18H世\x1b[1;20H ",
+		},
+		{
+			// After a wide character, where the cursor is isn't known.
+			name: "after wide", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 0, 0, "世", plain)
+				put(s.tScreen, 2, 0, "a", plain)
+			},
+			want: "\x1b[1;1H世\x1b[1;3Ha",
+		},
+		{
+			name: "down a line", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 5, 0, "ab", plain)
+				put(s.tScreen, 7, 1, "c", plain)
+			},
+			want: "\x1b[1;6Hab\nc",
+		},
+		{
+			name: "back to the start", term: "screen",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 15, 0, "ab", plain)
+				put(s.tScreen, 0, 1, "c", plain)
+			},
+			want: "\x1b[1;16Hab\n\rc",
+		},
+		{
+			// Clean cells between are cheaper to write again than
+			// to move over.
+			name: "rewrite", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 0, 0, "a", plain)
+				put(s.tScreen, 3, 0, "b", plain)
+			},
+			want: "\x1b[1;1Ha  b",
+		},
+		{
+			name: "move right", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				put(s.tScreen, 0, 0, "a", plain)
+				put(s.tScreen, 10, 0, "b", plain)
+			},
+			want: "\x1b[1;1Ha\x1b[9Cb",
+		},
+		{
+			// Style changes come before the run they're for.
+			name: "styled rep", term: "xterm-256color",
+			change: func(s *renderScreen) { put(s.tScreen, 0, 2, "----------", red) },
+			want:   "\x1b[3;1H\x1b[31m-\x1b[9b",
+		},
+		{
+			name: "scroll with a region", term: "xterm-256color",
+			change: func(s *renderScreen) { s.ScrollRegion(0, 0, 20, 3, 1) },
+			want:   "\x1b[1;3r\x1b[3;1H\n\x1b[1;4r",
+		},
+		{
+			name: "scroll down with a region", term: "xterm-256color",
+			change: func(s *renderScreen) { s.ScrollRegion(0, 1, 20, 3, -2) },
+			want:   "\x1b[2;4r\x1b[2;1H\x1bM\x1bM\x1b[1;4r",
+		},
+		{
+			// Deleting lines pulls the row below the region up, so
+			// a line's put back under it.
+			name: "scroll by lines", term: "screen",
+			change: func(s *renderScreen) { s.ScrollRegion(0, 0, 20, 3, 1) },
+			want:   "\x1b[1;1H\x1b[M\x1b[3;1H\x1b[L",
+		},
+		{
+			name: "scroll down by lines", term: "screen",
+			change: func(s *renderScreen) { s.ScrollRegion(0, 1, 20, 3, -2) },
+			want:   "\x1b[2;1H\x1b[2L",
+		},
+		{
+			// ansi can't hide the cursor, so it's parked in the
+			// corner.
+			name: "scroll the whole screen", term: "ansi",
+			change: func(s *renderScreen) { s.ScrollRegion(0, 0, 20, 4, 1) },
+			want:   "\x1b[5;21H\x1b[1;1H\x1b[M\x1b[5;21H",
+		},
+		{
+			// Only whole rows are scrolled by the terminal; these
+			// are drawn again, which they don't need, being blank.
+			name: "scroll part of rows", term: "xterm-256color",
+			change: func(s *renderScreen) { s.ScrollRegion(1, 0, 19, 3, 1) },
+			want:   "",
+		},
+		{
+			name: "scrolls merged", term: "xterm-256color",
+			change: func(s *renderScreen) {
+				s.ScrollRegion(0, 0, 20, 3, 1)
+				s.ScrollRegion(0, 0, 20, 3, 1)
+			},
+			want: "\x1b[1;3r\x1b[3;1H\n\n\x1b[1;4r",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := newRenderScreen(t, tt.term, 20, 4)
+			rs.check(t)
+			tt.change(rs)
+			// The cursor is hidden around the frame.
+			b := string(rs.frame())
+			b = strings.TrimPrefix(b, rs.ti.HideCursor)
+			b = strings.TrimSuffix(b, rs.ti.HideCursor)
+			if b != tt.want {
+				t.Errorf("sent %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package headlesstcell
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell"
+	"github.com/gdamore/tcell/terminfo"
+)
+
+// UnderlineStyle is how underlined text is underlined.  Terminals that
+// can only draw a single line draw that.
+type UnderlineStyle int
+
+const (
+	UnderlineSingle UnderlineStyle = iota
+	UnderlineDouble
+	UnderlineCurly
+	UnderlineDotted
+)
+
+// Attributes tcell doesn't have are kept in bits of tcell.Style it
+// doesn't use, so they survive its methods.  Style.Normal leaves them be.
+const (
+	styleStrikeThrough tcell.Style = 1 << 31
+	styleOverline      tcell.Style = 1 << 60
+	styleUnderlineBits             = 61
+	styleUnderline     tcell.Style = 3 << styleUnderlineBits
+
+	styleExtra = styleStrikeThrough | styleOverline | styleUnderline
+)
+
+// StrikeThrough returns st with a line through it, or not.
+func StrikeThrough(st tcell.Style, on bool) tcell.Style {
+	if on {
+		return st | styleStrikeThrough
+	}
+	return st &^ styleStrikeThrough
+}
+
+// Overline returns st with a line over it, or not.
+func Overline(st tcell.Style, on bool) tcell.Style {
+	if on {
+		return st | styleOverline
+	}
+	return st &^ styleOverline
+}
+
+// Underline returns st underlined in the given style.
+func Underline(st tcell.Style, u UnderlineStyle) tcell.Style {
+	return st.Underline(true)&^styleUnderline | tcell.Style(u&3)<<styleUnderlineBits
+}
+
+func underlineStyle(st tcell.Style) UnderlineStyle {
+	return UnderlineStyle(st&styleUnderline) >> styleUnderlineBits
+}
+
+// styleCaps are the capabilities for attributes tcell's Terminfo has no
+// fields for, from the extended section of a compiled terminfo entry.
+type styleCaps struct {
+	strikeThrough  string // smxx
+	overline       string // Smol
+	underlineStyle string // Smulx, taking the style as 1 to 5
+	underlineColor string // Setulc, taking the color as 0xRRGGBB
+}
+
+// ecmaStyleCaps are what modern emulators understand, whatever their
+// terminfo entries say.
+var ecmaStyleCaps = styleCaps{
+	strikeThrough:  "\x1b[9m",
+	overline:       "\x1b[53m",
+	underlineStyle: "\x1b[4:%p1%dm",
+	underlineColor: "\x1b[58:2::%p1%{65536}%/%d:%p1%{256}%/%{255}%&%d:%p1%{255}%&%dm",
+}
+
+// smulx are the Smulx parameters for each UnderlineStyle.
+var smulx = [...]int{
+	UnderlineSingle: 1,
+	UnderlineDouble: 2,
+	UnderlineCurly:  3,
+	UnderlineDotted: 4,
+}
+
+// isSGR reports whether ti's attributes are ECMA-48 SGR codes, which
+// can be turned off one at a time.
+func isSGR(ti *terminfo.Terminfo) bool {
+	return ti.Bold == "\x1b[1m" && ti.Underline == "\x1b[4m"
+}
+
+// SetUnderlineColor sets the color that text underlined in style u is
+// underlined in, on terminals that can color underlines.  The default is
+// ColorDefault, the text's own color.
+func (t *tScreen) SetUnderlineColor(u UnderlineStyle, c tcell.Color) {
+	t.Lock()
+	t.ulcolors[u&3] = c
+	t.curstyle = tcell.Style(-1)
+	t.cells.Invalidate()
+	t.Unlock()
+}
+
+// sendStyle changes the terminal's style from t.curstyle to style.  On
+// SGR terminals only what changed is sent, using the codes that turn one
+// attribute off; others start over from AttrOff.
+func (t *tScreen) sendStyle(style tcell.Style) {
+	fg, bg, attrs := style.Decompose()
+	extra := t.extraAttrs(style)
+	curfg, curbg, curattrs := t.curstyle.Decompose()
+	curextra := t.extraAttrs(t.curstyle)
+
+	if !t.sgr || t.curstyle == tcell.Style(-1) {
+		t.TPuts(t.ti.AttrOff)
+		curfg, curbg, curattrs, curextra = tcell.ColorDefault, tcell.ColorDefault, tcell.AttrNone, 0
+		t.curulc = tcell.ColorDefault
+	} else {
+		var off []string
+		gone := curattrs &^ attrs
+		if gone&(tcell.AttrBold|tcell.AttrDim) != 0 {
+			// One code turns off both.
+			off = append(off, "22")
+			curattrs &^= tcell.AttrBold | tcell.AttrDim
+		}
+		if gone&tcell.AttrItalic != 0 {
+			off = append(off, "23")
+		}
+		if gone&tcell.AttrUnderline != 0 {
+			off = append(off, "24")
+		}
+		if gone&tcell.AttrBlink != 0 {
+			off = append(off, "25")
+		}
+		if gone&tcell.AttrReverse != 0 {
+			off = append(off, "27")
+		}
+		curattrs &= attrs
+		if curextra&^extra&styleStrikeThrough != 0 {
+			off = append(off, "29")
+		}
+		if curextra&^extra&styleOverline != 0 {
+			off = append(off, "55")
+		}
+		if fg == tcell.ColorDefault && curfg != fg {
+			off = append(off, "39")
+			curfg = fg
+		}
+		if bg == tcell.ColorDefault && curbg != bg {
+			off = append(off, "49")
+			curbg = bg
+		}
+		if len(off) > 0 {
+			t.TPuts("\x1b[" + strings.Join(off, ";") + "m")
+		}
+	}
+
+	if fg != curfg && bg != curbg {
+		t.sendFgBg(fg, bg)
+	} else if fg != curfg {
+		t.sendFg(fg)
+	} else if bg != curbg {
+		t.sendBg(bg)
+	}
+
+	on := attrs &^ curattrs
+	if on&tcell.AttrBold != 0 {
+		t.TPuts(t.ti.Bold)
+	}
+	if on&tcell.AttrDim != 0 {
+		t.TPuts(t.ti.Dim)
+	}
+	if on&tcell.AttrItalic != 0 {
+		t.TPuts(t.ti.Italic)
+	}
+	if on&tcell.AttrBlink != 0 {
+		t.TPuts(t.ti.Blink)
+	}
+	if on&tcell.AttrReverse != 0 {
+		t.TPuts(t.ti.Reverse)
+	}
+	if attrs&tcell.AttrUnderline != 0 {
+		u := underlineStyle(extra)
+		if on&tcell.AttrUnderline != 0 || u != underlineStyle(curextra) {
+			if u != UnderlineSingle {
+				t.TPuts(t.ti.TParm(t.caps.underlineStyle, smulx[u]))
+			} else {
+				t.TPuts(t.ti.Underline)
+			}
+		}
+		if c := t.ulcolors[underlineStyle(style)]; c != t.curulc && t.caps.underlineColor != "" {
+			t.sendUnderlineColor(c)
+		}
+	}
+	if extra&^curextra&styleStrikeThrough != 0 {
+		t.TPuts(t.caps.strikeThrough)
+	}
+	if extra&^curextra&styleOverline != 0 {
+		t.TPuts(t.caps.overline)
+	}
+	t.curstyle = style
+}
+
+// extraAttrs returns those of st's extra attributes the terminal can show.
+func (t *tScreen) extraAttrs(st tcell.Style) tcell.Style {
+	st &= styleExtra
+	if t.caps.strikeThrough == "" {
+		st &^= styleStrikeThrough
+	}
+	if t.caps.overline == "" {
+		st &^= styleOverline
+	}
+	if t.caps.underlineStyle == "" {
+		st &^= styleUnderline
+	}
+	return st
+}
+
+func (t *tScreen) sendUnderlineColor(c tcell.Color) {
+	if c == tcell.ColorDefault {
+		if !t.sgr {
+			return
+		}
+		t.TPuts("\x1b[59m")
+	} else {
+		r, g, b := c.RGB()
+		if r < 0 {
+			return
+		}
+		t.TPuts(t.ti.TParm(t.caps.underlineColor, int(r<<16|g<<8|b)))
+	}
+	t.curulc = c
+}
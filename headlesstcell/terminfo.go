@@ -0,0 +1,584 @@
+package headlesstcell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gdamore/tcell/terminfo"
+)
+
+// DefaultTerminfoDirs are where the system's compiled terminfo database is
+// looked for, as ncurses does: $TERMINFO, the directories in
+// $TERMINFO_DIRS, then the usual locations.
+var DefaultTerminfoDirs = terminfoDirs(os.Getenv("TERMINFO"), os.Getenv("TERMINFO_DIRS"))
+
+func terminfoDirs(terminfo, terminfoDirs string) []string {
+	var dirs []string
+	if terminfo != "" {
+		dirs = append(dirs, terminfo)
+	}
+	for _, dir := range filepath.SplitList(terminfoDirs) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return append(dirs,
+		"/etc/terminfo",
+		"/lib/terminfo",
+		"/usr/share/terminfo",
+		"/usr/lib/terminfo",
+	)
+}
+
+// lastResortTerm is compiled into tcell's base package, so it's always
+// there to fall back on.
+const lastResortTerm = "ansi"
+
+// findTerminfo looks for a description of term, trying in turn tcell's
+// compiled-in terminals, the terminfo database, term with its suffixes
+// stripped (xterm-kitty becomes xterm), opts.DefaultTerm and finally a
+// plain ANSI terminal.  It returns an entry whose Terminfo the caller may
+// modify.  The capabilities tcell's Terminfo doesn't have come, for
+// tcell's own terminals, from the database's entry of the same name, or
+// failing that are assumed from how it addresses the cursor.
+func findTerminfo(term string, opts Options) (*entry, error) {
+	var names []string
+	for name := term; name != ""; {
+		names = append(names, name)
+		i := strings.LastIndexByte(name, '-')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	if opts.DefaultTerm != "" {
+		names = append(names, opts.DefaultTerm)
+	}
+	names = append(names, lastResortTerm)
+
+	dirs := opts.TerminfoDirs
+	if dirs == nil {
+		dirs = DefaultTerminfoDirs
+	}
+	for _, name := range names {
+		e, dbErr := loadTerminfo(dirs, name)
+		if ti, err := terminfo.LookupTerminfo(name); err == nil {
+			tc := *ti
+			if dbErr == nil {
+				return &entry{ti: &tc, caps: e.caps, draw: e.draw}, nil
+			}
+			ent := &entry{ti: &tc}
+			if isECMA(tc.SetCursor) {
+				ent.draw = ecmaDrawCaps
+			}
+			return ent, nil
+		}
+		if dbErr == nil {
+			tc := *e.ti
+			return &entry{ti: &tc, caps: e.caps, draw: e.draw}, nil
+		}
+	}
+	return nil, terminfo.ErrTermNotFound
+}
+
+// entry is a compiled terminfo entry.
+type entry struct {
+	ti   *terminfo.Terminfo
+	caps styleCaps
+	draw drawCaps
+}
+
+var (
+	dbCache = make(map[string]*entry)
+	dbLock  sync.Mutex
+)
+
+// loadTerminfo reads name's entry from the first of dirs that has one.
+// Entries are cached, so each file is only parsed once.
+func loadTerminfo(dirs []string, name string) (*entry, error) {
+	if name == "" || len(name) > 64 || strings.ContainsAny(name, "/\\") || name[0] == '.' {
+		return nil, terminfo.ErrTermNotFound
+	}
+	for _, dir := range dirs {
+		// Linux uses the first letter for the subdirectory, macOS its
+		// hex code.
+		for _, sub := range []string{name[:1], fmt.Sprintf("%x", name[0])} {
+			path := filepath.Join(dir, sub, name)
+			dbLock.Lock()
+			e, ok := dbCache[path]
+			dbLock.Unlock()
+			if ok {
+				return e, nil
+			}
+			e, err := readTerminfo(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			dbLock.Lock()
+			dbCache[path] = e
+			dbLock.Unlock()
+			return e, nil
+		}
+	}
+	return nil, terminfo.ErrTermNotFound
+}
+
+// Compiled terminfo magic numbers, for 16 and 32 bit numbers.
+const (
+	magicLegacy   = 0432
+	magicExtended = 01036
+)
+
+// The largest compiled entry ncurses will write.
+const maxTerminfoSize = 32768
+
+var errBadTerminfo = errors.New("not a compiled terminfo entry")
+
+// readTerminfo parses a compiled terminfo file, as described in term(5).
+// Only the capabilities we use are read: the standard ones tcell has and
+// those we draw with, and from the extended section, those for 24-bit
+// colors and the attributes tcell doesn't have.
+func readTerminfo(path string) (*entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxTerminfoSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseTerminfo(b)
+}
+
+func parseTerminfo(b []byte) (*entry, error) {
+	if len(b) < 12 {
+		return nil, errBadTerminfo
+	}
+	var hdr [6]int
+	for i := range hdr {
+		hdr[i] = int(int16(binary.LittleEndian.Uint16(b[i*2:])))
+	}
+	numSize := 2
+	switch hdr[0] {
+	case magicLegacy:
+	case magicExtended:
+		numSize = 4
+	default:
+		return nil, errBadTerminfo
+	}
+	namesLen, boolCount, numCount, strCount, tableLen := hdr[1], hdr[2], hdr[3], hdr[4], hdr[5]
+	if namesLen < 0 || boolCount < 0 || numCount < 0 || strCount < 0 || tableLen < 0 {
+		return nil, errBadTerminfo
+	}
+	b = b[12:]
+
+	take := func(n int) ([]byte, error) {
+		if n > len(b) {
+			return nil, errBadTerminfo
+		}
+		s := b[:n]
+		b = b[n:]
+		return s, nil
+	}
+	names, err := take(namesLen)
+	if err != nil {
+		return nil, err
+	}
+	bools, err := take(boolCount)
+	if err != nil {
+		return nil, err
+	}
+	if (namesLen+boolCount)%2 == 1 {
+		if _, err := take(1); err != nil {
+			return nil, err
+		}
+	}
+	nums, err := take(numCount * numSize)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := take(strCount * 2)
+	if err != nil {
+		return nil, err
+	}
+	table, err := take(tableLen)
+	if err != nil {
+		return nil, err
+	}
+	if tableLen%2 == 1 && len(b) > 0 {
+		b = b[1:]
+	}
+	extBools, extStrs := parseExtended(b, numSize)
+
+	num := func(i int) int {
+		if i >= numCount {
+			return -1
+		}
+		if numSize == 4 {
+			return int(int32(binary.LittleEndian.Uint32(nums[i*4:])))
+		}
+		return int(int16(binary.LittleEndian.Uint16(nums[i*2:])))
+	}
+	str := func(i int) string {
+		if i >= strCount {
+			return ""
+		}
+		off := int(int16(binary.LittleEndian.Uint16(offsets[i*2:])))
+		if off < 0 || off >= len(table) {
+			return ""
+		}
+		s := table[off:]
+		if end := strings.IndexByte(string(s), 0); end >= 0 {
+			s = s[:end]
+		}
+		return string(s)
+	}
+
+	all := strings.Split(strings.TrimRight(string(names), "\x00"), "|")
+	ti := &terminfo.Terminfo{Name: all[0]}
+	if len(all) > 2 {
+		// The last name is a description.
+		ti.Aliases = all[1 : len(all)-1]
+	}
+	ti.Columns = num(capColumns)
+	ti.Lines = num(capLines)
+	if ti.Colors = num(capMaxColors); ti.Colors < 0 {
+		ti.Colors = 0
+	}
+	for i, p := range terminfoStrings(ti) {
+		*p = str(i)
+	}
+	for i, p := range terminfoFKeys(ti) {
+		*p = str(capKeyF[i])
+	}
+	ti.SetFgRGB = extStrs["setrgbf"]
+	ti.SetBgRGB = extStrs["setrgbb"]
+	if extBools["RGB"] {
+		// Direct color entries, like xterm-direct, take RGB values in
+		// setaf for all but the first eight colors.
+		if ti.Colors > 256 {
+			ti.Colors = 8
+		}
+		addTrueColor(ti)
+	} else if extBools["Tc"] {
+		addTrueColor(ti)
+	}
+	noPadChar := capNoPadChar < boolCount && bools[capNoPadChar] == 1
+	if err := fixupTerminfo(ti, noPadChar); err != nil {
+		return nil, err
+	}
+	caps := styleCaps{
+		strikeThrough:  extStrs["smxx"],
+		overline:       extStrs["Smol"],
+		underlineStyle: extStrs["Smulx"],
+		underlineColor: extStrs["Setulc"],
+	}
+	var draw drawCaps
+	for i, p := range drawStrings(&draw) {
+		*p = str(i)
+	}
+	if !strings.Contains(draw.repeatRun, "%p1%c") {
+		// We can't say which character to repeat.
+		draw.repeatRun = ""
+	}
+	return &entry{ti: ti, caps: caps, draw: draw}, nil
+}
+
+var errNotAddressable = errors.New("terminal is not cursor addressable")
+
+// fixupTerminfo fills in what tcell's own terminfo generator would: the
+// modified keys modern emulators send but terminfo doesn't describe,
+// mouse mode, padding and combined colors.
+func fixupTerminfo(ti *terminfo.Terminfo, noPadChar bool) error {
+	if ti.SetCursor == "" {
+		return errNotAddressable
+	}
+	if ti.KeyShfRight == "\x1b[1;2C" && ti.KeyShfLeft == "\x1b[1;2D" {
+		ti.KeyShfUp = "\x1b[1;2A"
+		ti.KeyShfDown = "\x1b[1;2B"
+		ti.KeyMetaUp = "\x1b[1;9A"
+		ti.KeyMetaDown = "\x1b[1;9B"
+		ti.KeyMetaRight = "\x1b[1;9C"
+		ti.KeyMetaLeft = "\x1b[1;9D"
+		ti.KeyAltUp = "\x1b[1;3A"
+		ti.KeyAltDown = "\x1b[1;3B"
+		ti.KeyAltRight = "\x1b[1;3C"
+		ti.KeyAltLeft = "\x1b[1;3D"
+		ti.KeyCtrlUp = "\x1b[1;5A"
+		ti.KeyCtrlDown = "\x1b[1;5B"
+		ti.KeyCtrlRight = "\x1b[1;5C"
+		ti.KeyCtrlLeft = "\x1b[1;5D"
+		ti.KeyAltShfUp = "\x1b[1;4A"
+		ti.KeyAltShfDown = "\x1b[1;4B"
+		ti.KeyAltShfRight = "\x1b[1;4C"
+		ti.KeyAltShfLeft = "\x1b[1;4D"
+		ti.KeyMetaShfUp = "\x1b[1;10A"
+		ti.KeyMetaShfDown = "\x1b[1;10B"
+		ti.KeyMetaShfRight = "\x1b[1;10C"
+		ti.KeyMetaShfLeft = "\x1b[1;10D"
+		ti.KeyCtrlShfUp = "\x1b[1;6A"
+		ti.KeyCtrlShfDown = "\x1b[1;6B"
+		ti.KeyCtrlShfRight = "\x1b[1;6C"
+		ti.KeyCtrlShfLeft = "\x1b[1;6D"
+		ti.KeyShfPgUp = "\x1b[5;2~"
+		ti.KeyShfPgDn = "\x1b[6;2~"
+	}
+	if ti.KeyShfHome == "\x1b[1;2H" && ti.KeyShfEnd == "\x1b[1;2F" {
+		ti.KeyCtrlHome = "\x1b[1;5H"
+		ti.KeyCtrlEnd = "\x1b[1;5F"
+		ti.KeyAltHome = "\x1b[1;9H"
+		ti.KeyAltEnd = "\x1b[1;9F"
+		ti.KeyCtrlShfHome = "\x1b[1;6H"
+		ti.KeyCtrlShfEnd = "\x1b[1;6F"
+		ti.KeyAltShfHome = "\x1b[1;4H"
+		ti.KeyAltShfEnd = "\x1b[1;4F"
+		ti.KeyMetaShfHome = "\x1b[1;10H"
+		ti.KeyMetaShfEnd = "\x1b[1;10F"
+	}
+	// rxvt and friends
+	if ti.KeyShfRight == "\x1b[c" && ti.KeyShfLeft == "\x1b[d" {
+		ti.KeyShfUp = "\x1b[a"
+		ti.KeyShfDown = "\x1b[b"
+		ti.KeyCtrlUp = "\x1b[Oa"
+		ti.KeyCtrlDown = "\x1b[Ob"
+		ti.KeyCtrlRight = "\x1b[Oc"
+		ti.KeyCtrlLeft = "\x1b[Od"
+	}
+	if ti.KeyShfHome == "\x1b[7$" && ti.KeyShfEnd == "\x1b[8$" {
+		ti.KeyCtrlHome = "\x1b[7^"
+		ti.KeyCtrlEnd = "\x1b[8^"
+	}
+
+	// Terminals with kmous are assumed to do xterm mouse tracking.
+	if ti.Mouse != "" {
+		ti.MouseMode = "%?%p1%{1}%=%t%'h'%Pa%e%'l'%Pa%;" +
+			"\x1b[?1000%ga%c\x1b[?1002%ga%c\x1b[?1003%ga%c\x1b[?1006%ga%c"
+	}
+	if ti.Colors < 8 || ti.SetFg == "" {
+		ti.Colors = 0
+	}
+	if ti.Colors > 256 {
+		ti.Colors = 256
+	}
+	if ti.PadChar == "" && !noPadChar {
+		ti.PadChar = "\x00"
+	}
+	ti.SetFgBg = combineSGR(ti.SetFg, ti.SetBg, 1)
+	ti.SetFgBgRGB = combineSGR(ti.SetFgRGB, ti.SetBgRGB, 3)
+	return nil
+}
+
+// combineSGR combines standard SGR foreground and background sequences,
+// each taking n parameters, into one.
+func combineSGR(fg, bg string, n int) string {
+	if !strings.HasPrefix(fg, "\x1b[") || !strings.HasSuffix(fg, "m") ||
+		!strings.HasPrefix(bg, "\x1b[") || !strings.HasSuffix(bg, "m") {
+		return ""
+	}
+	bg = bg[2:]
+	for i := n; i > 0; i-- {
+		bg = strings.Replace(bg, fmt.Sprintf("%%p%d", i), fmt.Sprintf("%%p%d", i+n), -1)
+	}
+	return fg[:len(fg)-1] + ";" + bg
+}
+
+// addTrueColor gives ti xterm's 24-bit color sequences, unless it has its
+// own.
+func addTrueColor(ti *terminfo.Terminfo) {
+	if ti.SetFgRGB != "" && ti.SetBgRGB != "" {
+		return
+	}
+	ti.SetFgRGB = "\x1b[38;2;%p1%d;%p2%d;%p3%dm"
+	ti.SetBgRGB = "\x1b[48;2;%p1%d;%p2%d;%p3%dm"
+	ti.SetFgBgRGB = "\x1b[38;2;%p1%d;%p2%d;%p3%d;48;2;%p4%d;%p5%d;%p6%dm"
+}
+
+// parseExtended reads the extended section of a compiled entry, which
+// follows the standard capabilities in b, returning its booleans that are
+// set and its strings by name.  Numbers are skipped, as we use none.  A
+// missing or damaged section reads as empty.
+func parseExtended(b []byte, numSize int) (bools map[string]bool, strs map[string]string) {
+	if len(b) < 10 {
+		return nil, nil
+	}
+	var hdr [5]int
+	for i := range hdr {
+		hdr[i] = int(int16(binary.LittleEndian.Uint16(b[i*2:])))
+	}
+	boolCount, numCount, strCount, tableLen := hdr[0], hdr[1], hdr[2], hdr[4]
+	if boolCount < 0 || numCount < 0 || strCount < 0 || tableLen < 0 {
+		return nil, nil
+	}
+	b = b[10:]
+	offsets := boolCount + boolCount%2 + numCount*numSize
+	names := offsets + strCount*2
+	table := names + (boolCount+numCount+strCount)*2
+	if table+tableLen > len(b) {
+		return nil, nil
+	}
+	short := func(at int) int {
+		return int(int16(binary.LittleEndian.Uint16(b[at:])))
+	}
+	// cstr returns the string at off in the table, and where it ends.
+	cstr := func(off int) (string, int) {
+		if off < 0 || off >= tableLen {
+			return "", -1
+		}
+		s := b[table+off : table+tableLen]
+		end := bytes.IndexByte(s, 0)
+		if end < 0 {
+			return "", -1
+		}
+		return string(s[:end]), off + end + 1
+	}
+	// The names follow the string values, and are offset from them.
+	values := make([]string, strCount)
+	namesAt := 0
+	for i := range values {
+		if v, end := cstr(short(offsets + i*2)); end >= 0 {
+			values[i] = v
+			if end > namesAt {
+				namesAt = end
+			}
+		}
+	}
+	name := func(i int) string {
+		s, _ := cstr(namesAt + short(names+i*2))
+		return s
+	}
+
+	bools = make(map[string]bool)
+	for i := 0; i < boolCount; i++ {
+		if b[i] == 1 {
+			bools[name(i)] = true
+		}
+	}
+	strs = make(map[string]string)
+	for i, v := range values {
+		if v != "" {
+			strs[name(boolCount+numCount+i)] = v
+		}
+	}
+	return bools, strs
+}
+
+// Indexes of the standard capabilities, from ncurses' term.h.
+const (
+	capNoPadChar = 25 // boolean
+
+	capColumns   = 0
+	capLines     = 2
+	capMaxColors = 13
+)
+
+// terminfoStrings maps the string capabilities we read to their fields
+// in ti.
+func terminfoStrings(ti *terminfo.Terminfo) map[int]*string {
+	return map[int]*string{
+		1:   &ti.Bell,
+		5:   &ti.Clear,
+		28:  &ti.EnterCA,
+		40:  &ti.ExitCA,
+		16:  &ti.ShowCursor,
+		13:  &ti.HideCursor,
+		39:  &ti.AttrOff,
+		36:  &ti.Underline,
+		27:  &ti.Bold,
+		26:  &ti.Blink,
+		34:  &ti.Reverse,
+		30:  &ti.Dim,
+		311: &ti.Italic,
+		89:  &ti.EnterKeypad,
+		88:  &ti.ExitKeypad,
+		359: &ti.SetFg,
+		360: &ti.SetBg,
+		10:  &ti.SetCursor,
+		14:  &ti.CursorBack1,
+		19:  &ti.CursorUp1,
+		104: &ti.PadChar,
+		55:  &ti.KeyBackspace,
+		77:  &ti.KeyInsert,
+		59:  &ti.KeyDelete,
+		76:  &ti.KeyHome,
+		164: &ti.KeyEnd,
+		168: &ti.KeyHelp,
+		82:  &ti.KeyPgUp,
+		81:  &ti.KeyPgDn,
+		87:  &ti.KeyUp,
+		61:  &ti.KeyDown,
+		79:  &ti.KeyLeft,
+		83:  &ti.KeyRight,
+		148: &ti.KeyBacktab,
+		166: &ti.KeyExit,
+		57:  &ti.KeyClear,
+		176: &ti.KeyPrint,
+		159: &ti.KeyCancel,
+		355: &ti.Mouse,
+		146: &ti.AltChars,
+		25:  &ti.EnterAcs,
+		38:  &ti.ExitAcs,
+		155: &ti.EnableAcs,
+		210: &ti.KeyShfRight,
+		201: &ti.KeyShfLeft,
+		199: &ti.KeyShfHome,
+		194: &ti.KeyShfEnd,
+	}
+}
+
+// drawStrings maps the string capabilities we draw with that tcell's
+// Terminfo doesn't have to their fields in c.
+func drawStrings(c *drawCaps) map[int]*string {
+	return map[int]*string{
+		2:   &c.cr,
+		11:  &c.down1,
+		6:   &c.clrEOL,
+		112: &c.right,
+		111: &c.left,
+		114: &c.up,
+		107: &c.down,
+		121: &c.repeatRun,
+		3:   &c.setRegion,
+		129: &c.index,
+		130: &c.revIndex,
+		109: &c.indexN,
+		113: &c.revIndexN,
+		53:  &c.insLine1,
+		22:  &c.delLine1,
+		110: &c.insLine,
+		106: &c.delLine,
+	}
+}
+
+// capKeyF are the indexes of kf1 through kf63.  kf10 comes between kf0
+// and kf1, and kf11 on were added later.
+var capKeyF = func() []int {
+	keys := []int{66, 68, 69, 70, 71, 72, 73, 74, 75, 67}
+	for i := 216; i <= 268; i++ {
+		keys = append(keys, i)
+	}
+	return keys
+}()
+
+func terminfoFKeys(ti *terminfo.Terminfo) []*string {
+	return []*string{
+		&ti.KeyF1, &ti.KeyF2, &ti.KeyF3, &ti.KeyF4, &ti.KeyF5, &ti.KeyF6, &ti.KeyF7, &ti.KeyF8,
+		&ti.KeyF9, &ti.KeyF10, &ti.KeyF11, &ti.KeyF12, &ti.KeyF13, &ti.KeyF14, &ti.KeyF15, &ti.KeyF16,
+		&ti.KeyF17, &ti.KeyF18, &ti.KeyF19, &ti.KeyF20, &ti.KeyF21, &ti.KeyF22, &ti.KeyF23, &ti.KeyF24,
+		&ti.KeyF25, &ti.KeyF26, &ti.KeyF27, &ti.KeyF28, &ti.KeyF29, &ti.KeyF30, &ti.KeyF31, &ti.KeyF32,
+		&ti.KeyF33, &ti.KeyF34, &ti.KeyF35, &ti.KeyF36, &ti.KeyF37, &ti.KeyF38, &ti.KeyF39, &ti.KeyF40,
+		&ti.KeyF41, &ti.KeyF42, &ti.KeyF43, &ti.KeyF44, &ti.KeyF45, &ti.KeyF46, &ti.KeyF47, &ti.KeyF48,
+		&ti.KeyF49, &ti.KeyF50, &ti.KeyF51, &ti.KeyF52, &ti.KeyF53, &ti.KeyF54, &ti.KeyF55, &ti.KeyF56,
+		&ti.KeyF57, &ti.KeyF58, &ti.KeyF59, &ti.KeyF60, &ti.KeyF61, &ti.KeyF62, &ti.KeyF63,
+	}
+}
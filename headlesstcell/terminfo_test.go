@@ -0,0 +1,625 @@
+package headlesstcell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gdamore/tcell/terminfo"
+)
+
+// tiSource is a terminfo entry for compileTerminfo to compile, as tic
+// would.  Standard capabilities are keyed by their index.
+type tiSource struct {
+	names string
+	bools map[int]bool
+	nums  map[int]int
+	strs  map[int]string
+
+	// The extended section, if any of these are set.
+	extBools []string
+	extNums  map[string]int
+	extStrs  map[string]string
+}
+
+// Indexes of the string capabilities the tests set.
+const (
+	capClear = 5
+	capCup   = 10
+	capBold  = 27
+	capSgr0  = 39
+	capKcuu1 = 87
+	capKf1   = 66
+	capSetaf = 359
+	capSetab = 360
+)
+
+// xtermish returns an entry with enough capabilities to draw with.
+func xtermish(names string) tiSource {
+	return tiSource{
+		names: names,
+		nums:  map[int]int{capColumns: 80, capLines: 24, capMaxColors: 256},
+		strs: map[int]string{
+			capClear: "\x1b[H\x1b[2J",
+			capCup:   "\x1b[%i%p1%d;%p2%dH",
+			capBold:  "\x1b[1m",
+			capSgr0:  "\x1b(B\x1b[m",
+			capKcuu1: "\x1bOA",
+			capKf1:   "\x1bOP",
+			capSetaf: "\x1b[%?%p1%{8}%<%t3%p1%d%e%p1%{16}%<%t9%p1%{8}%-%d%e38;5;%p1%d%;m",
+			capSetab: "\x1b[%?%p1%{8}%<%t4%p1%d%e%p1%{16}%<%t10%p1%{8}%-%d%e48;5;%p1%d%;m",
+		},
+	}
+}
+
+// compileTerminfo encodes src in the format of term(5) with the given
+// magic number.
+func compileTerminfo(src tiSource, magic int) []byte {
+	numSize := 2
+	if magic == magicExtended {
+		numSize = 4
+	}
+	var out bytes.Buffer
+	short := func(v int) {
+		binary.Write(&out, binary.LittleEndian, int16(v))
+	}
+	number := func(v int) {
+		if numSize == 4 {
+			binary.Write(&out, binary.LittleEndian, int32(v))
+		} else {
+			short(v)
+		}
+	}
+	bools := func(n int, set func(i int) bool) {
+		for i := 0; i < n; i++ {
+			if set(i) {
+				out.WriteByte(1)
+			} else {
+				out.WriteByte(0)
+			}
+		}
+	}
+
+	names := src.names + "\x00"
+	boolCount, numCount, strCount := 0, 0, 0
+	for i := range src.bools {
+		if i >= boolCount {
+			boolCount = i + 1
+		}
+	}
+	for i := range src.nums {
+		if i >= numCount {
+			numCount = i + 1
+		}
+	}
+	for i := range src.strs {
+		if i >= strCount {
+			strCount = i + 1
+		}
+	}
+	var table []byte
+	offsets := make([]int, strCount)
+	for i := range offsets {
+		s, ok := src.strs[i]
+		if !ok {
+			offsets[i] = -1
+			continue
+		}
+		offsets[i] = len(table)
+		table = append(append(table, s...), 0)
+	}
+
+	for _, v := range []int{magic, len(names), boolCount, numCount, strCount, len(table)} {
+		short(v)
+	}
+	out.WriteString(names)
+	bools(boolCount, func(i int) bool { return src.bools[i] })
+	if (len(names)+boolCount)%2 == 1 {
+		out.WriteByte(0)
+	}
+	for i := 0; i < numCount; i++ {
+		if v, ok := src.nums[i]; ok {
+			number(v)
+		} else {
+			number(-1)
+		}
+	}
+	for _, off := range offsets {
+		short(off)
+	}
+	out.Write(table)
+
+	if len(src.extBools) == 0 && len(src.extNums) == 0 && len(src.extStrs) == 0 {
+		return out.Bytes()
+	}
+	if len(table)%2 == 1 {
+		out.WriteByte(0)
+	}
+	var numNames, strNames []string
+	for name := range src.extNums {
+		numNames = append(numNames, name)
+	}
+	for name := range src.extStrs {
+		strNames = append(strNames, name)
+	}
+	sort.Strings(numNames)
+	sort.Strings(strNames)
+	allNames := append(append(append([]string(nil), src.extBools...), numNames...), strNames...)
+
+	var values, nameTable []byte
+	valueOffsets := make([]int, len(strNames))
+	for i, name := range strNames {
+		valueOffsets[i] = len(values)
+		values = append(append(values, src.extStrs[name]...), 0)
+	}
+	nameOffsets := make([]int, len(allNames))
+	for i, name := range allNames {
+		nameOffsets[i] = len(nameTable)
+		nameTable = append(append(nameTable, name...), 0)
+	}
+
+	for _, v := range []int{len(src.extBools), len(numNames), len(strNames),
+		len(strNames) + len(allNames), len(values) + len(nameTable)} {
+		short(v)
+	}
+	bools(len(src.extBools), func(int) bool { return true })
+	if len(src.extBools)%2 == 1 {
+		out.WriteByte(0)
+	}
+	for _, name := range numNames {
+		number(src.extNums[name])
+	}
+	for _, off := range valueOffsets {
+		short(off)
+	}
+	for _, off := range nameOffsets {
+		short(off)
+	}
+	out.Write(values)
+	out.Write(nameTable)
+	return out.Bytes()
+}
+
+// TestParseFixture parses xterm-256color as compiled by ncurses, which
+// should agree with tcell's built-in description of it.
+func TestParseFixture(t *testing.T) {
+	e, err := readTerminfo(filepath.Join("testdata", "terminfo", "x", "xterm-256color"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := terminfo.LookupTerminfo("xterm-256color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, w := reflect.ValueOf(e.ti).Elem(), reflect.ValueOf(want).Elem()
+	for i := 0; i < g.NumField(); i++ {
+		name := g.Type().Field(i).Name
+		if name == "Mouse" {
+			// Newer entries give the SGR mouse prefix; tcell's is
+			// older.  Both mean the terminal has a mouse.
+			continue
+		}
+		if gv, wv := g.Field(i).Interface(), w.Field(i).Interface(); !reflect.DeepEqual(gv, wv) {
+			t.Errorf("%s is %q, tcell has %q", name, gv, wv)
+		}
+	}
+}
+
+// TestParseDirectFixture parses ncurses' xterm-direct, whose colors need
+// the 32 bit numbers of the newer format, and whose RGB capability is in
+// the extended section.
+func TestParseDirectFixture(t *testing.T) {
+	e, err := readTerminfo(filepath.Join("testdata", "terminfo", "x", "xterm-direct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := e.ti
+	if ti.Colors != 8 {
+		t.Errorf("%d colors, want 8", ti.Colors)
+	}
+	if want := "\x1b[38;2;%p1%d;%p2%d;%p3%dm"; ti.SetFgRGB != want {
+		t.Errorf("SetFgRGB is %q, want %q", ti.SetFgRGB, want)
+	}
+	if ti.SetFgBgRGB == "" {
+		t.Error("no SetFgBgRGB")
+	}
+}
+
+func TestParseTerminfo(t *testing.T) {
+	ext := func(src tiSource) tiSource {
+		src.extBools = []string{"AX", "XT"}
+		src.extNums = map[string]int{"U8": 1}
+		src.extStrs = map[string]string{
+			"Smulx":  "\x1b[4:%p1%dm",
+			"Setulc": "\x1b[58:2::%p1%{65536}%/%d:%p1%{256}%/%{255}%&%d:%p1%{255}%&%dm",
+			"Smol":   "\x1b[53m",
+			"smxx":   "\x1b[9m",
+			"kUP5":   "\x1b[1;5A",
+		}
+		return src
+	}
+	tests := []struct {
+		name  string
+		src   tiSource
+		magic int
+		alias string
+		caps  styleCaps
+	}{
+		{"16 bit", xtermish("mudtest|mt|Test terminal"), magicLegacy, "mt", styleCaps{}},
+		{"32 bit", xtermish("mudtest|mt|Test terminal"), magicExtended, "mt", styleCaps{}},
+		// With an even length of names plus booleans, there's no
+		// padding before the numbers.
+		{"unpadded", xtermish("mudtest|mtt|Test terminal"), magicLegacy, "mtt", styleCaps{}},
+		{"16 bit extended", ext(xtermish("mudtest|mt|Test terminal")), magicLegacy, "mt", ecmaStyleCaps},
+		{"32 bit extended", ext(xtermish("mudtest|mt|Test terminal")), magicExtended, "mt", ecmaStyleCaps},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := parseTerminfo(compileTerminfo(tt.src, tt.magic))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.caps != tt.caps {
+				t.Errorf("style capabilities %+v, want %+v", e.caps, tt.caps)
+			}
+			ti := e.ti
+			if ti.Name != "mudtest" || len(ti.Aliases) != 1 || ti.Aliases[0] != tt.alias {
+				t.Errorf("names %q, %q", ti.Name, ti.Aliases)
+			}
+			if ti.Columns != 80 || ti.Lines != 24 || ti.Colors != 256 {
+				t.Errorf("%d by %d with %d colors", ti.Columns, ti.Lines, ti.Colors)
+			}
+			if ti.SetCursor != tt.src.strs[capCup] || ti.Bold != "\x1b[1m" || ti.KeyUp != "\x1bOA" || ti.KeyF1 != "\x1bOP" {
+				t.Errorf("wrong strings: %+v", ti)
+			}
+			if ti.KeyHome != "" || ti.Italic != "" {
+				t.Errorf("capabilities that aren't there: %q, %q", ti.KeyHome, ti.Italic)
+			}
+			if ti.SetFgBg == "" || ti.PadChar != "\x00" {
+				t.Errorf("not fixed up: %+v", ti)
+			}
+		})
+	}
+}
+
+func TestParseTerminfoNumbers(t *testing.T) {
+	// Without RGB to say how, more than 256 colors are no use to us.
+	src := xtermish("direct|32 bit colors")
+	src.nums[capMaxColors] = 1 << 24
+	e, err := parseTerminfo(compileTerminfo(src, magicExtended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti := e.ti; ti.Colors != 256 || ti.SetFgRGB != "" {
+		t.Errorf("%d colors, RGB %q, want 256 and none", ti.Colors, ti.SetFgRGB)
+	}
+
+	// Numbers that aren't there are -1, which for colors means none.
+	src = xtermish("mono|No colors")
+	delete(src.nums, capMaxColors)
+	src.nums[capMaxColors+1] = 8 // so colors is there, as -1
+	for _, magic := range []int{magicLegacy, magicExtended} {
+		e, err = parseTerminfo(compileTerminfo(src, magic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti := e.ti; ti.Colors != 0 || ti.Columns != 80 || ti.Lines != 24 {
+			t.Errorf("magic %o: %d by %d with %d colors", magic, ti.Columns, ti.Lines, ti.Colors)
+		}
+	}
+
+	src = xtermish("nopad|No pad character")
+	src.bools = map[int]bool{capNoPadChar: true}
+	if e, err = parseTerminfo(compileTerminfo(src, magicLegacy)); err != nil {
+		t.Fatal(err)
+	} else if e.ti.PadChar != "" {
+		t.Errorf("pad character %q despite npc", e.ti.PadChar)
+	}
+}
+
+func TestParseTerminfoTrueColor(t *testing.T) {
+	const (
+		xtermFgRGB   = "\x1b[38;2;%p1%d;%p2%d;%p3%dm"
+		xtermBgRGB   = "\x1b[48;2;%p1%d;%p2%d;%p3%dm"
+		xtermFgBgRGB = "\x1b[38;2;%p1%d;%p2%d;%p3%d;48;2;%p4%d;%p5%d;%p6%dm"
+		// from ncurses' xterm-direct
+		directSetaf = "\x1b[%?%p1%{8}%<%t3%p1%d%e38:2::%p1%{65536}%/%d:%p1%{256}%/%{255}%&%d:%p1%{255}%&%d%;m"
+		directSetab = "\x1b[%?%p1%{8}%<%t4%p1%d%e48:2::%p1%{65536}%/%d:%p1%{256}%/%{255}%&%d:%p1%{255}%&%d%;m"
+	)
+	tests := []struct {
+		name                     string
+		colors                   int
+		setaf, setab             string
+		bools                    []string
+		strs                     map[string]string
+		wantColors               int
+		wantFg, wantBg, wantFgBg string
+	}{
+		{name: "none", colors: 256, wantColors: 256},
+		{
+			name: "Tc", colors: 256, bools: []string{"Tc"},
+			wantColors: 256, wantFg: xtermFgRGB, wantBg: xtermBgRGB, wantFgBg: xtermFgBgRGB,
+		},
+		{
+			// Direct color setaf is no use for the palette beyond
+			// the first eight.  Legacy entries can't say 1<<24, and
+			// give the largest 16 bit number instead.
+			name: "RGB direct", colors: 0x7fff, setaf: directSetaf, setab: directSetab,
+			bools:      []string{"RGB"},
+			wantColors: 8, wantFg: xtermFgRGB, wantBg: xtermBgRGB, wantFgBg: xtermFgBgRGB,
+		},
+		{
+			name: "RGB with its own sequences", colors: 256, bools: []string{"AX", "RGB"},
+			strs: map[string]string{
+				"setrgbf": "\x1b[38:2::%p1%d:%p2%d:%p3%dm",
+				"setrgbb": "\x1b[48:2::%p1%d:%p2%d:%p3%dm",
+				"kUP5":    "\x1b[1;5A",
+			},
+			wantColors: 256,
+			wantFg:     "\x1b[38:2::%p1%d:%p2%d:%p3%dm",
+			wantBg:     "\x1b[48:2::%p1%d:%p2%d:%p3%dm",
+			wantFgBg:   "\x1b[38:2::%p1%d:%p2%d:%p3%d;48:2::%p4%d:%p5%d:%p6%dm",
+		},
+		{
+			// Sequences without RGB to say they work are still
+			// taken as given.
+			name: "setrgbf alone", colors: 256,
+			strs: map[string]string{
+				"setrgbf": "\x1b[38;2;%p1%d;%p2%d;%p3%dm",
+				"setrgbb": "\x1b[48;2;%p1%d;%p2%d;%p3%dm",
+			},
+			wantColors: 256, wantFg: xtermFgRGB, wantBg: xtermBgRGB, wantFgBg: xtermFgBgRGB,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := xtermish("truecolor|24 bit colors")
+			src.nums[capMaxColors] = tt.colors
+			if tt.setaf != "" {
+				src.strs[capSetaf], src.strs[capSetab] = tt.setaf, tt.setab
+			}
+			src.extBools, src.extStrs = tt.bools, tt.strs
+			src.extNums = map[string]int{"U8": 1}
+			for _, magic := range []int{magicLegacy, magicExtended} {
+				e, err := parseTerminfo(compileTerminfo(src, magic))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ti := e.ti
+				if ti.Colors != tt.wantColors {
+					t.Errorf("magic %o: %d colors, want %d", magic, ti.Colors, tt.wantColors)
+				}
+				if ti.SetFgRGB != tt.wantFg || ti.SetBgRGB != tt.wantBg || ti.SetFgBgRGB != tt.wantFgBg {
+					t.Errorf("magic %o: RGB %q, %q, %q, want %q, %q, %q", magic,
+						ti.SetFgRGB, ti.SetBgRGB, ti.SetFgBgRGB, tt.wantFg, tt.wantBg, tt.wantFgBg)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTerminfoErrors(t *testing.T) {
+	good := compileTerminfo(xtermish("mudtest|Test terminal"), magicLegacy)
+	if _, err := parseTerminfo(good); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(good); n++ {
+		if _, err := parseTerminfo(good[:n]); err == nil {
+			t.Errorf("truncated to %d bytes of %d, parsed", n, len(good))
+		}
+	}
+
+	corrupt := func(at int, v int16) []byte {
+		b := append([]byte(nil), good...)
+		binary.LittleEndian.PutUint16(b[at:], uint16(v))
+		return b
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"bad magic", corrupt(0, 0x1234)},
+		{"byte swapped magic", corrupt(0, int16(magicLegacy>>8|magicLegacy&0xff<<8))},
+		{"negative names", corrupt(2, -1)},
+		{"negative bools", corrupt(4, -2)},
+		{"negative numbers", corrupt(6, -3)},
+		{"negative strings", corrupt(8, -4)},
+		{"negative table", corrupt(10, -5)},
+		{"long names", corrupt(2, 0x7fff)},
+		{"long table", corrupt(10, 0x7fff)},
+		{"text", []byte("xterm|xterm terminal emulator,\n\tam, bce,\n")},
+	}
+	for _, tt := range tests {
+		if _, err := parseTerminfo(tt.b); err == nil {
+			t.Errorf("%s: parsed", tt.name)
+		}
+	}
+
+	// An entry that can't address the cursor is no use to us.
+	src := xtermish("dumb|No cursor addressing")
+	delete(src.strs, capCup)
+	if _, err := parseTerminfo(compileTerminfo(src, magicLegacy)); err != errNotAddressable {
+		t.Errorf("without cup: %v, want %v", err, errNotAddressable)
+	}
+}
+
+func TestParseTerminfoBadOffsets(t *testing.T) {
+	// String offsets past the table are taken as missing strings.
+	src := xtermish("mudtest|Test terminal")
+	b := compileTerminfo(src, magicLegacy)
+	namesLen := len(src.names) + 1
+	numCount := capMaxColors + 1
+	strs := 12 + namesLen + namesLen%2 + numCount*2
+	binary.LittleEndian.PutUint16(b[strs+capBold*2:], 0x7fff)
+	e, err := parseTerminfo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ti.Bold != "" {
+		t.Errorf("bold %q from past the table", e.ti.Bold)
+	}
+}
+
+func FuzzParseTerminfo(f *testing.F) {
+	src := xtermish("mudtest|mt|Test terminal")
+	f.Add(compileTerminfo(src, magicLegacy))
+	src.extBools = []string{"AX"}
+	src.extStrs = map[string]string{"Smulx": "\x1b[4:%p1%dm"}
+	f.Add(compileTerminfo(src, magicExtended))
+	if b, err := os.ReadFile(filepath.Join("testdata", "terminfo", "x", "xterm-256color")); err == nil {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		e, err := parseTerminfo(b)
+		if err == nil && e.ti.SetCursor == "" {
+			t.Fatal("parsed an entry without cup")
+		}
+	})
+}
+
+// terminfoDB writes entries to a new terminfo database directory, in
+// subdirectories named by their first letters.
+func terminfoDB(t *testing.T, entries map[string][]byte) string {
+	dir := t.TempDir()
+	for name, b := range entries {
+		path := filepath.Join(dir, name[:1], name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFindTerminfo(t *testing.T) {
+	entry := func(name, cup string) []byte {
+		src := xtermish(name + "|Test terminal")
+		src.strs[capCup] = cup
+		return compileTerminfo(src, magicLegacy)
+	}
+	first := terminfoDB(t, map[string][]byte{
+		"mudtest": entry("mudtest", "first"),
+		"broken":  []byte("not terminfo"),
+	})
+	second := terminfoDB(t, map[string][]byte{
+		"mudtest": entry("mudtest", "second"),
+		"other":   entry("other", "other"),
+		"broken":  entry("broken", "broken"),
+	})
+	// macOS puts entries under the hex code of their first letter.
+	mac := filepath.Join(second, "6d", "mactest")
+	os.MkdirAll(filepath.Dir(mac), 0o755)
+	os.WriteFile(mac, entry("mactest", "mac"), 0o644)
+	dirs := []string{first, second}
+
+	ansi, _ := terminfo.LookupTerminfo("ansi")
+	xterm, _ := terminfo.LookupTerminfo("xterm")
+	tests := []struct {
+		term, defaultTerm string
+		want              string // cup of the entry found
+	}{
+		{"mudtest", "", "first"},
+		{"other", "", "other"},
+		{"mactest", "", "mac"},
+		{"xterm", "other", xterm.SetCursor},
+		{"mudtest-256color", "", "first"},
+		{"other-kitty-direct", "", "other"},
+		{"nonesuch", "other", "other"},
+		{"nonesuch", "nonesuch-either", ansi.SetCursor},
+		{"nonesuch", "", ansi.SetCursor},
+		{"", "other", "other"},
+		{"", "", ansi.SetCursor},
+		// A corrupt entry isn't looked past for a good one, but
+		// falls back like a missing one.
+		{"broken", "other", "other"},
+		{"../../etc/passwd", "", ansi.SetCursor},
+		{".hidden", "", ansi.SetCursor},
+	}
+	for _, tt := range tests {
+		e, err := findTerminfo(tt.term, Options{DefaultTerm: tt.defaultTerm, TerminfoDirs: dirs})
+		if err != nil {
+			t.Errorf("%q, default %q: %v", tt.term, tt.defaultTerm, err)
+			continue
+		}
+		ti := e.ti
+		if ti.SetCursor != tt.want {
+			t.Errorf("%q, default %q: found %s (%q), want cup %q", tt.term, tt.defaultTerm, ti.Name, ti.SetCursor, tt.want)
+		}
+	}
+
+	// What's returned is a copy, so the caller can set its size.
+	e, _ := findTerminfo("mudtest", Options{TerminfoDirs: dirs})
+	e.ti.Columns = 132
+	if e, _ = findTerminfo("mudtest", Options{TerminfoDirs: dirs}); e.ti.Columns != 80 {
+		t.Error("changed the cached entry")
+	}
+}
+
+func TestFindTerminfoStyleCaps(t *testing.T) {
+	entry := func(name string) []byte {
+		src := xtermish(name + "|Test terminal")
+		src.strs[capCup] = "database"
+		src.extStrs = map[string]string{"Smulx": "\x1b[4:%p1%dm", "smxx": "\x1b[9m"}
+		return compileTerminfo(src, magicLegacy)
+	}
+	dirs := []string{terminfoDB(t, map[string][]byte{
+		"mudtest": entry("mudtest"),
+		"xterm":   entry("xterm"),
+	})}
+	want := styleCaps{strikeThrough: "\x1b[9m", underlineStyle: "\x1b[4:%p1%dm"}
+
+	// tcell's own terminals take their style capabilities from the
+	// database, and everything else from tcell.
+	xterm, _ := terminfo.LookupTerminfo("xterm")
+	for _, term := range []string{"mudtest", "xterm"} {
+		e, err := findTerminfo(term, Options{TerminfoDirs: dirs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.caps != want {
+			t.Errorf("%s: style capabilities %+v, want %+v", term, e.caps, want)
+		}
+		if term == "xterm" && e.ti.SetCursor != xterm.SetCursor {
+			t.Errorf("xterm's cup %q from the database", e.ti.SetCursor)
+		}
+	}
+	if e, _ := findTerminfo("ansi", Options{TerminfoDirs: dirs}); e.caps != (styleCaps{}) {
+		t.Errorf("ansi: style capabilities %+v", e.caps)
+	}
+}
+
+func TestTerminfoDirs(t *testing.T) {
+	got := terminfoDirs("/home/mud/.terminfo", "/opt/a"+string(filepath.ListSeparator)+string(filepath.ListSeparator)+"/opt/b")
+	want := []string{"/home/mud/.terminfo", "/opt/a", "/opt/b",
+		"/etc/terminfo", "/lib/terminfo", "/usr/share/terminfo", "/usr/lib/terminfo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := terminfoDirs("", ""); !reflect.DeepEqual(got, want[3:]) {
+		t.Errorf("without the environment, got %q", got)
+	}
+}
+
+// TestNewScreenUnknownTerm checks clients get a screen whatever they say
+// their terminal is, including nothing.
+func TestNewScreenUnknownTerm(t *testing.T) {
+	for _, term := range []string{"", "nonesuch", "xterm-nonesuch"} {
+		s, err := NewScreen(newRecordConn(t), term, 80, 24, Options{TerminfoDirs: []string{}})
+		if err != nil {
+			t.Errorf("%q: %v", term, err)
+			continue
+		}
+		if err := s.Init(); err != nil {
+			t.Errorf("%q: %v", term, err)
+			continue
+		}
+		s.Fini()
+	}
+}
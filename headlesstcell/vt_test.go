@@ -0,0 +1,435 @@
+package headlesstcell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell"
+	"github.com/mattn/go-runewidth"
+)
+
+// vt is a model of a terminal, enough of one to check what a screen sends
+// it: it keeps the characters on the screen, their colors and attributes,
+// and where the cursor is.  It understands the sequences of xterm, screen
+// and ansi that a screen draws with, and complains about any others.
+type vt struct {
+	w, h    int
+	cells   [][]vtCell
+	x, y    int
+	style   vtStyle
+	last    rune // the last character written, for REP
+	pending bool // the last column was written; the next character wraps
+
+	// top and bottom are the scrolling region: rows top up to bottom.
+	top, bottom int
+
+	// wrapNow makes the terminal wrap as soon as the last column is
+	// written, as those without xenl do, rather than waiting to see
+	// whether anything follows.  Screens shouldn't rely on either.
+	wrapNow bool
+
+	seq []byte // an unfinished escape sequence or character
+	err error  // the first sequence it didn't understand
+}
+
+// vtStyle is how a cell looks.  Colors are palette indexes, 1<<24 plus
+// the value for RGB, or -1 for the default.
+type vtStyle struct {
+	fg, bg int
+	attrs  tcell.AttrMask
+}
+
+// vtAttrs are the attributes the model keeps.
+const vtAttrs = tcell.AttrBold | tcell.AttrUnderline | tcell.AttrReverse
+
+type vtCell struct {
+	r     rune // 0 for the right half of a wide character
+	style vtStyle
+}
+
+var vtDefault = vtStyle{fg: -1, bg: -1}
+
+func newVT(w, h int) *vt {
+	v := &vt{w: w, h: h, style: vtDefault, bottom: h}
+	v.cells = make([][]vtCell, h)
+	for y := range v.cells {
+		v.cells[y] = make([]vtCell, w)
+		v.erase(y, 0, w)
+	}
+	return v
+}
+
+// Write feeds the terminal what a screen sent.
+func (v *vt) Write(b []byte) (int, error) {
+	for _, c := range b {
+		v.feed(c)
+	}
+	return len(b), nil
+}
+
+func (v *vt) fail(format string, args ...interface{}) {
+	if v.err == nil {
+		v.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (v *vt) feed(c byte) {
+	if len(v.seq) > 0 {
+		v.seq = append(v.seq, c)
+		switch s := v.seq; {
+		case s[0] != 0x1b:
+			if utf8.FullRune(s) {
+				r, _ := utf8.DecodeRune(s)
+				v.seq = v.seq[:0]
+				v.put(r)
+			}
+		case len(s) == 2 && s[1] != '[' && s[1] != ']' && (s[1] < 0x20 || s[1] > 0x2f):
+			v.seq = v.seq[:0]
+			v.esc(s[1])
+		case s[1] == '[' && len(s) > 2 && c >= 0x40 && c <= 0x7e:
+			v.seq = v.seq[:0]
+			v.csi(string(s[2:len(s)-1]), c)
+		case s[1] == ']' && (c == 0x07 || c == '\\' && s[len(s)-2] == 0x1b):
+			v.seq = v.seq[:0]
+		case s[1] >= 0x20 && s[1] <= 0x2f && len(s) == 3:
+			// character set designations
+			v.seq = v.seq[:0]
+		}
+		return
+	}
+	switch {
+	case c == 0x1b || c >= 0x80:
+		v.seq = append(v.seq, c)
+	case c == '\r':
+		v.x, v.pending = 0, false
+	case c == '\n':
+		v.lineFeed()
+	case c == '\b':
+		if v.x > 0 {
+			v.x--
+		}
+		v.pending = false
+	case c == 0 || c == 0x07 || c == 0x0e || c == 0x0f:
+		// padding, bell, and shifting to and from the ACS
+	case c < 0x20 || c == 0x7f:
+		v.fail("control character %#x", c)
+	default:
+		v.put(rune(c))
+	}
+}
+
+func (v *vt) lineFeed() {
+	if v.y == v.bottom-1 {
+		v.scroll(v.top, v.bottom, 1)
+	} else if v.y < v.h-1 {
+		v.y++
+	}
+	v.pending = false
+}
+
+func (v *vt) reverseIndex() {
+	if v.y == v.top {
+		v.scrollDown(v.top, v.bottom, 1)
+	} else if v.y > 0 {
+		v.y--
+	}
+	v.pending = false
+}
+
+// scroll moves rows top to bottom up n, blanking those at the bottom.
+func (v *vt) scroll(top, bottom, n int) {
+	for i := 0; i < n && i < bottom-top; i++ {
+		row := v.cells[top]
+		copy(v.cells[top:bottom-1], v.cells[top+1:bottom])
+		v.cells[bottom-1] = row
+		v.erase(bottom-1, 0, v.w)
+	}
+}
+
+// scrollDown moves rows top to bottom down n, blanking those at the top.
+func (v *vt) scrollDown(top, bottom, n int) {
+	for i := 0; i < n && i < bottom-top; i++ {
+		row := v.cells[bottom-1]
+		copy(v.cells[top+1:bottom], v.cells[top:bottom-1])
+		v.cells[top] = row
+		v.erase(top, 0, v.w)
+	}
+}
+
+// erase blanks row y from column from up to column to, in the current
+// background.
+func (v *vt) erase(y, from, to int) {
+	for x := from; x < to; x++ {
+		v.cells[y][x] = vtCell{' ', vtStyle{fg: -1, bg: v.style.bg}}
+	}
+}
+
+// put writes r at the cursor.
+func (v *vt) put(r rune) {
+	width := runewidth.RuneWidth(r)
+	if width == 0 {
+		v.fail("combining character %q", r)
+		return
+	}
+	if v.pending || width == 2 && v.x == v.w-1 {
+		v.x = 0
+		v.lineFeed()
+	}
+	v.unsplit(v.x)
+	v.cells[v.y][v.x] = vtCell{r, v.style}
+	if width == 2 {
+		v.unsplit(v.x + 1)
+		v.cells[v.y][v.x+1] = vtCell{0, v.style}
+	}
+	v.last = r
+	v.x += width
+	if v.x >= v.w {
+		if v.wrapNow {
+			v.x = 0
+			if v.y < v.h-1 {
+				v.y++
+			}
+		} else {
+			v.x, v.pending = v.w-1, true
+		}
+	}
+}
+
+// unsplit blanks the other half of any wide character at column x of the
+// cursor's row, which is about to be written over.
+func (v *vt) unsplit(x int) {
+	row := v.cells[v.y]
+	if row[x].r == 0 && x > 0 {
+		row[x-1].r = ' '
+	}
+	if x+1 < v.w && row[x+1].r == 0 {
+		row[x+1].r = ' '
+	}
+}
+
+func (v *vt) esc(c byte) {
+	switch c {
+	case 'D':
+		v.lineFeed()
+	case 'M':
+		v.reverseIndex()
+	case '=', '>':
+		// keypad modes
+	default:
+		v.fail("unknown sequence ESC %c", c)
+	}
+}
+
+func (v *vt) csi(params string, final byte) {
+	if strings.HasPrefix(params, "?") {
+		if final != 'h' && final != 'l' {
+			v.fail("unknown private sequence %q%c", params, final)
+		}
+		return
+	}
+	args := strings.Split(params, ";")
+	arg := func(i, def int) int {
+		if i >= len(args) || args[i] == "" {
+			return def
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil {
+			v.fail("bad parameter in %q%c", params, final)
+		}
+		if n == 0 && def == 1 {
+			return 1
+		}
+		return n
+	}
+	clamp := func(n, max int) int {
+		if n < 0 {
+			return 0
+		}
+		if n > max {
+			return max
+		}
+		return n
+	}
+	switch final {
+	case 'H', 'f':
+		v.y, v.x = clamp(arg(0, 1)-1, v.h-1), clamp(arg(1, 1)-1, v.w-1)
+	case 'A':
+		v.y = clamp(v.y-arg(0, 1), v.h-1)
+	case 'B':
+		v.y = clamp(v.y+arg(0, 1), v.h-1)
+	case 'C':
+		v.x = clamp(v.x+arg(0, 1), v.w-1)
+	case 'D':
+		v.x = clamp(v.x-arg(0, 1), v.w-1)
+	case 'K':
+		if arg(0, 0) != 0 {
+			v.fail("EL %q", params)
+		}
+		v.erase(v.y, v.x, v.w)
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			v.erase(v.y, v.x, v.w)
+			for y := v.y + 1; y < v.h; y++ {
+				v.erase(y, 0, v.w)
+			}
+		case 2:
+			for y := 0; y < v.h; y++ {
+				v.erase(y, 0, v.w)
+			}
+		default:
+			v.fail("ED %q", params)
+		}
+	case 'r':
+		v.top, v.bottom = clamp(arg(0, 1)-1, v.h-1), clamp(arg(1, v.h), v.h)
+		if v.bottom-v.top < 2 {
+			v.fail("region %q", params)
+			v.top, v.bottom = 0, v.h
+		}
+		v.x, v.y = 0, 0
+	case 'S':
+		v.scroll(v.top, v.bottom, arg(0, 1))
+	case 'T':
+		v.scrollDown(v.top, v.bottom, arg(0, 1))
+	case 'L', 'M':
+		// Lines are inserted and deleted in the region, from the
+		// cursor's row, if it's in it.
+		if v.y < v.top || v.y >= v.bottom {
+			break
+		}
+		if final == 'L' {
+			v.scrollDown(v.y, v.bottom, arg(0, 1))
+		} else {
+			v.scroll(v.y, v.bottom, arg(0, 1))
+		}
+		v.x = 0
+	case 'b':
+		for n := arg(0, 1); n > 0; n-- {
+			v.put(v.last)
+		}
+	case 'm':
+		v.sgr(args)
+	case 'h', 'l', 't':
+		// modes, and window operations like saving the title
+	default:
+		v.fail("unknown sequence CSI %q%c", params, final)
+	}
+	v.pending = false
+}
+
+func (v *vt) sgr(args []string) {
+	// color reads a 38, 48 or 58 color, from its subparameters or the
+	// parameters after it.
+	color := func(sub []string, i *int) int {
+		colon := len(sub) > 1
+		p := args[*i+1:]
+		if colon {
+			p = sub[1:]
+			if len(p) == 5 && p[0] == "2" {
+				// 38:2::r:g:b has an empty color space
+				p = []string{p[0], p[2], p[3], p[4]}
+			}
+		}
+		n := func(j int) int {
+			if j >= len(p) {
+				v.fail("short color in SGR %q", args)
+				return 0
+			}
+			c, _ := strconv.Atoi(p[j])
+			return c
+		}
+		switch n(0) {
+		case 5:
+			if !colon {
+				*i += 2
+			}
+			return n(1)
+		case 2:
+			if !colon {
+				*i += 4
+			}
+			return 1<<24 | n(1)<<16 | n(2)<<8 | n(3)
+		}
+		v.fail("bad color in SGR %q", args)
+		return -1
+	}
+	for i := 0; i < len(args); i++ {
+		sub := strings.Split(args[i], ":")
+		n, _ := strconv.Atoi(sub[0])
+		s := &v.style
+		switch {
+		case n == 0:
+			*s = vtDefault
+		case n == 1:
+			s.attrs |= tcell.AttrBold
+		case n == 4:
+			if len(sub) > 1 && sub[1] == "0" {
+				s.attrs &^= tcell.AttrUnderline
+			} else {
+				s.attrs |= tcell.AttrUnderline
+			}
+		case n == 7:
+			s.attrs |= tcell.AttrReverse
+		case n == 22:
+			s.attrs &^= tcell.AttrBold
+		case n == 24:
+			s.attrs &^= tcell.AttrUnderline
+		case n == 27:
+			s.attrs &^= tcell.AttrReverse
+		case n >= 30 && n <= 37:
+			s.fg = n - 30
+		case n == 38:
+			s.fg = color(sub, &i)
+		case n == 39:
+			s.fg = -1
+		case n >= 40 && n <= 47:
+			s.bg = n - 40
+		case n == 48:
+			s.bg = color(sub, &i)
+		case n == 49:
+			s.bg = -1
+		case n == 58:
+			color(sub, &i)
+		case n >= 90 && n <= 97:
+			s.fg = n - 90 + 8
+		case n >= 100 && n <= 107:
+			s.bg = n - 100 + 8
+		case n == 2 || n == 3 || n == 5 || n == 9 || n == 10 || n == 11 || n == 21 ||
+			n == 23 || n == 25 || n == 29 || n == 53 || n == 55 || n == 59:
+			// attributes the model doesn't keep, and fonts
+		default:
+			v.fail("unknown SGR %q", args)
+		}
+	}
+}
+
+// vtColor returns how the model writes c.
+func vtColor(c tcell.Color) int {
+	switch {
+	case c == tcell.ColorDefault:
+		return -1
+	case c&tcell.ColorIsRGB != 0:
+		return 1<<24 | int(c&0xffffff)
+	}
+	return int(c)
+}
+
+// looksLike reports whether the cell looks like one with r in style.
+// Only the background, and attributes that show on a blank, matter for
+// spaces.
+func (c vtCell) looksLike(r rune, style tcell.Style) bool {
+	fg, bg, attrs := style.Decompose()
+	want := vtStyle{vtColor(fg), vtColor(bg), attrs & vtAttrs}
+	got := c.style
+	if r == ' ' {
+		visible := tcell.AttrUnderline | tcell.AttrReverse
+		if want.attrs&tcell.AttrReverse == 0 {
+			want.fg, got.fg = 0, 0
+		}
+		want.attrs &= visible
+		got.attrs &= visible
+	}
+	return c.r == r && got == want
+}
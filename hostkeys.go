@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const rsaHostKeyBits = 3072
+
+// generateHostKey makes a new private key for one of the host key
+// algorithms: "ed25519", "ecdsa" or "rsa".
+func generateHostKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, rsaHostKeyBits)
+	}
+	return nil, fmt.Errorf("unknown host key algorithm %q", algorithm)
+}
+
+// loadHostKey reads the host key for algorithm from dir, generating and
+// saving one first if there isn't one.
+func loadHostKey(dir, algorithm string) (ssh.Signer, error) {
+	path := filepath.Join(dir, "ssh_host_"+algorithm+"_key")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := generateHostKey(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated %s host key %s", algorithm, path)
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return signer, nil
+}
+
+// loadHostKeys loads (or generates) a host key for each algorithm, adds
+// them to config and logs their fingerprints.
+func loadHostKeys(config *ssh.ServerConfig, dir string, algorithms []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, algorithm := range algorithms {
+		signer, err := loadHostKey(dir, algorithm)
+		if err != nil {
+			return err
+		}
+		config.AddHostKey(signer)
+		log.Printf("Host key %s %s", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	return nil
+}
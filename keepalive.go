@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepalive pings the client every keepalive interval until done is
+// closed, and closes the connection if too many pings in a row go
+// unanswered.  Any reply counts, even a failure.
+func (srv *server) keepalive(sconn *ssh.ServerConn, done <-chan struct{}) {
+	interval := srv.cfg.Network.KeepaliveInterval
+	if interval <= 0 {
+		return
+	}
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := sconn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= srv.cfg.Network.KeepaliveMissed {
+				log.Printf("%s missed %d keepalives, disconnecting", sconn.RemoteAddr(), missed)
+				sconn.Close()
+				return
+			}
+		}
+	}
+}
+
+// idleCheckInterval is how often sessions are checked for idleness.
+const idleCheckInterval = 10 * time.Second
+
+// reapIdle warns and then disconnects players who haven't sent any input
+// for the idle timeout, until the server shuts down.  Staff are exempt.
+func (srv *server) reapIdle() {
+	timeout := srv.cfg.Network.IdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	warnAt := timeout - srv.cfg.Network.IdleWarning
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.stopping:
+			return
+		case <-ticker.C:
+		}
+		srv.sessions.Each(func(sess *session) {
+			if sess.account.isStaff() {
+				return
+			}
+			idle := time.Since(sess.LastInput())
+			if idle >= timeout {
+				log.Printf("%q idle for %s, disconnecting", sess.account.Name, idle.Truncate(time.Second))
+				sess.notify("You have been idle too long. Goodbye!")
+				// give the goodbye a moment to be drawn
+				time.AfterFunc(time.Second, sess.close)
+			} else if idle >= warnAt && sess.warnIdle() {
+				sess.notify(fmt.Sprintf("You will be disconnected in %s unless you do something.",
+					(timeout - idle).Round(time.Second)))
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rateLimiter is a set of token buckets keyed by string (usually an IP).
+// Each bucket holds up to burst tokens and gains one every interval.
+type rateLimiter struct {
+	burst     float64
+	interval  time.Duration
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(burst int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		burst:     float64(burst),
+		interval:  interval,
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// refill returns key's bucket topped up to now.  The caller must hold
+// the lock.
+func (l *rateLimiter) refill(key string, now time.Time) *bucket {
+	if now.Sub(l.lastPrune) > l.interval*time.Duration(l.burst) {
+		// Forget buckets that have refilled completely.
+		for k, b := range l.buckets {
+			if b.tokens+float64(now.Sub(b.last))/float64(l.interval) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	return b
+}
+
+// Allow takes a token from key's bucket, returning false if it was empty.
+func (l *rateLimiter) Allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	b := l.refill(key, time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Blocked reports whether key's bucket is empty, without taking a token.
+func (l *rateLimiter) Blocked(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.refill(key, time.Now()).tokens < 1
+}
+
+// remoteIP returns the IP address of addr, or nil.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+var errThrottled = errors.New("too many failed logins; try again later")
+
+// throttleAuth wraps config's password and keyboard-interactive callbacks
+// so every failure costs the client's IP a token from srv.authFailures,
+// and IPs with none left are refused without their password being
+// checked.  Public key failures are free, since clients routinely offer
+// several keys.
+func (srv *server) throttleAuth(config *ssh.ServerConfig) {
+	blocked := func(c ssh.ConnMetadata) bool {
+		if srv.authFailures.Blocked(remoteIP(c.RemoteAddr()).String()) {
+			log.Printf("Refusing login for %q from %s: too many failures", c.User(), c.RemoteAddr())
+			return true
+		}
+		return false
+	}
+	failed := func(c ssh.ConnMetadata) {
+		srv.authFailures.Allow(remoteIP(c.RemoteAddr()).String())
+	}
+
+	if cb := config.PasswordCallback; cb != nil {
+		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if blocked(c) {
+				return nil, errThrottled
+			}
+			perms, err := cb(c, pass)
+			if err != nil {
+				failed(c)
+			}
+			return perms, err
+		}
+	}
+	if cb := config.KeyboardInteractiveCallback; cb != nil {
+		config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if blocked(c) {
+				client(c.User(), "Too many failed logins from your address; try again later.", nil, nil)
+				return nil, errThrottled
+			}
+			perms, err := cb(c, client)
+			if err != nil {
+				failed(c)
+			}
+			return perms, err
+		}
+	}
+}
+
+// admit decides whether to accept a new connection, returning an error
+// saying why not.  Every nil return must be matched by a call to release.
+func (srv *server) admit(conn net.Conn) error {
+	ip := remoteIP(conn.RemoteAddr())
+	if ban := srv.bans.Find(ip); ban != nil {
+		return fmt.Errorf("banned (%s)", ban.CIDR)
+	}
+	if !srv.connRate.Allow(ip.String()) {
+		return errors.New("connecting too often")
+	}
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.active >= srv.cfg.Network.MaxSessions {
+		return errors.New("server is full")
+	}
+	srv.active++
+	return nil
+}
+
+func (srv *server) release() {
+	srv.Lock()
+	srv.active--
+	srv.Unlock()
+}
+
+// activeConns returns the number of connections admitted.
+func (srv *server) activeConns() int {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.active
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("token %d of the burst refused", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("allowed past the burst")
+	}
+	if !l.Blocked("a") {
+		t.Error("empty bucket not blocked")
+	}
+	if l.Blocked("b") || !l.Allow("b") {
+		t.Error("one key's bucket emptied another's")
+	}
+
+	// Wind a's clock back as if two and a half intervals had passed.
+	rewind := func(key string, d time.Duration) {
+		l.Lock()
+		l.buckets[key].last = l.buckets[key].last.Add(-d)
+		l.Unlock()
+	}
+	rewind("a", 5*time.Minute/2)
+	for i := 0; i < 2; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("refilled token %d refused", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("allowed more than refilled")
+	}
+	// Half a token is left over; half an interval more makes it whole.
+	rewind("a", time.Minute/2)
+	if !l.Allow("a") {
+		t.Fatal("leftover part of a token lost")
+	}
+
+	// However long a bucket waits, it holds no more than the burst.
+	rewind("a", time.Hour)
+	for i := 0; i < 3; i++ {
+		l.Allow("a")
+	}
+	if l.Allow("a") {
+		t.Error("bucket refilled past the burst")
+	}
+}
+
+func TestRateLimiterPrunes(t *testing.T) {
+	l := newRateLimiter(2, time.Second)
+	l.Allow("full")
+	l.Allow("full")
+	l.Allow("empty")
+	l.Allow("empty")
+
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now().Add(10 * time.Second)
+	l.buckets["empty"].last = now
+	l.buckets["empty"].tokens = 0
+	l.refill("new", now)
+	if _, ok := l.buckets["full"]; ok {
+		t.Error("refilled bucket kept")
+	}
+	if _, ok := l.buckets["empty"]; !ok {
+		t.Error("empty bucket forgotten")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}, "192.0.2.1"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "<nil>"},
+	}
+	for _, tt := range tests {
+		if got := remoteIP(tt.addr).String(); got != tt.want {
+			t.Errorf("remoteIP(%v) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxLineLength is the longest line of input accepted in line mode.
+const maxLineLength = 1024
+
+// textConn is the output of a session without a screen: plain text, with
+// writes from the game and from notices kept whole.
+type textConn struct {
+	w    io.Writer
+	crlf bool // the client has a pty, so newlines need carriage returns
+	sync.Mutex
+}
+
+func (t *textConn) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	b := p
+	if t.crlf {
+		b = bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1)
+	}
+	if _, err := t.w.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// runLineMode is the game for clients without a pty: it reads commands a
+// line at a time from r and writes their output to sess.text, until the
+// client hangs up or the session is closed.
+func runLineMode(sess *session, r io.Reader) {
+	fmt.Fprintf(sess.text, "Welcome, %s. Type help for a list of commands, or quit to leave.\n",
+		sess.account.Name)
+
+	lines := make(chan string)
+	go func() {
+		defer sess.close()
+		br := bufio.NewReaderSize(r, maxLineLength)
+		for {
+			line, err := br.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				// Skip the rest of the line.
+				for err == bufio.ErrBufferFull {
+					_, err = br.ReadSlice('\n')
+				}
+				fmt.Fprintln(sess.text, "Line too long.")
+				if err != nil {
+					return
+				}
+				continue
+			} else if err != nil {
+				return
+			}
+			select {
+			case lines <- string(bytes.TrimRight(line, "\r\n")):
+			case <-sess.done:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-sess.done:
+			return
+		case line := <-lines:
+			sess.touch()
+			runCommand(sess, line, sess.text)
+		}
+	}
+}
+
+// Exit statuses of exec requests.
+const (
+	exitOK       = 0
+	exitFailed   = 1
+	exitUsage    = 2
+	exitNotFound = 127
+)
+
+// exitStatus returns the exit status for the error from runCommand.
+func exitStatus(err error) uint32 {
+	switch err {
+	case nil:
+		return exitOK
+	case errUsage:
+		return exitUsage
+	case errUnknownCommand:
+		return exitNotFound
+	}
+	return exitFailed
+}
+
+// runExec runs the command line of an exec request, writing its output
+// to the channel and then sending its exit status.
+func runExec(sess *session, line string, channel ssh.Channel) {
+	err := runCommand(sess, line, sess.text)
+	status := struct{ Status uint32 }{exitStatus(err)}
+	channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loginAttempts is how many names a plain-text client can try.
+const loginAttempts = 3
+
+// prompter is a connection we log in by asking questions in plain text,
+// like telnet or the browser client.
+type prompter interface {
+	io.Writer
+	// readLine reads a line of input, keeping it off the screen if hide
+	// is set.
+	readLine(hide bool) (string, error)
+}
+
+// challenge returns a keyboard-interactive challenge that asks its
+// questions on p.
+func challenge(p prompter) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" {
+			fmt.Fprintf(p, "%s\r\n", instruction)
+		}
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			fmt.Fprint(p, q)
+			answer, err := p.readLine(!echos[i])
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+}
+
+// promptMetadata lets plain-text logins use the SSH auth callbacks.
+type promptMetadata struct {
+	user    string
+	conn    net.Conn
+	version string // the transport, in place of a client version
+}
+
+func (m *promptMetadata) User() string          { return m.user }
+func (m *promptMetadata) SessionID() []byte     { return nil }
+func (m *promptMetadata) ClientVersion() []byte { return []byte(m.version) }
+func (m *promptMetadata) ServerVersion() []byte { return []byte(m.version) }
+func (m *promptMetadata) RemoteAddr() net.Addr  { return m.conn.RemoteAddr() }
+func (m *promptMetadata) LocalAddr() net.Addr   { return m.conn.LocalAddr() }
+
+// promptLogin asks for an account name on p and logs it in with the same
+// keyboard-interactive callback SSH uses, so plain-text players get the
+// same throttling and can sign up the same way.  conn is the underlying
+// connection and transport names it, for the callbacks.
+func (srv *server) promptLogin(p prompter, conn net.Conn, transport string) (*Account, string, error) {
+	for i := 0; i < loginAttempts; i++ {
+		fmt.Fprint(p, "Login: ")
+		name, err := p.readLine(false)
+		if err != nil {
+			return nil, "", err
+		}
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		meta := &promptMetadata{name, conn, transport}
+		perms, err := srv.sshConfig.KeyboardInteractiveCallback(meta, challenge(p))
+		if err == errThrottled {
+			return nil, "", err
+		} else if err != nil {
+			fmt.Fprint(p, "Login incorrect.\r\n")
+			continue
+		}
+		acct, err := srv.accounts.LookupID(perms.Extensions[accountIDExtension])
+		if err != nil {
+			return nil, "", err
+		}
+		return acct, perms.Extensions[authMethodExtension], nil
+	}
+	return nil, "", errors.New("too many failed logins")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// telnetOptMCCP2 is the MUD Client Compression Protocol, version 2: once
+// the client agrees, everything we send is a zlib stream.
+const telnetOptMCCP2 = 86
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// write sends b to the client, compressing it if MCCP2 is on.  The
+// caller must hold wmu.
+func (t *telnetConn) write(b []byte) error {
+	t.sent += int64(len(b))
+	if t.zw == nil {
+		_, err := t.wire.Write(b)
+		return err
+	}
+	if _, err := t.zw.Write(b); err != nil {
+		return err
+	}
+	// Flush every write; players are waiting on it.
+	return t.zw.Flush()
+}
+
+// startCompression announces that the stream is compressed from here
+// on, and starts compressing.
+func (t *telnetConn) startCompression() error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.zw != nil {
+		return nil
+	}
+	if err := t.write([]byte{telnetIAC, telnetSB, telnetOptMCCP2, telnetIAC, telnetSE}); err != nil {
+		return err
+	}
+	t.zw = zlib.NewWriter(&t.wire)
+	return nil
+}
+
+// endCompression finishes the zlib stream, so the client can go back to
+// reading plain telnet.
+func (t *telnetConn) endCompression() error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.zw == nil {
+		return nil
+	}
+	err := t.zw.Close()
+	t.zw = nil
+	return err
+}
+
+// compressionStats returns how many bytes we've sent the client, and how
+// many that came to on the wire.
+func (t *telnetConn) compressionStats() (sent, wire int64) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	return t.sent, t.wire.n
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const mccpStart = "\xff\xfa\x56\xff\xf0"
+
+// newMCCPTelnet returns a telnet connection offering MCCP2 to a client
+// that sends input.
+func newMCCPTelnet(t *testing.T, input string) (*telnetConn, *pipeConn) {
+	c := &pipeConn{in: strings.NewReader(input)}
+	tc := newTelnetConn(c, true)
+	if err := tc.negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(tc)
+	return tc, c
+}
+
+// inflate splits what was sent at the start of compression, and
+// decompresses what follows up to the end of the zlib stream.  It
+// returns what came before the stream, what was in it, and what came
+// after.
+func inflate(t *testing.T, sent []byte) (before, stream, after []byte) {
+	i := bytes.Index(sent, []byte(mccpStart))
+	if i < 0 {
+		t.Fatalf("compression never started: %q", sent)
+	}
+	r := bytes.NewReader(sent[i+len(mccpStart):])
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err = io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("stream didn't end cleanly: %v", err)
+	}
+	after, _ = io.ReadAll(r)
+	return sent[:i], stream, after
+}
+
+func TestMCCP(t *testing.T) {
+	tc, c := newMCCPTelnet(t, "\xff\xfd\x56")
+	if !bytes.Contains(c.out.Bytes(), []byte("\xff\xfb\x56")) {
+		t.Fatalf("didn't offer MCCP2: %q", c.out.Bytes())
+	}
+	text := strings.Repeat("You see a box.\r\n", 100) + "\xff"
+	tc.Write([]byte(text))
+	tc.subnegotiate(telnetOptNAWS, nil)
+	if err := tc.endCompression(); err != nil {
+		t.Fatal(err)
+	}
+	tc.Write([]byte("plain"))
+
+	_, stream, after := inflate(t, c.out.Bytes())
+	if want := strings.Replace(text, "\xff", "\xff\xff", 1) + "\xff\xfa\x1f\xff\xf0"; string(stream) != want {
+		t.Errorf("inflated to %q, want %q", stream, want)
+	}
+	if string(after) != "plain" {
+		t.Errorf("sent %q after the stream, want %q", after, "plain")
+	}
+
+	sent, wire := tc.compressionStats()
+	if wire != int64(c.out.Len()) {
+		t.Errorf("counted %d bytes on the wire, want %d", wire, c.out.Len())
+	}
+	if sent <= wire {
+		t.Errorf("%d bytes sent as %d", sent, wire)
+	}
+}
+
+func TestMCCPRefused(t *testing.T) {
+	// The client agrees, then changes its mind: the stream ends before
+	// we say we've stopped.
+	tc, c := newMCCPTelnet(t, "\xff\xfd\x56\xff\xfe\x56")
+	tc.Write([]byte("after"))
+	_, stream, after := inflate(t, c.out.Bytes())
+	if len(stream) != 0 {
+		t.Errorf("compressed %q", stream)
+	}
+	if want := "\xff\xfc\x56after"; string(after) != want {
+		t.Errorf("sent %q after the stream, want %q", after, want)
+	}
+}
+
+func TestMCCPNotOffered(t *testing.T) {
+	tc, c := newTestTelnet("\xff\xfd\x56")
+	if err := tc.negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(tc)
+	if out := c.out.String(); strings.Contains(out, "\xff\xfb\x56") || !strings.HasSuffix(out, "\xff\xfc\x56") {
+		t.Errorf("sent %q", out)
+	}
+	if tc.optionEnabled(telnetOptMCCP2) {
+		t.Error("compressing")
+	}
+}
+
+func TestStatusCompression(t *testing.T) {
+	srv := newServer(DefaultConfig(), nil, nil, &ssh.ServerConfig{})
+	sess := testSession(t, srv, "player", "192.0.2.1")
+	var out strings.Builder
+	cmdStatus(sess, nil, &out)
+	if strings.Contains(out.String(), "Compressing") {
+		t.Errorf("reported compression over SSH:\n%s", out.String())
+	}
+
+	sess.telnet, _ = newMCCPTelnet(t, "\xff\xfd\x56")
+	sess.telnet.Write([]byte(strings.Repeat("x", 1000)))
+	out.Reset()
+	cmdStatus(sess, nil, &out)
+	sent, wire := sess.telnet.compressionStats()
+	want := fmt.Sprintf("Compressing your output: %d bytes have gone out as %d (", sent, wire)
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("didn't report compression:\n%s", out.String())
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gdamore/tcell"
@@ -17,52 +23,135 @@ import (
 )
 
 func main() {
+	cfg, args, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
+
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("Failed to open log file: ", err)
+		}
+		log.SetOutput(f)
+	}
+	logRect = cfg.Render.LogPane.Rectangle()
+	frameInterval = cfg.Render.FrameInterval
+
 	tcell.SetEncodingFallback(tcell.EncodingFallbackASCII)
 
+	if err := os.MkdirAll(cfg.World.DataDir, 0700); err != nil {
+		log.Fatal("Failed to create data directory: ", err)
+	}
+
+	accounts, err := NewFileAccountStore(cfg.Path(cfg.World.Accounts),
+		cfg.Auth.MaxFailures, cfg.Auth.Lockout)
+	if err != nil {
+		log.Fatal("Failed to load accounts: ", err)
+	}
+
+	if len(args) == 2 && args[0] == "adduser" {
+		addUser(accounts, args[1])
+		return
+	}
+	if len(args) >= 2 && args[0] == "roles" {
+		setRoles(accounts, args[1], args[2:])
+		return
+	}
+
 	config := &ssh.ServerConfig{
 		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in
-			// a production setting.
-			fmt.Println(c.User(), string(pass))
-			return nil, nil
-			// return nil, fmt.Errorf("password rejected for %q", c.User())
+			acct, err := accounts.Authenticate(c.User(), pass)
+			if err != nil {
+				log.Printf("Password auth for %q from %s failed: %v", c.User(), c.RemoteAddr(), err)
+				return nil, fmt.Errorf("password rejected for %q", c.User())
+			}
+			return accountPermissions(acct, authPassword), nil
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			acct, err := accounts.AuthenticateKey(c.User(), key)
+			if err != nil {
+				return nil, fmt.Errorf("key rejected for %q", c.User())
+			}
+			return accountPermissions(acct, authPublicKey), nil
 		},
+		KeyboardInteractiveCallback: keyboardInteractiveCallback(accounts),
 	}
 
-	privateBytes, err := ioutil.ReadFile("id_rsa")
-	if err != nil {
-		log.Fatal("Failed to load private key: ", err)
+	if err := loadHostKeys(config, cfg.World.DataDir, cfg.Auth.HostKeys); err != nil {
+		log.Fatal("Failed to load host keys: ", err)
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	listener, err := listen(cfg, cfg.Network.Listen)
 	if err != nil {
-		log.Fatal("Failed to parse private key: ", err)
+		log.Fatal("failed to listen for connection: ", err)
 	}
 
-	config.AddHostKey(private)
-
-	listener, err := net.Listen("tcp", "0.0.0.0:2022")
+	bans, err := loadBans(cfg.Path(cfg.World.Bans))
 	if err != nil {
-		log.Fatal("failed to listen for connection: ", err)
+		log.Fatal("Failed to load bans: ", err)
 	}
-	for {
-		nConn, err := listener.Accept()
+
+	srv := newServer(cfg, accounts, bans, config)
+	if cfg.Network.TelnetListen != "" {
+		tl, err := listen(cfg, cfg.Network.TelnetListen)
 		if err != nil {
-			log.Printf("Failed to accept incoming connection: %v", err)
-			continue
+			log.Fatal("failed to listen for telnet: ", err)
+		}
+		go srv.ServeTelnet(tl)
+	}
+	if cfg.Network.WebListen != "" {
+		wl, err := listen(cfg, cfg.Network.WebListen)
+		if err != nil {
+			log.Fatal("failed to listen for the browser client: ", err)
 		}
-		go handleSSHConnection(nConn, config)
+		go srv.ServeWeb(wl)
 	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		srv.Shutdown(signals)
+		close(stopped)
+	}()
+	srv.Serve(listener)
+	<-stopped
+	log.Printf("Shutdown complete")
 }
 
-func handleSSHConnection(conn net.Conn, config *ssh.ServerConfig) {
-	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+func (srv *server) handleSSHConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(srv.cfg.Network.HandshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, srv.sshConfig)
 	if err != nil {
 		log.Printf("Failed to handshake: %v", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if !srv.addConn(sconn) {
+		sconn.Close()
+		return
+	}
+	defer srv.removeConn(sconn)
+	acct, err := srv.accounts.LookupID(sconn.Permissions.Extensions[accountIDExtension])
+	if err != nil {
+		log.Printf("Failed to find account for %q: %v", sconn.User(), err)
+		sconn.Close()
 		return
 	}
+	authMethod := sconn.Permissions.Extensions[authMethodExtension]
+	log.Printf("%q (account %s) connected from %s with %s", acct.Name,
+		acct.ID, sconn.RemoteAddr(), authMethod)
 	go ssh.DiscardRequests(reqs)
 
+	done := make(chan struct{})
+	defer close(done)
+	go srv.keepalive(sconn, done)
+
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -71,89 +160,271 @@ func handleSSHConnection(conn net.Conn, config *ssh.ServerConfig) {
 
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Fatalf("Could not accept channel: %v", err)
-		}
-
-		var term tcell.Screen
-
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				fmt.Println(req.Type)
-				switch req.Type {
-				case "shell":
-					req.Reply(true, nil)
-				case "pty-req":
-					fmt.Println(string(req.Payload))
-					termLen := req.Payload[3]
-					termName := string(req.Payload[4 : termLen+4])
-					cols := binary.BigEndian.Uint32(req.Payload[termLen+4 : termLen+8])
-					lines := binary.BigEndian.Uint32(req.Payload[termLen+8 : termLen+12])
-					term, err = headlesstcell.NewScreen(channel,
-						termName, int(cols), int(lines))
-					if err := term.Init(); err != nil {
-						req.Reply(false, nil)
-					} else {
-						req.Reply(true, nil)
-						go func() {
-							defer channel.Close()
-							run(term)
-						}()
-					}
-				case "window-change":
-					if wr, ok := term.(interface{ Winch(w, h int) }); ok {
-						cols := binary.BigEndian.Uint32(req.Payload[0:4])
-						lines := binary.BigEndian.Uint32(req.Payload[4:8])
-						wr.Winch(int(cols), int(lines))
-					}
+			log.Printf("Could not accept channel: %v", err)
+			continue
+		}
+
+		go srv.handleChannel(sconn, acct, authMethod, channel, requests)
+	}
+}
+
+// handleChannel serves the requests on one session channel.  A shell
+// request starts the game, full screen if the client asked for a pty and
+// in line mode if not; an exec request runs one command.
+func (srv *server) handleChannel(sconn *ssh.ServerConn, acct *Account, authMethod string,
+	channel ssh.Channel, requests <-chan *ssh.Request) {
+	var pty *ptyRequest
+	var modes headlesstcell.TermModes
+	var term tcell.Screen
+	var sess *session
+	env := make(map[string]string)
+
+	for req := range requests {
+		var err error
+		var start func()
+		switch req.Type {
+		case "pty-req":
+			if pty != nil || sess != nil {
+				err = errors.New("pty already requested")
+				break
+			}
+			pty, modes, err = parsePtyRequest(req.Payload)
+		case "shell":
+			if err = parseShell(req.Payload); err != nil {
+				break
+			}
+			if sess != nil {
+				err = errors.New("session already started")
+				break
+			}
+			if pty != nil {
+				cols := clampSize(pty.Columns, defaultColumns)
+				lines := clampSize(pty.Rows, defaultRows)
+				color := colortermColor(env)
+				term, err = srv.newScreen(channel, pty.Term, cols, lines, headlesstcell.Options{
+					Modes:     modes,
+					Charset:   localeCharset(env),
+					TrueColor: screenColor(acct.Color, color),
+				})
+				if err != nil {
+					break
+				}
+				sess = newSession(srv, acct, authMethod, sconn.RemoteAddr(),
+					pty.Term, cols, lines, term)
+				sess.color = color
+			} else {
+				sess = newSession(srv, acct, authMethod, sconn.RemoteAddr(), "", 0, 0, nil)
+				sess.text = &textConn{w: channel}
+			}
+			if !srv.startSession(sess) {
+				err = errors.New("server is shutting down")
+				break
+			}
+			if term != nil {
+				if err = term.Init(); err != nil {
+					srv.endSession(sess)
+					break
 				}
 			}
-		}(requests)
+			start = func() {
+				srv.playSession(sess, channel, func() {
+					channel.Close()
+					sconn.Close()
+				})
+			}
+		case "exec":
+			var ex *execRequest
+			if ex, err = parseExec(req.Payload); err != nil {
+				break
+			}
+			if sess != nil {
+				err = errors.New("session already started")
+				break
+			}
+			termName := ""
+			if pty != nil {
+				termName = pty.Term
+			}
+			sess = newSession(srv, acct, authMethod, sconn.RemoteAddr(), termName, 0, 0, nil)
+			sess.text = &textConn{w: channel, crlf: pty != nil}
+			log.Printf("%q ran %q", acct.Name, ex.Command)
+			start = func() {
+				runExec(sess, ex.Command, channel)
+				channel.Close()
+			}
+		case "window-change":
+			var wc *windowChangeRequest
+			if wc, err = parseWindowChange(req.Payload); err != nil {
+				break
+			}
+			if wr, ok := term.(interface{ Winch(w, h int) }); ok {
+				cols := clampSize(wc.Columns, defaultColumns)
+				lines := clampSize(wc.Rows, defaultRows)
+				wr.Winch(cols, lines)
+				sess.setSize(cols, lines)
+			} else if pty != nil {
+				pty.Columns, pty.Rows = wc.Columns, wc.Rows
+			}
+		case "env":
+			var ev *envRequest
+			if ev, err = parseEnv(req.Payload); err != nil {
+				break
+			}
+			if _, ok := env[ev.Name]; !acceptEnv(ev.Name) || (!ok && len(env) >= maxEnv) {
+				err = fmt.Errorf("env %s not accepted", ev.Name)
+				break
+			}
+			env[ev.Name] = ev.Value
+		default:
+			err = fmt.Errorf("unsupported request %q", req.Type)
+		}
+		if err != nil {
+			log.Printf("Rejected %s request from %s: %v", req.Type, sconn.RemoteAddr(), err)
+		}
+		if req.WantReply {
+			req.Reply(err == nil, nil)
+		}
+		if start != nil {
+			go start()
+		}
+	}
+}
+
+// addUser creates an account, reading its password from stdin.
+func addUser(accounts AccountStore, name string) {
+	if err := validAccountName(name); err != nil {
+		log.Fatal("Bad account name: ", err)
+	}
+	fmt.Printf("Password for %s: ", name)
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatal("Failed to read password: ", err)
+	}
+	if _, err := accounts.Create(name, strings.TrimRight(pass, "\r\n")); err != nil {
+		log.Fatal("Failed to create account: ", err)
 	}
+	fmt.Printf("Created account %s\n", name)
 }
 
-var logRect = image.Rect(5, 5, 50, 20)
+// setRoles replaces an account's roles.
+func setRoles(accounts AccountStore, name string, roles []string) {
+	acct, err := accounts.Lookup(name)
+	if err != nil {
+		log.Fatal("Failed to find account: ", err)
+	}
+	if err := accounts.SetRoles(acct.ID, roles); err != nil {
+		log.Fatal("Failed to set roles: ", err)
+	}
+	fmt.Printf("%s now has roles %v\n", acct.Name, roles)
+}
 
-func run(s tcell.Screen) {
-	s.SetStyle(tcell.StyleDefault.
-		Foreground(tcell.ColorBlack).
-		Background(tcell.ColorWhite))
+var (
+	logRect       = image.Rect(5, 5, 50, 20)
+	frameInterval = 50 * time.Millisecond
+)
+
+// screenStyle is the style screens are cleared to.
+var screenStyle = tcell.StyleDefault.
+	Foreground(tcell.ColorBlack).
+	Background(tcell.ColorWhite)
+
+func run(sess *session, l *link) {
+	s := l.screen
+	s.SetStyle(screenStyle)
 	s.Clear()
+	logLine(s, fmt.Sprintf("Welcome, %s. Type help for a list of commands.", sess.account.Name))
+	if other := sess.playingElsewhere(); other != nil {
+		logLine(s, fmt.Sprintf("You're also playing from %s; type takeover to move that game here.",
+			other.RemoteAddr()))
+	}
 
-	quit := make(chan struct{})
-	go func() {
-		for {
-			ev := s.PollEvent()
+	var input []rune
+	out := &logWriter{s: s}
+	drawPrompt(s, input)
+
+	var linkDead <-chan time.Time // while the player is gone
+	nextFrame := time.After(frameInterval)
+	cnt := 0
+	dur := time.Duration(0)
+loop:
+	for {
+		select {
+		case <-sess.done:
+			break loop
+		case <-linkDead:
+			log.Printf("%q was link-dead too long", sess.account.Name)
+			break loop
+		case nl := <-sess.attach:
+			// The player is back, or has taken the game over from
+			// another connection.
+			nl.screen.SetStyle(screenStyle)
+			nl.screen.Clear()
+			copyScreen(nl.screen, s)
+			l.fini()
+			l, s = nl, nl.screen
+			out.s = s
+			sess.setLink(l)
+			linkDead = nil
+			logLine(s, fmt.Sprintf("Welcome back, %s.", sess.account.Name))
+			drawPrompt(s, input)
+			s.Sync()
+		case ev := <-l.events:
 			switch ev := ev.(type) {
+			case *headlesstcell.EventHangup:
+				grace := sess.srv.cfg.Network.LinkDeadGrace
+				if grace <= 0 {
+					break loop
+				}
+				log.Printf("%q went link-dead", sess.account.Name)
+				sess.goLinkDead()
+				l.detach()
+				linkDead = time.After(grace)
+			case *tcell.EventInterrupt:
+				if msg, ok := ev.Data().(string); ok {
+					logLine(s, msg)
+					s.Show()
+				}
 			case *tcell.EventKey:
+				sess.touch()
 				switch ev.Key() {
-				case tcell.KeyEscape, tcell.KeyEnter:
-					close(quit)
-					return
+				case tcell.KeyEscape:
+					break loop
+				case tcell.KeyEnter:
+					line := string(input)
+					input = input[:0]
+					if line != "" {
+						logLine(s, "> "+line)
+						runCommand(sess, line, out)
+					}
+				case tcell.KeyBackspace, tcell.KeyBackspace2:
+					if len(input) > 0 {
+						input = input[:len(input)-1]
+					}
+				case tcell.KeyRune:
+					input = append(input, ev.Rune())
 				case tcell.KeyCtrlL:
 					s.Sync()
 				}
+				drawPrompt(s, input)
+				s.Show()
 			case *tcell.EventResize:
+				sess.setSize(s.Size())
+				drawPrompt(s, input)
 				s.Sync()
 			}
+		case <-nextFrame:
+			start := time.Now()
+			makebox(s)
+			cnt++
+			dur += time.Now().Sub(start)
+			nextFrame = time.After(frameInterval)
 		}
-	}()
-
-	cnt := 0
-	dur := time.Duration(0)
-loop:
-	for {
-		select {
-		case <-quit:
-			break loop
-		case <-time.After(time.Millisecond * 50):
-		}
-		start := time.Now()
-		makebox(s)
-		cnt++
-		dur += time.Now().Sub(start)
 	}
 
-	s.Fini()
+	sess.close()
+	if to := sess.handoffTarget(); to == nil || !to.attachLink(l) {
+		l.fini()
+	}
 	fmt.Printf("Finished %d boxes in %s\n", cnt, dur)
 	fmt.Printf("Average is %0.3f ms / box\n", (float64(dur)/float64(cnt))/1000000.0)
 }
@@ -161,9 +432,10 @@ loop:
 func makebox(s tcell.Screen) {
 	w, h := s.Size()
 
-	if w == 0 || h == 0 {
+	if w == 0 || h <= 1 {
 		return
 	}
+	h-- // the bottom row is the command line
 
 	glyphs := []rune{'@', '#', '&', '*', '%', 'Z', 'A', ' '}
 
@@ -173,11 +445,21 @@ func makebox(s tcell.Screen) {
 	lh := rand.Int() % (h - ly)
 	st := tcell.StyleDefault
 	gl := ' '
-	if s.Colors() > 1 {
+	if s.Colors() > 256 {
+		st = st.Background(tcell.NewRGBColor(rand.Int31n(256), rand.Int31n(256), rand.Int31n(256)))
+	} else if s.Colors() > 1 {
 		st = st.Background(tcell.Color(rand.Int() % s.Colors()))
 	} else {
 		st = st.Reverse(rand.Int()%2 == 0)
 	}
+	switch rand.Int() % 4 {
+	case 1:
+		st = st.Italic(true)
+	case 2:
+		st = headlesstcell.StrikeThrough(st, true)
+	case 3:
+		st = headlesstcell.Underline(st, headlesstcell.UnderlineStyle(rand.Int()%4))
+	}
 	gl = glyphs[rand.Int()%len(glyphs)]
 
 	for row := 0; row < lh; row++ {
@@ -190,6 +472,70 @@ func makebox(s tcell.Screen) {
 	s.Show()
 }
 
+// logLine scrolls the log pane up and writes line at the bottom of it,
+// wrapping if it's too wide.
 func logLine(s tcell.Screen, line string) {
+	sr, ok := s.(headlesstcell.RegionScroller)
+	if !ok {
+		return
+	}
+	w := logRect.Dx()
+	runes := []rune(line)
+	for {
+		n := len(runes)
+		if n > w {
+			n = w
+		}
+		sr.ScrollRegion(logRect.Min.X, logRect.Min.Y, w, logRect.Dy(), 1)
+		for x := 0; x < w; x++ {
+			r := ' '
+			if x < n {
+				r = runes[x]
+			}
+			s.SetContent(logRect.Min.X+x, logRect.Max.Y-1, r, nil, tcell.StyleDefault)
+		}
+		runes = runes[n:]
+		if len(runes) == 0 {
+			break
+		}
+	}
+}
+
+// logWriter is an io.Writer that sends each line written to the log pane.
+type logWriter struct {
+	s   tcell.Screen
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		logLine(w.s, string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
 
+// drawPrompt draws the command line along the bottom of the screen.
+func drawPrompt(s tcell.Screen, input []rune) {
+	w, h := s.Size()
+	if w == 0 || h == 0 {
+		return
+	}
+	line := append([]rune("> "), input...)
+	if len(line) >= w {
+		line = line[len(line)-w+1:]
+	}
+	for x := 0; x < w; x++ {
+		r := ' '
+		if x < len(line) {
+			r = line[x]
+		}
+		s.SetContent(x, h-1, r, nil, tcell.StyleDefault)
+	}
+	s.ShowCursor(len(line), h-1)
 }
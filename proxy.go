@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The PROXY protocol lets a load balancer tell us who its connections
+// are really from, in a header it sends before anything else.  See
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+// proxyV2Signature starts a version 2 (binary) header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1Max    = 107 // longest version 1 header, with its CRLF
+	proxyV2Header = 16  // signature, version and command, family, length
+
+	proxyV2Local = 0x20 // the balancer's own connection, like a health check
+	proxyV2Proxy = 0x21
+
+	proxyV2INET  = 0x1
+	proxyV2INET6 = 0x2
+)
+
+// parseTrusted parses the list of upstreams trusted to send PROXY
+// headers, each a CIDR range or single address.  Empty entries are
+// skipped.
+func parseTrusted(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ipnet, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// listen listens for TCP on addr, reading PROXY headers from the
+// configured trusted upstreams.
+func listen(cfg *Config, addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parseTrusted(cfg.Network.ProxyProtocol)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if len(trusted) == 0 {
+		return l, nil
+	}
+	return newProxyListener(l, trusted, cfg.Network.HandshakeTimeout), nil
+}
+
+// proxyListener is a listener whose connections from trusted upstreams
+// start with a PROXY header, and report the addresses in it.  Others are
+// passed through untouched.  Headers are read in the background, so a
+// slow upstream doesn't hold up Accept.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration // for reading a header
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{} // closed by Close
+	once  sync.Once
+}
+
+func newProxyListener(l net.Listener, trusted []*net.IPNet, timeout time.Duration) *proxyListener {
+	pl := &proxyListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.run()
+	return pl
+}
+
+func (l *proxyListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		if !l.trusts(c.RemoteAddr()) {
+			l.deliver(c)
+			continue
+		}
+		go func() {
+			pc, err := readProxyHeader(c, l.timeout)
+			if err != nil {
+				log.Printf("Bad PROXY header from %s: %v", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+			l.deliver(pc)
+		}()
+	}
+}
+
+// deliver hands c to Accept, or closes it if the listener has closed.
+func (l *proxyListener) deliver(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *proxyListener) trusts(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection with the addresses from its PROXY header.
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader // holds whatever followed the header
+	remote, local net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// readProxyHeader reads the PROXY header that starts c, returning a
+// connection reporting the addresses in it.  Headers that don't give
+// addresses, from health checks and the like, leave c's own.
+func readProxyHeader(c net.Conn, timeout time.Duration) (net.Conn, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(c)
+	remote, local, err := parseProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+	pc := &proxyConn{Conn: c, r: r, remote: c.RemoteAddr(), local: c.LocalAddr()}
+	if remote != nil {
+		pc.remote, pc.local = remote, local
+	}
+	return pc, nil
+}
+
+// parseProxyHeader reads a version 1 or 2 PROXY header from r, returning
+// the client and server addresses, or nils if it doesn't give any.
+func parseProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return parseProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return parseProxyV1(r)
+	}
+	return nil, nil, errors.New("no PROXY header")
+}
+
+// parseProxyV1 reads a text header, like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 2022\r\n".
+func parseProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == proxyV1Max {
+			return nil, nil, errors.New("version 1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("version 1 header doesn't end in CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("bad version 1 header %q", line)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("bad address %q in version 1 header", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (port != "0" && port[0] == '0') {
+		return nil, fmt.Errorf("bad port %q in version 1 header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseProxyV2 reads a binary header.
+func parseProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	hdr := make([]byte, proxyV2Header)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported version and command %#x", hdr[12])
+	}
+	// The low nybble of the family is the transport; addresses are
+	// the same whether it's a stream or not.
+	switch hdr[13] >> 4 {
+	case proxyV2INET:
+		if len(body) < 12 {
+			return nil, nil, errors.New("truncated IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case proxyV2INET6:
+		if len(body) < 36 {
+			return nil, nil, errors.New("truncated IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+	// Unix sockets and unspecified families have no addresses we can use.
+	return nil, nil, nil
+}
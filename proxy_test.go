@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 returns a version 2 header with the given version and command,
+// family, and body.
+func proxyV2(cmd, family byte, body string) string {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return string(hdr) + body
+}
+
+const (
+	// 192.0.2.1:56324 to 198.51.100.1:2022
+	v2INET = "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x07\xe6"
+	// [2001:db8::1]:56324 to [2001:db8::2]:2022
+	v2INET6 = "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\xdc\x04\x07\xe6"
+	// PP2_TYPE_AUTHORITY and PP2_TYPE_NOOP
+	v2TLVs = "\x02\x00\x0bexample.com\x04\x00\x02\x00\x00"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		remote, local string // empty for none
+		err           string // in the error; empty for none
+	}{
+		{
+			name:   "v1 TCP4",
+			in:     "PROXY TCP4 192.0.2.1 198.51.100.1 56324 2022\r\n",
+			remote: "192.0.2.1:56324", local: "198.51.100.1:2022",
+		},
+		{
+			name:   "v1 TCP6",
+			in:     "PROXY TCP6 2001:db8::1 2001:db8::2 56324 2022\r\n",
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:2022",
+		},
+		{name: "v1 UNKNOWN", in: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", in: "PROXY UNKNOWN 2001:db8::1 2001:db8::2 56324 2022\r\n"},
+		{
+			name: "v1 longest",
+			in: "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff " +
+				"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			remote: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+			local:  "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+		},
+		{name: "v1 too long", in: "PROXY UNKNOWN" + strings.Repeat(" ", 100) + "\r\n", err: "too long"},
+		{name: "v1 LF", in: "PROXY UNKNOWN\n", err: "CRLF"},
+		{name: "v1 truncated", in: "PROXY TCP4 192.0.2.1 198.51", err: "EOF"},
+		{name: "v1 TCP4 with IPv6", in: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 2022\r\n", err: "bad address"},
+		{name: "v1 TCP6 with IPv4", in: "PROXY TCP6 192.0.2.1 2001:db8::2 56324 2022\r\n", err: "bad address"},
+		{name: "v1 port too big", in: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 2022\r\n", err: "bad port"},
+		{name: "v1 leading zero", in: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 02022\r\n", err: "bad port"},
+		{name: "v1 missing port", in: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", err: "bad version 1 header"},
+		{name: "v1 UDP", in: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 2022\r\n", err: "bad version 1 header"},
+		{name: "v1 double space", in: "PROXY TCP4  192.0.2.1 198.51.100.1 56324 2022\r\n", err: "bad version 1 header"},
+
+		{
+			name:   "v2 PROXY IPv4",
+			in:     proxyV2(proxyV2Proxy, 0x11, v2INET),
+			remote: "192.0.2.1:56324", local: "198.51.100.1:2022",
+		},
+		{
+			name:   "v2 PROXY IPv6",
+			in:     proxyV2(proxyV2Proxy, 0x21, v2INET6),
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:2022",
+		},
+		{
+			name:   "v2 PROXY IPv4 with TLVs",
+			in:     proxyV2(proxyV2Proxy, 0x11, v2INET+v2TLVs),
+			remote: "192.0.2.1:56324", local: "198.51.100.1:2022",
+		},
+		{
+			name:   "v2 PROXY IPv6 with TLVs",
+			in:     proxyV2(proxyV2Proxy, 0x21, v2INET6+v2TLVs),
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:2022",
+		},
+		{
+			name:   "v2 PROXY datagram",
+			in:     proxyV2(proxyV2Proxy, 0x12, v2INET),
+			remote: "192.0.2.1:56324", local: "198.51.100.1:2022",
+		},
+		{name: "v2 LOCAL", in: proxyV2(proxyV2Local, 0x00, "")},
+		{name: "v2 LOCAL with addresses", in: proxyV2(proxyV2Local, 0x11, v2INET+v2TLVs)},
+		{name: "v2 unspecified family", in: proxyV2(proxyV2Proxy, 0x00, v2TLVs)},
+		{name: "v2 unix", in: proxyV2(proxyV2Proxy, 0x31, strings.Repeat("\x00", 216))},
+		{name: "v2 version 1", in: proxyV2(0x11, 0x11, v2INET), err: "unsupported version"},
+		{name: "v2 unknown command", in: proxyV2(0x22, 0x11, v2INET), err: "unsupported version"},
+		{name: "v2 short IPv4", in: proxyV2(proxyV2Proxy, 0x11, v2INET[:11]), err: "truncated IPv4"},
+		{name: "v2 short IPv6", in: proxyV2(proxyV2Proxy, 0x21, v2INET), err: "truncated IPv6"},
+		{name: "v2 truncated header", in: proxyV2(proxyV2Proxy, 0x11, "")[:14], err: "EOF"},
+		{name: "v2 truncated body", in: proxyV2(proxyV2Proxy, 0x11, v2INET)[:20], err: "EOF"},
+		{
+			// The length says there's more than was sent.
+			name: "v2 oversized",
+			in:   proxyV2(proxyV2Proxy, 0x11, v2INET)[:14] + "\xff\xff" + v2INET,
+			err:  "EOF",
+		},
+		{name: "v2 truncated signature", in: string(proxyV2Signature[:5]), err: "EOF"},
+
+		{name: "empty", in: "", err: "EOF"},
+		{name: "SSH", in: "SSH-2.0-OpenSSH_9.6\r\n", err: "no PROXY header"},
+		{name: "not quite v2", in: "\r\n\r\n\x00\r\nQUIT!\x21\x11\x00\x0c" + v2INET, err: "no PROXY header"},
+		{name: "lower case", in: "proxy UNKNOWN\r\n", err: "no PROXY header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const after = "SSH-2.0-client\r\n"
+			r := bufio.NewReader(strings.NewReader(tt.in + after))
+			if tt.err != "" {
+				// Errors from running out shouldn't depend on what
+				// followed.
+				r = bufio.NewReader(strings.NewReader(tt.in))
+			}
+			remote, local, err := parseProxyHeader(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addrString(remote); got != tt.remote {
+				t.Errorf("remote %s, want %s", got, tt.remote)
+			}
+			if got := addrString(local); got != tt.local {
+				t.Errorf("local %s, want %s", got, tt.local)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != after {
+				t.Errorf("left %q, want %q", rest, after)
+			}
+		})
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestParseProxyHeaderWaits(t *testing.T) {
+	// A client that waits for the server to speak first sends nothing
+	// after the header, so reading it mustn't need more.
+	for _, in := range []string{"PROXY UNKNOWN\r\n", proxyV2(proxyV2Local, 0, "")} {
+		client, server := net.Pipe()
+		go client.Write([]byte(in))
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := parseProxyHeader(bufio.NewReader(server)); err != nil {
+			t.Errorf("%q: %v", in, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// testProxyListener listens on a loopback port for connections with PROXY
+// headers from trusted.
+func testProxyListener(t *testing.T, trusted string) *proxyListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nets, err := parseTrusted([]string{trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newProxyListener(l, nets, 500*time.Millisecond)
+	t.Cleanup(func() { pl.Close() })
+	return pl
+}
+
+// dialSend connects to l and sends s.
+func dialSend(t *testing.T, l net.Listener, s string) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// accept accepts a connection from l, and reads n bytes from it.
+func accept(t *testing.T, l net.Listener, n int) (net.Conn, string) {
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	return c, string(b)
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	l := testProxyListener(t, "127.0.0.0/8")
+	dialSend(t, l, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 2022\r\nhello")
+	c, got := accept(t, l, 5)
+	if got != "hello" {
+		t.Errorf("read %q", got)
+	}
+	if c.RemoteAddr().String() != "192.0.2.1:56324" || c.LocalAddr().String() != "198.51.100.1:2022" {
+		t.Errorf("addresses %s, %s", c.RemoteAddr(), c.LocalAddr())
+	}
+
+	// Health checks keep the upstream's own addresses.
+	client := dialSend(t, l, proxyV2(proxyV2Local, 0, "")+"hello")
+	c, got = accept(t, l, 5)
+	if got != "hello" {
+		t.Errorf("read %q", got)
+	}
+	if c.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("remote address %s, want %s", c.RemoteAddr(), client.LocalAddr())
+	}
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	// Anyone else's header is just data, which the server will find it
+	// can't make sense of.
+	l := testProxyListener(t, "192.0.2.0/24")
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 2022\r\n"
+	client := dialSend(t, l, header)
+	c, got := accept(t, l, len(header))
+	if got != header {
+		t.Errorf("read %q", got)
+	}
+	if c.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("remote address %s, want %s", c.RemoteAddr(), client.LocalAddr())
+	}
+}
+
+func TestProxyListenerRejects(t *testing.T) {
+	logOut := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(logOut)
+
+	l := testProxyListener(t, "127.0.0.1")
+	bad := []net.Conn{
+		dialSend(t, l, "SSH-2.0-OpenSSH_9.6\r\n"),
+		dialSend(t, l, "PROXY TCP4 192.0.2.1\r\n"),
+		dialSend(t, l, proxyV2(0x11, 0x11, v2INET)),
+		dialSend(t, l, "PROXY "), // and nothing more, till it times out
+	}
+	for i, c := range bad {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("connection %d: read %d bytes, want it closed", i, n)
+		}
+	}
+
+	// None of them got through, and good ones still do.
+	dialSend(t, l, "PROXY UNKNOWN\r\nhello")
+	if _, got := accept(t, l, 5); got != "hello" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestProxyListenerClose(t *testing.T) {
+	l := testProxyListener(t, "127.0.0.1")
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("accepted after closing")
+	}
+}
+
+func FuzzParseProxyHeader(f *testing.F) {
+	f.Add("PROXY TCP4 192.0.2.1 198.51.100.1 56324 2022\r\n")
+	f.Add("PROXY TCP6 2001:db8::1 2001:db8::2 56324 2022\r\n")
+	f.Add("PROXY UNKNOWN\r\n")
+	f.Add(proxyV2(proxyV2Proxy, 0x11, v2INET+v2TLVs))
+	f.Add(proxyV2(proxyV2Proxy, 0x21, v2INET6))
+	f.Add(proxyV2(proxyV2Local, 0x00, ""))
+	f.Fuzz(func(t *testing.T, in string) {
+		sr := strings.NewReader(in)
+		r := bufio.NewReader(sr)
+		remote, local, err := parseProxyHeader(r)
+		if err != nil {
+			if remote != nil || local != nil {
+				t.Fatalf("addresses %v, %v with error %v", remote, local, err)
+			}
+			return
+		}
+		if (remote == nil) != (local == nil) {
+			t.Fatalf("addresses %v, %v", remote, local)
+		}
+		if !strings.HasPrefix(in, "PROXY ") && !strings.HasPrefix(in, string(proxyV2Signature)) {
+			t.Fatalf("parsed %q", in)
+		}
+		if n := len(in) - sr.Len() - r.Buffered(); strings.HasPrefix(in, "PROXY ") && n > proxyV1Max {
+			t.Fatalf("read %d bytes of a version 1 header", n)
+		}
+	})
+}
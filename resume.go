@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// link is a connection's screen, as attached to a game.  A game outlives
+// its links: when a player's connection drops, the game carries on
+// link-dead until they log in again and a new link is attached, or the
+// grace period runs out.  A player can also take a game over from one of
+// their connections to another.
+type link struct {
+	screen     tcell.Screen
+	remoteAddr net.Addr
+	term       string
+	telnet     *telnetConn
+	gmcp       *gmcpState
+	color      headlesstcell.TrueColorMode
+	events     chan tcell.Event // from the screen
+	detached   chan struct{}    // closed when the connection is done with the game
+	finished   chan struct{}    // closed by fini
+
+	detachOnce, finiOnce sync.Once
+}
+
+// newLink returns a link to the screen of sess, a session just started
+// for a new connection, and starts passing on its events.
+func newLink(sess *session) *link {
+	l := &link{
+		screen:     sess.screen,
+		remoteAddr: sess.remoteAddr,
+		term:       sess.term,
+		telnet:     sess.telnet,
+		gmcp:       sess.gmcp,
+		color:      sess.color,
+		events:     make(chan tcell.Event),
+		detached:   make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	go l.poll()
+	return l
+}
+
+// poll passes the screen's events to whichever game the link is
+// attached to.
+func (l *link) poll() {
+	for {
+		ev := l.screen.PollEvent()
+		if ev == nil {
+			return
+		}
+		select {
+		case l.events <- ev:
+		case <-l.finished:
+			return
+		}
+	}
+}
+
+// detach lets the connection go; playSession hangs it up.
+func (l *link) detach() {
+	l.detachOnce.Do(func() { close(l.detached) })
+}
+
+// fini restores the client's terminal and lets the connection go.
+func (l *link) fini() {
+	l.finiOnce.Do(func() {
+		l.screen.Fini()
+		close(l.finished)
+	})
+	l.detach()
+}
+
+// copyScreen copies what fits of src's contents onto dst.
+func copyScreen(dst, src tcell.Screen) {
+	w, h := dst.Size()
+	sw, sh := src.Size()
+	if sw < w {
+		w = sw
+	}
+	if sh < h {
+		h = sh
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			mainc, combc, style, _ := src.GetContent(x, y)
+			dst.SetContent(x, y, mainc, combc, style)
+		}
+	}
+}
+
+// setLink records l as the session's connection.
+func (sess *session) setLink(l *link) {
+	w, h := l.screen.Size()
+	sess.mu.Lock()
+	sess.remoteAddr, sess.term, sess.screen = l.remoteAddr, l.term, l.screen
+	sess.telnet, sess.gmcp = l.telnet, l.gmcp
+	sess.color = l.color
+	sess.width, sess.height = w, h
+	sess.linkDead = time.Time{}
+	sess.mu.Unlock()
+	sess.touch()
+}
+
+// goLinkDead records that the player's connection has dropped.
+func (sess *session) goLinkDead() {
+	sess.mu.Lock()
+	sess.linkDead = time.Now()
+	sess.mu.Unlock()
+}
+
+// claim marks a link-dead session as being resumed, returning false if it
+// isn't link-dead, so two connections can't both resume it.
+func (sess *session) claim() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.linkDead.IsZero() {
+		return false
+	}
+	sess.linkDead = time.Time{}
+	return true
+}
+
+// attachLink hands l to the session's game, returning false if the game
+// has ended.
+func (sess *session) attachLink(l *link) bool {
+	select {
+	case sess.attach <- l:
+		return true
+	case <-sess.done:
+		return false
+	}
+}
+
+// handoff ends the session, passing its screen on to to's game.
+func (sess *session) handoff(to *session) {
+	sess.mu.Lock()
+	sess.handoffTo = to
+	sess.mu.Unlock()
+	sess.close()
+}
+
+func (sess *session) handoffTarget() *session {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.handoffTo
+}
+
+// playingElsewhere returns another session of the player's that has a
+// screen and is still connected, or nil.
+func (sess *session) playingElsewhere() *session {
+	for _, other := range sess.srv.sessions.ForAccount(sess.account.ID) {
+		if other != sess && other.Screen() != nil && !other.LinkDead() {
+			return other
+		}
+	}
+	return nil
+}
+
+// resume attaches l, the link of the newly started sess, to a link-dead
+// game of the same player's, returning that game's session, or nil if
+// there isn't one.
+func (srv *server) resume(sess *session, l *link) *session {
+	if srv.cfg.Network.LinkDeadGrace <= 0 {
+		return nil
+	}
+	for _, old := range srv.sessions.ForAccount(sess.account.ID) {
+		if old != sess && old.claim() && old.attachLink(l) {
+			log.Printf("%q resumed their game from %s", sess.account.Name, l.remoteAddr)
+			return old
+		}
+	}
+	return nil
+}
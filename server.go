@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// server is the state shared by every connection.
+type server struct {
+	cfg          *Config
+	accounts     AccountStore
+	bans         *banList
+	sshConfig    *ssh.ServerConfig
+	connRate     *rateLimiter
+	authFailures *rateLimiter
+	started      time.Time
+
+	listeners []net.Listener
+	conns     map[io.Closer]bool // SSH, telnet and WebSocket connections
+	sessions  *sessionManager
+	active    int // connections admitted
+	closing   bool
+	stopping  chan struct{}  // closed at shutdown
+	running   sync.WaitGroup // sessions
+	sync.Mutex
+}
+
+func newServer(cfg *Config, accounts AccountStore, bans *banList, sshConfig *ssh.ServerConfig) *server {
+	srv := &server{
+		cfg:          cfg,
+		accounts:     accounts,
+		bans:         bans,
+		sshConfig:    sshConfig,
+		connRate:     newRateLimiter(cfg.Network.ConnBurst, cfg.Network.ConnInterval),
+		authFailures: newRateLimiter(cfg.Auth.FailureBurst, cfg.Auth.FailureInterval),
+		started:      time.Now(),
+		conns:        make(map[io.Closer]bool),
+		sessions:     newSessionManager(),
+		stopping:     make(chan struct{}),
+	}
+	srv.throttleAuth(sshConfig)
+	go srv.reapIdle()
+	return srv
+}
+
+// Serve accepts SSH connections on l until Shutdown is called.
+func (srv *server) Serve(l net.Listener) error {
+	return srv.serve(l, srv.handleSSHConnection)
+}
+
+// ServeTelnet accepts telnet connections on l until Shutdown is called.
+func (srv *server) ServeTelnet(l net.Listener) error {
+	return srv.serve(l, srv.handleTelnetConnection)
+}
+
+// ServeWeb serves the browser client on l until Shutdown is called.
+func (srv *server) ServeWeb(l net.Listener) error {
+	if !srv.addListener(l) {
+		return l.Close()
+	}
+	err := (&http.Server{Handler: srv.webHandler()}).Serve(l)
+	if srv.isClosing() {
+		return nil
+	}
+	return err
+}
+
+func (srv *server) serve(l net.Listener, handle func(net.Conn)) error {
+	if !srv.addListener(l) {
+		return l.Close()
+	}
+	for {
+		nConn, err := l.Accept()
+		if err != nil {
+			if srv.isClosing() {
+				return nil
+			}
+			log.Printf("Failed to accept incoming connection: %v", err)
+			continue
+		}
+		if err := srv.admit(nConn); err != nil {
+			log.Printf("Refused connection from %s: %v", nConn.RemoteAddr(), err)
+			nConn.Close()
+			continue
+		}
+		go func() {
+			defer srv.release()
+			handle(nConn)
+		}()
+	}
+}
+
+// addListener tracks a listener for Shutdown to close, returning false
+// if the server is shutting down.
+func (srv *server) addListener(l net.Listener) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.listeners = append(srv.listeners, l)
+	return true
+}
+
+func (srv *server) isClosing() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.closing
+}
+
+// addConn tracks a connection, returning false if the server is shutting
+// down.
+func (srv *server) addConn(c io.Closer) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.conns[c] = true
+	return true
+}
+
+func (srv *server) removeConn(c io.Closer) {
+	srv.Lock()
+	delete(srv.conns, c)
+	srv.Unlock()
+}
+
+// startSession registers a running session, returning false if the
+// server is shutting down.  Every successful call must be matched by
+// endSession.
+func (srv *server) startSession(sess *session) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.sessions.Add(sess)
+	srv.running.Add(1)
+	return true
+}
+
+func (srv *server) endSession(sess *session) {
+	srv.sessions.Remove(sess)
+	srv.running.Done()
+}
+
+// playSession runs the game for a started session until the player
+// leaves or is disconnected, reading line mode input from in.  Then it
+// hangs up and ends the session.  Games with a screen can outlive the
+// connection: they resume link-dead games, and go link-dead themselves
+// when the connection drops, so playSession only waits until the
+// connection is done with the game.
+func (srv *server) playSession(sess *session, in io.Reader, hangup func()) {
+	sess.SendGMCP("Char.Name", map[string]string{
+		"name":     sess.account.Name,
+		"fullname": sess.account.Name,
+	})
+	if sess.screen == nil {
+		runLineMode(sess, in)
+		hangup()
+		srv.endSession(sess)
+		log.Printf("%q disconnected from %s", sess.account.Name, sess.remoteAddr)
+		return
+	}
+	l := newLink(sess)
+	if srv.resume(sess, l) != nil {
+		// sess only brought the connection.
+		srv.endSession(sess)
+	} else {
+		go func() {
+			run(sess, l)
+			srv.endSession(sess)
+			if sess.handoffTarget() == nil {
+				log.Printf("%q disconnected from %s", sess.account.Name, sess.RemoteAddr())
+			}
+		}()
+	}
+	<-l.detached
+	hangup()
+	if r, ok := l.screen.(headlesstcell.OutputReporter); ok {
+		st := r.OutputStats()
+		log.Printf("Sent %d bytes in %d frames (%d dropped) to %s, writes taking %s on average, %s at most",
+			st.Bytes, st.Frames, st.Dropped, l.remoteAddr, st.AvgWrite().Round(time.Microsecond), st.MaxWrite.Round(time.Microsecond))
+	}
+}
+
+// newScreen returns a screen on rw for a client with the given terminal
+// and size.  opts gives what's known of the client; the terminfo settings
+// and output limits come from the config.
+func (srv *server) newScreen(rw io.ReadWriter, term string, cols, lines int,
+	opts headlesstcell.Options) (tcell.Screen, error) {
+	opts.DefaultTerm = srv.cfg.Render.DefaultTerm
+	opts.TerminfoDirs = srv.cfg.Render.TerminfoDirs
+	opts.MaxFPS = srv.cfg.Render.MaxFPS
+	opts.WriteTimeout = srv.cfg.Render.WriteTimeout
+	opts.OutputBudget = srv.cfg.Render.OutputBudget
+	return headlesstcell.NewScreen(rw, term, cols, lines, opts)
+}
+
+// screenColor returns whether to send 24-bit colors to a player with the
+// given account color setting, whose client says hint.  The setting wins,
+// for clients that get it wrong.
+func screenColor(setting string, hint headlesstcell.TrueColorMode) headlesstcell.TrueColorMode {
+	switch setting {
+	case colorTrueColor:
+		return headlesstcell.TrueColorOn
+	case colorPalette:
+		return headlesstcell.TrueColorOff
+	}
+	return hint
+}
+
+// shutdownMarks are the points in the countdown where players are warned.
+var shutdownMarks = []time.Duration{
+	10 * time.Minute, 5 * time.Minute, time.Minute, 30 * time.Second,
+	10 * time.Second, 5 * time.Second, 4 * time.Second, 3 * time.Second,
+	2 * time.Second, time.Second,
+}
+
+// Shutdown stops accepting connections, counts down for the configured
+// warning period (cut short by anything arriving on hurry), saves state,
+// and ends every session.  Connections still open after the shutdown
+// timeout are closed regardless.
+func (srv *server) Shutdown(hurry <-chan os.Signal) {
+	srv.Lock()
+	srv.closing = true
+	close(srv.stopping)
+	for _, l := range srv.listeners {
+		l.Close()
+	}
+	srv.Unlock()
+
+	remaining := srv.cfg.Network.ShutdownWarning
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-hurry:
+			return false
+		}
+	}
+	if remaining > 0 {
+		srv.sessions.Broadcast(fmt.Sprintf("*** The server is shutting down in %s. ***", remaining))
+		for _, mark := range shutdownMarks {
+			if mark >= remaining {
+				continue
+			}
+			if !wait(remaining - mark) {
+				remaining = 0
+				break
+			}
+			remaining = mark
+			srv.sessions.Broadcast(fmt.Sprintf("*** The server is shutting down in %s. ***", remaining))
+		}
+		if remaining > 0 {
+			wait(remaining)
+		}
+	}
+	srv.sessions.Broadcast("*** The server is shutting down now. ***")
+
+	if err := srv.accounts.Save(); err != nil {
+		log.Printf("Failed to save accounts: %v", err)
+	}
+	if err := srv.bans.Save(); err != nil {
+		log.Printf("Failed to save bans: %v", err)
+	}
+
+	srv.sessions.Each((*session).close)
+
+	done := make(chan struct{})
+	go func() {
+		srv.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(srv.cfg.Network.ShutdownTimeout):
+		log.Printf("Timed out waiting for sessions to end")
+	}
+
+	srv.Lock()
+	for c := range srv.conns {
+		c.Close()
+	}
+	srv.Unlock()
+}
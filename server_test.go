@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer starts a server on a loopback port with one account,
+// leaktest, which any password logs in to.  The caller must shut it down.
+func testServer(t *testing.T, cfg *Config) (*server, string) {
+	accounts, err := NewFileAccountStore(filepath.Join(t.TempDir(), "accounts.json"),
+		cfg.Auth.MaxFailures, cfg.Auth.Lockout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accounts.Create("leaktest", "password"); err != nil {
+		t.Fatal(err)
+	}
+	sshConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			acct, err := accounts.Lookup(c.User())
+			if err != nil {
+				return nil, err
+			}
+			return accountPermissions(acct, authPassword), nil
+		},
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans, err := loadBans(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, accounts, bans, sshConfig)
+	go srv.Serve(l)
+	return srv, l.Addr().String()
+}
+
+// play logs in to addr with a pty and reads until the game has drawn
+// something, then drops the connection.
+func play(t *testing.T, addr string) {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "leaktest",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 0, 4096)
+	buf := make([]byte, 4096)
+	for !bytes.Contains(got, []byte("Welcome")) {
+		n, err := out.Read(buf)
+		if err != nil {
+			t.Fatalf("%v before the game drew anything", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+}
+
+// TestDisconnectLeaks connects and disconnects players many times, and
+// checks nothing they or the server started is left running once it's
+// shut down.
+func TestDisconnectLeaks(t *testing.T) {
+	logOut := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(logOut)
+
+	base := runtime.NumGoroutine()
+	cfg := DefaultConfig()
+	cfg.Network.ShutdownWarning = 0
+	cfg.Network.ConnBurst = 100
+	// Dropped games wait a moment for their players, and then go too.
+	cfg.Network.LinkDeadGrace = 100 * time.Millisecond
+	srv, addr := testServer(t, cfg)
+
+	for i := 0; i < 50; i++ {
+		play(t, addr)
+	}
+
+	// Sessions finish shortly after the connections they belong to.
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.sessions.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := srv.sessions.Len(); n != 0 {
+		t.Errorf("%d sessions still registered", n)
+	}
+
+	srv.Shutdown(nil)
+	for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		t.Fatalf("%d goroutines running, up from %d:\n%s", n, base, stacks)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// session is one player's game.  It usually lasts as long as their
+// connection, but a game with a screen can outlive it: see link.
+type session struct {
+	id         uint64
+	srv        *server
+	account    *Account
+	authMethod string
+	connected  time.Time
+	text       *textConn // in line mode, where screen is nil
+	attach     chan *link
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// guarded by mu; the first six change when a new connection is
+	// attached
+	remoteAddr    net.Addr
+	term          string
+	screen        tcell.Screen
+	telnet        *telnetConn                 // nil unless the client is on telnet
+	gmcp          *gmcpState                  // likewise
+	color         headlesstcell.TrueColorMode // what the client says about 24-bit color
+	width, height int
+	lastInput     time.Time
+	idleWarned    bool
+	linkDead      time.Time // when the connection dropped, if it's gone
+	handoffTo     *session  // where the screen goes when the game ends
+	mu            sync.Mutex
+}
+
+func newSession(srv *server, acct *Account, authMethod string, remoteAddr net.Addr,
+	term string, width, height int, screen tcell.Screen) *session {
+	now := time.Now()
+	return &session{
+		srv:        srv,
+		account:    acct,
+		authMethod: authMethod,
+		remoteAddr: remoteAddr,
+		term:       term,
+		connected:  now,
+		screen:     screen,
+		attach:     make(chan *link),
+		done:       make(chan struct{}),
+		width:      width,
+		height:     height,
+		lastInput:  now,
+	}
+}
+
+// close ends the session's game loop.
+func (sess *session) close() {
+	sess.closeOnce.Do(func() { close(sess.done) })
+}
+
+// notify shows msg in the player's log pane, or as a line of its own in
+// line mode.
+func (sess *session) notify(msg string) {
+	sess.SendGMCP("Comm.Channel.Text", map[string]string{
+		"channel": "server",
+		"talker":  "server",
+		"text":    msg,
+	})
+	screen := sess.Screen()
+	if screen == nil {
+		fmt.Fprintln(sess.text, msg)
+		return
+	}
+	screen.PostEvent(tcell.NewEventInterrupt(msg))
+}
+
+// touch records that the player just sent input.
+func (sess *session) touch() {
+	sess.mu.Lock()
+	sess.lastInput = time.Now()
+	sess.idleWarned = false
+	sess.mu.Unlock()
+}
+
+// warnIdle returns true the first time it's called after each input, so
+// idle players are only warned once.
+func (sess *session) warnIdle() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	warn := !sess.idleWarned
+	sess.idleWarned = true
+	return warn
+}
+
+func (sess *session) LastInput() time.Time {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.lastInput
+}
+
+func (sess *session) setSize(width, height int) {
+	sess.mu.Lock()
+	sess.width, sess.height = width, height
+	sess.mu.Unlock()
+}
+
+func (sess *session) Size() (int, int) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.width, sess.height
+}
+
+// Screen returns the screen of the session's connection, or nil in line
+// mode.
+func (sess *session) Screen() tcell.Screen {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.screen
+}
+
+// applyColor sets whether the session's screen sends 24-bit colors, for
+// when the player changes their color setting.
+func (sess *session) applyColor(setting string) {
+	sess.mu.Lock()
+	screen, hint := sess.screen, sess.color
+	sess.mu.Unlock()
+	if s, ok := screen.(headlesstcell.TrueColorSetter); ok {
+		s.SetTrueColor(screenColor(setting, hint))
+	}
+}
+
+// Telnet returns the session's telnet connection, or nil if the
+// client isn't on telnet.
+func (sess *session) Telnet() *telnetConn {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.telnet
+}
+
+func (sess *session) RemoteAddr() net.Addr {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.remoteAddr
+}
+
+// LinkDead reports whether the player's connection has dropped.
+func (sess *session) LinkDead() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return !sess.linkDead.IsZero()
+}
+
+// sessionManager tracks every connected player.  It's safe for
+// concurrent use.
+type sessionManager struct {
+	sessions map[uint64]*session
+	lastID   uint64
+	sync.RWMutex
+}
+
+func newSessionManager() *sessionManager {
+	return &sessionManager{sessions: make(map[uint64]*session)}
+}
+
+// Add registers sess and assigns its ID.
+func (m *sessionManager) Add(sess *session) {
+	m.Lock()
+	m.lastID++
+	sess.id = m.lastID
+	m.sessions[sess.id] = sess
+	m.Unlock()
+}
+
+func (m *sessionManager) Remove(sess *session) {
+	m.Lock()
+	delete(m.sessions, sess.id)
+	m.Unlock()
+}
+
+// Get returns the session with the given ID, or nil.
+func (m *sessionManager) Get(id uint64) *session {
+	m.RLock()
+	defer m.RUnlock()
+	return m.sessions[id]
+}
+
+// ForAccount returns the account's sessions, oldest first.
+func (m *sessionManager) ForAccount(accountID string) []*session {
+	var found []*session
+	for _, sess := range m.All() {
+		if sess.account.ID == accountID {
+			found = append(found, sess)
+		}
+	}
+	return found
+}
+
+// All returns every session, oldest first.
+func (m *sessionManager) All() []*session {
+	m.RLock()
+	all := make([]*session, 0, len(m.sessions))
+	for _, sess := range m.sessions {
+		all = append(all, sess)
+	}
+	m.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].id < all[j].id })
+	return all
+}
+
+// Each calls fn for every session.  fn may add or remove sessions.
+func (m *sessionManager) Each(fn func(*session)) {
+	for _, sess := range m.All() {
+		fn(sess)
+	}
+}
+
+func (m *sessionManager) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.sessions)
+}
+
+// Broadcast shows msg to every player.
+func (m *sessionManager) Broadcast(msg string) {
+	m.Each(func(sess *session) { sess.notify(msg) })
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	minNameLen     = 3
+	maxNameLen     = 20
+	minPasswordLen = 8
+	signupAttempts = 3
+)
+
+// validAccountName returns an error unless name is acceptable for a new
+// account: a letter followed by letters, digits, '-' or '_'.
+func validAccountName(name string) error {
+	if len(name) < minNameLen || len(name) > maxNameLen {
+		return fmt.Errorf("names must be %d to %d characters long", minNameLen, maxNameLen)
+	}
+	for i, r := range name {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLetter(r):
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_'):
+		default:
+			return errors.New("names must start with a letter and contain only letters, digits, '-' and '_'")
+		}
+	}
+	return nil
+}
+
+// checkPasswordStrength returns an error describing why password is too
+// weak for the account name, or nil.
+func checkPasswordStrength(name, password string) error {
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("passwords must be at least %d characters long", minPasswordLen)
+	}
+	if strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+		return errors.New("passwords must not contain your name")
+	}
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, b := range []bool{lower, upper, digit, other} {
+		if b {
+			classes++
+		}
+	}
+	if classes < 2 {
+		return errors.New("passwords must mix at least two of lowercase, uppercase, digits and symbols")
+	}
+	return nil
+}
+
+// keyboardInteractiveCallback returns an ssh keyboard-interactive
+// callback that asks existing players for their password, and walks new
+// names through creating an account.
+func keyboardInteractiveCallback(accounts AccountStore) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		if _, err := accounts.Lookup(c.User()); err == nil {
+			answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 {
+				return nil, errors.New("wrong number of answers")
+			}
+			acct, err := accounts.Authenticate(c.User(), []byte(answers[0]))
+			if err != nil {
+				log.Printf("Keyboard-interactive auth for %q from %s failed: %v", c.User(), c.RemoteAddr(), err)
+				return nil, fmt.Errorf("password rejected for %q", c.User())
+			}
+			return accountPermissions(acct, authPassword), nil
+		} else if err != ErrNoAccount {
+			return nil, err
+		}
+
+		if err := validAccountName(c.User()); err != nil {
+			client(c.User(), "Can't create an account named "+c.User()+": "+err.Error()+".", nil, nil)
+			return nil, err
+		}
+
+		instruction := "There is no account named " + c.User() + " yet. Choose a password to create it."
+		for i := 0; i < signupAttempts; i++ {
+			answers, err := client(c.User(), instruction,
+				[]string{"New password: ", "Confirm password: "}, []bool{false, false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 2 {
+				return nil, errors.New("wrong number of answers")
+			}
+			if answers[0] != answers[1] {
+				instruction = "Passwords didn't match; try again."
+				continue
+			}
+			if err := checkPasswordStrength(c.User(), answers[0]); err != nil {
+				instruction = "Sorry, " + err.Error() + "."
+				continue
+			}
+			acct, err := accounts.Create(c.User(), answers[0])
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Created account %q (%s) for %s", acct.Name, acct.ID, c.RemoteAddr())
+			return accountPermissions(acct, authPassword), nil
+		}
+		return nil, fmt.Errorf("signup for %q abandoned", c.User())
+	}
+}
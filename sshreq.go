@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// Payloads of the session channel requests we handle, from RFC 4254
+// section 6.
+
+// ptyRequest is the payload of a "pty-req" request.
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32 // in pixels
+	Modes         string // encoded terminal modes
+}
+
+// windowChangeRequest is the payload of a "window-change" request.
+type windowChangeRequest struct {
+	Columns, Rows uint32
+	Width, Height uint32 // in pixels
+}
+
+// envRequest is the payload of an "env" request.
+type envRequest struct {
+	Name, Value string
+}
+
+// execRequest is the payload of an "exec" request.
+type execRequest struct {
+	Command string
+}
+
+// Terminal sizes are clamped to this, so clients can't make us allocate
+// enormous cell buffers.
+const maxTermSize = 1000
+
+// Defaults for clients that don't give a size in characters.
+const (
+	defaultColumns = 80
+	defaultRows    = 24
+)
+
+func clampSize(v uint32, def int) int {
+	if v == 0 {
+		return def
+	}
+	if v > maxTermSize {
+		return maxTermSize
+	}
+	return int(v)
+}
+
+func parsePtyRequest(payload []byte) (*ptyRequest, headlesstcell.TermModes, error) {
+	var req ptyRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return nil, nil, fmt.Errorf("bad pty-req: %v", err)
+	}
+	modes, err := parseTermModes([]byte(req.Modes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad pty-req: %v", err)
+	}
+	return &req, modes, nil
+}
+
+func parseWindowChange(payload []byte) (*windowChangeRequest, error) {
+	var req windowChangeRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("bad window-change: %v", err)
+	}
+	return &req, nil
+}
+
+func parseEnv(payload []byte) (*envRequest, error) {
+	var req envRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("bad env: %v", err)
+	}
+	return &req, nil
+}
+
+func parseExec(payload []byte) (*execRequest, error) {
+	var req execRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("bad exec: %v", err)
+	}
+	return &req, nil
+}
+
+func parseShell(payload []byte) error {
+	if len(payload) != 0 {
+		return errors.New("bad shell: unexpected payload")
+	}
+	return nil
+}
+
+// Terminal mode opcodes that end the list (RFC 4254 section 8).
+const (
+	ttyOpEnd       = 0
+	ttyOpUndefined = 160 // and up
+)
+
+// parseTermModes decodes the encoded terminal modes of a pty-req: a list
+// of opcode bytes each followed by a uint32 argument.
+func parseTermModes(b []byte) (headlesstcell.TermModes, error) {
+	modes := make(headlesstcell.TermModes)
+	for len(b) > 0 {
+		op := b[0]
+		if op == ttyOpEnd || op >= ttyOpUndefined {
+			break
+		}
+		if len(b) < 5 {
+			return nil, fmt.Errorf("truncated terminal mode %d", op)
+		}
+		modes[op] = binary.BigEndian.Uint32(b[1:5])
+		b = b[5:]
+	}
+	return modes, nil
+}
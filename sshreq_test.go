@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// openSSHModes are terminal modes as OpenSSH sends them for a typical
+// Linux tty: a few control characters and flags, then the speeds.
+var openSSHModes = modeBytes(
+	1, 3, // VINTR ^C
+	2, 28, // VQUIT ^\
+	3, 127, // VERASE DEL
+	4, 21, // VKILL ^U
+	5, 4, // VEOF ^D
+	30, 0, // IGNPAR
+	35, 0, // IGNCR
+	36, 1, // ICRNL
+	50, 1, // ISIG
+	51, 1, // ICANON
+	53, 1, // ECHO
+	128, 38400, // TTY_OP_ISPEED
+	129, 38400, // TTY_OP_OSPEED
+)
+
+// modeBytes encodes opcode, argument pairs, ending the list.
+func modeBytes(pairs ...uint32) []byte {
+	var b []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		b = append(b, byte(pairs[i]))
+		b = binary.BigEndian.AppendUint32(b, pairs[i+1])
+	}
+	return append(b, ttyOpEnd)
+}
+
+// truncations returns every prefix of b shorter than it, which the
+// slicing the decoders replaced indexed past the end of.
+func truncations(b []byte) [][]byte {
+	var out [][]byte
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[:i])
+	}
+	return out
+}
+
+func FuzzParsePtyRequest(f *testing.F) {
+	seed := ssh.Marshal(&ptyRequest{
+		Term:    "xterm-256color",
+		Columns: 80, Rows: 24,
+		Width: 640, Height: 480,
+		Modes: string(openSSHModes),
+	})
+	f.Add(seed)
+	f.Add(ssh.Marshal(&ptyRequest{Term: "vt100", Columns: 132, Rows: 43, Modes: "\x00"}))
+	// No terminal name, which is left to the screen to fall back from.
+	f.Add(ssh.Marshal(&ptyRequest{Modes: "\x00"}))
+	for _, b := range truncations(seed) {
+		f.Add(b)
+	}
+	// A terminal name longer than the payload.
+	f.Add([]byte("\x00\x00\x00\xffxterm"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		req, modes, err := parsePtyRequest(payload)
+		if err != nil {
+			return
+		}
+		if modes == nil {
+			t.Fatal("nil modes without an error")
+		}
+		if !bytes.Equal(ssh.Marshal(req), payload) {
+			t.Fatalf("%q decoded as %+v, which doesn't encode the same", payload, req)
+		}
+	})
+}
+
+func FuzzParseWindowChange(f *testing.F) {
+	seed := ssh.Marshal(&windowChangeRequest{Columns: 100, Rows: 40, Width: 800, Height: 600})
+	f.Add(seed)
+	for _, b := range truncations(seed) {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		req, err := parseWindowChange(payload)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(ssh.Marshal(req), payload) {
+			t.Fatalf("%q decoded as %+v, which doesn't encode the same", payload, req)
+		}
+	})
+}
+
+func FuzzParseEnv(f *testing.F) {
+	seed := ssh.Marshal(&envRequest{Name: "LANG", Value: "en_US.UTF-8"})
+	f.Add(seed)
+	for _, b := range truncations(seed) {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		req, err := parseEnv(payload)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(ssh.Marshal(req), payload) {
+			t.Fatalf("%q decoded as %+v, which doesn't encode the same", payload, req)
+		}
+	})
+}
+
+func FuzzParseExec(f *testing.F) {
+	seed := ssh.Marshal(&execRequest{Command: "who"})
+	f.Add(seed)
+	f.Add(ssh.Marshal(&execRequest{}))
+	for _, b := range truncations(seed) {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		req, err := parseExec(payload)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(ssh.Marshal(req), payload) {
+			t.Fatalf("%q decoded as %+v, which doesn't encode the same", payload, req)
+		}
+	})
+}
+
+func FuzzParseTermModes(f *testing.F) {
+	f.Add(openSSHModes)
+	for _, b := range truncations(openSSHModes) {
+		f.Add(b)
+	}
+	f.Add([]byte{ttyOpUndefined, 1, 2})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		modes, err := parseTermModes(b)
+		if err != nil {
+			return
+		}
+		if len(modes) > len(b)/5 {
+			t.Fatalf("%q decoded as %d modes", b, len(modes))
+		}
+		for op := range modes {
+			if op == ttyOpEnd || op >= ttyOpUndefined {
+				t.Fatalf("%q decoded as having opcode %d", b, op)
+			}
+		}
+	})
+}
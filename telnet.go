@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// Telnet commands and options (RFC 854, 857, 858, 1073, 1091).
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+
+	ttypeIS   = 0
+	ttypeSEND = 1
+)
+
+// MTTS terminal capability bits, sent by MUD clients as a "MTTS <bits>"
+// terminal type.
+const (
+	mttsANSI         = 1
+	mttsVT100        = 2
+	mttsUTF8         = 4
+	mttsScreenReader = 64
+	mttsTrueColor    = 256
+)
+
+// maxSubnegotiation limits how much of a subnegotiation we keep.
+const maxSubnegotiation = 8192
+
+// Reader states.
+const (
+	telnetData = iota
+	telnetCR
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+// telnetConn speaks telnet on a connection, presenting the data stream
+// as an io.ReadWriter.  Read strips commands, answering negotiations as
+// they arrive, and turns each CR LF or CR NUL into enter.  Write escapes
+// IAC bytes.
+type telnetConn struct {
+	net.Conn
+	r     *bufio.Reader
+	enter byte // what a newline reads as
+	gmcp  *gmcpState
+
+	// reader state
+	state int
+	verb  byte
+	sub   []byte
+
+	// guarded by the mutex
+	him, us    [256]bool // options enabled on the client and our side
+	askedHim   [256]bool // options we've asked the client to enable
+	askedUs    [256]bool // options we've offered
+	wantUs     [256]bool // options we're willing to enable
+	ttypes     []string
+	mtts       int // -1 until the client sends MTTS
+	cols, rows int
+	onResize   func(cols, rows int)
+	sync.Mutex
+
+	// guarded by wmu
+	wire countingWriter
+	zw   *zlib.Writer // while MCCP2 is on
+	sent int64        // bytes before compression
+	wmu  sync.Mutex
+}
+
+// newTelnetConn returns a telnet connection on conn, which will offer
+// MCCP2 compression if compress is set.
+func newTelnetConn(conn net.Conn, compress bool) *telnetConn {
+	t := &telnetConn{
+		Conn:  conn,
+		r:     bufio.NewReader(conn),
+		enter: '\n',
+		mtts:  -1,
+		wire:  countingWriter{w: conn},
+	}
+	t.gmcp = newGMCPState(t)
+	t.wantUs[telnetOptMCCP2] = compress
+	return t
+}
+
+// negotiate asks for everything we'd like the client to tell us.
+func (t *telnetConn) negotiate() error {
+	t.Lock()
+	defer t.Unlock()
+	t.askedHim[telnetOptTType] = true
+	t.askedHim[telnetOptNAWS] = true
+	t.askedUs[telnetOptSGA] = true
+	t.wantUs[telnetOptSGA] = true
+	t.askedUs[telnetOptGMCP] = true
+	t.wantUs[telnetOptGMCP] = true
+	cmds := []byte{
+		telnetIAC, telnetDO, telnetOptTType,
+		telnetIAC, telnetDO, telnetOptNAWS,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetWILL, telnetOptGMCP,
+	}
+	if t.wantUs[telnetOptMCCP2] {
+		t.askedUs[telnetOptMCCP2] = true
+		cmds = append(cmds, telnetIAC, telnetWILL, telnetOptMCCP2)
+	}
+	return t.command(cmds...)
+}
+
+// optionEnabled reports whether we've agreed with the client to use opt.
+func (t *telnetConn) optionEnabled(opt byte) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.us[opt]
+}
+
+// subnegotiate sends payload as a subnegotiation of opt.
+func (t *telnetConn) subnegotiate(opt byte, payload []byte) error {
+	b := make([]byte, 0, len(payload)+5)
+	b = append(b, telnetIAC, telnetSB, opt)
+	for _, c := range payload {
+		if c == telnetIAC {
+			b = append(b, telnetIAC)
+		}
+		b = append(b, c)
+	}
+	return t.command(append(b, telnetIAC, telnetSE)...)
+}
+
+// command writes raw telnet bytes.
+func (t *telnetConn) command(b ...byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	return t.write(b)
+}
+
+func (t *telnetConn) Write(p []byte) (int, error) {
+	b := p
+	if n := strings.Count(string(p), "\xff"); n > 0 {
+		b = make([]byte, 0, len(p)+n)
+		for _, c := range p {
+			if c == telnetIAC {
+				b = append(b, telnetIAC)
+			}
+			b = append(b, c)
+		}
+	}
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if err := t.write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *telnetConn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && t.r.Buffered() == 0 {
+			break
+		}
+		c, err := t.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b, ok := t.scan(c); ok {
+			p[n] = b
+			n++
+		}
+	}
+	return n, nil
+}
+
+// scan runs c through the reader, returning the data byte it yields, if
+// any.
+func (t *telnetConn) scan(c byte) (byte, bool) {
+	switch t.state {
+	case telnetCR:
+		t.state = telnetData
+		if c == 0 || c == '\n' {
+			return 0, false
+		}
+		return t.scan(c)
+	case telnetCommand:
+		t.state = telnetData
+		switch c {
+		case telnetIAC:
+			return c, true
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			t.verb = c
+			t.state = telnetOption
+		case telnetSB:
+			t.sub = t.sub[:0]
+			t.state = telnetSub
+		}
+		// Anything else (NOP, GA, AYT...) is ignored.
+	case telnetOption:
+		t.state = telnetData
+		t.option(t.verb, c)
+	case telnetSub:
+		if c == telnetIAC {
+			t.state = telnetSubIAC
+		} else if len(t.sub) < maxSubnegotiation {
+			t.sub = append(t.sub, c)
+		}
+	case telnetSubIAC:
+		switch c {
+		case telnetSE:
+			t.state = telnetData
+			t.subnegotiation(t.sub)
+		case telnetIAC:
+			t.state = telnetSub
+			if len(t.sub) < maxSubnegotiation {
+				t.sub = append(t.sub, c)
+			}
+		default:
+			t.state = telnetData
+		}
+	default:
+		switch c {
+		case telnetIAC:
+			t.state = telnetCommand
+		case '\r':
+			t.state = telnetCR
+			return t.enter, true
+		case '\n':
+			return t.enter, true
+		default:
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// option answers a WILL, WONT, DO or DONT from the client, agreeing to
+// the options we support and refusing the rest.  Requests that don't
+// change anything get no reply, so negotiation can't loop.
+func (t *telnetConn) option(verb, opt byte) {
+	t.Lock()
+	defer t.Unlock()
+	switch verb {
+	case telnetWILL:
+		if opt != telnetOptTType && opt != telnetOptNAWS {
+			t.command(telnetIAC, telnetDONT, opt)
+			return
+		}
+		if !t.him[opt] {
+			t.him[opt] = true
+			if !t.askedHim[opt] {
+				t.command(telnetIAC, telnetDO, opt)
+			}
+			if opt == telnetOptTType {
+				t.command(telnetIAC, telnetSB, telnetOptTType, ttypeSEND, telnetIAC, telnetSE)
+			}
+		}
+		t.askedHim[opt] = false
+	case telnetWONT:
+		t.askedHim[opt] = false
+		if t.him[opt] {
+			t.him[opt] = false
+			t.command(telnetIAC, telnetDONT, opt)
+		}
+	case telnetDO:
+		if !t.wantUs[opt] {
+			t.us[opt] = false
+			t.command(telnetIAC, telnetWONT, opt)
+			return
+		}
+		if !t.us[opt] {
+			t.us[opt] = true
+			if !t.askedUs[opt] {
+				t.command(telnetIAC, telnetWILL, opt)
+			}
+			if opt == telnetOptMCCP2 {
+				t.startCompression()
+			}
+		}
+		t.askedUs[opt] = false
+	case telnetDONT:
+		t.askedUs[opt] = false
+		if t.us[opt] {
+			t.us[opt] = false
+			if opt == telnetOptMCCP2 {
+				t.endCompression()
+			}
+			t.command(telnetIAC, telnetWONT, opt)
+		}
+	}
+}
+
+// subnegotiation handles a window size or terminal type report, or a
+// GMCP message.
+func (t *telnetConn) subnegotiation(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if b[0] == telnetOptGMCP {
+		if err := t.gmcp.receive(b[1:]); err != nil {
+			log.Printf("GMCP from %s: %v", t.RemoteAddr(), err)
+		}
+		return
+	}
+	t.Lock()
+	switch b[0] {
+	case telnetOptNAWS:
+		if len(b) != 5 {
+			break
+		}
+		t.cols = int(b[1])<<8 | int(b[2])
+		t.rows = int(b[3])<<8 | int(b[4])
+		if fn := t.onResize; fn != nil {
+			cols, rows := t.cols, t.rows
+			t.Unlock()
+			fn(cols, rows)
+			return
+		}
+	case telnetOptTType:
+		if len(b) < 2 || b[1] != ttypeIS {
+			break
+		}
+		name := string(b[2:])
+		// MTTS clients cycle through their client name, terminal type
+		// and capabilities; others repeat themselves.
+		if n := len(t.ttypes); n > 0 && t.ttypes[n-1] == name {
+			break
+		}
+		t.ttypes = append(t.ttypes, name)
+		if strings.HasPrefix(name, "MTTS ") {
+			if v, err := strconv.Atoi(name[5:]); err == nil {
+				t.mtts = v
+			}
+		} else if len(t.ttypes) < 3 {
+			t.command(telnetIAC, telnetSB, telnetOptTType, ttypeSEND, telnetIAC, telnetSE)
+		}
+	}
+	t.Unlock()
+}
+
+// hideInput asks the client to stop (or resume) echoing what's typed, by
+// offering to do the echoing ourselves.
+func (t *telnetConn) hideInput(hide bool) error {
+	t.Lock()
+	defer t.Unlock()
+	t.wantUs[telnetOptEcho] = hide
+	if hide {
+		if t.us[telnetOptEcho] || t.askedUs[telnetOptEcho] {
+			return nil
+		}
+		t.askedUs[telnetOptEcho] = true
+		return t.command(telnetIAC, telnetWILL, telnetOptEcho)
+	}
+	if !t.us[telnetOptEcho] && !t.askedUs[telnetOptEcho] {
+		return nil
+	}
+	t.us[telnetOptEcho] = false
+	t.askedUs[telnetOptEcho] = false
+	return t.command(telnetIAC, telnetWONT, telnetOptEcho)
+}
+
+// terminal returns the client's terminal type, its MTTS bits (or -1) and
+// its window size, as far as it has told us.
+func (t *telnetConn) terminal() (term string, mtts, cols, rows int) {
+	t.Lock()
+	defer t.Unlock()
+	for i, name := range t.ttypes {
+		if strings.HasPrefix(name, "MTTS ") {
+			break
+		}
+		term = strings.ToLower(name)
+		if i == 1 {
+			break
+		}
+	}
+	return term, t.mtts, t.cols, t.rows
+}
+
+// setResize sets a function to call with each new window size.
+func (t *telnetConn) setResize(fn func(cols, rows int)) {
+	t.Lock()
+	t.onResize = fn
+	t.Unlock()
+}
+
+// readLine reads a line of input, for logging in.  If hide is set, it
+// asks the client not to echo it.
+func (t *telnetConn) readLine(hide bool) (string, error) {
+	if hide {
+		t.hideInput(true)
+		defer func() {
+			t.hideInput(false)
+			fmt.Fprint(t, "\r\n")
+		}()
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := t.Read(b); err != nil {
+			return "", err
+		}
+		switch c := b[0]; c {
+		case t.enter:
+			return string(line), nil
+		case 0x08, 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		default:
+			if c >= ' ' && len(line) < maxLineLength {
+				line = append(line, c)
+			}
+		}
+	}
+}
+
+func (srv *server) handleTelnetConnection(conn net.Conn) {
+	t := newTelnetConn(conn, srv.cfg.Network.TelnetCompression)
+	if !srv.addConn(t) {
+		conn.Close()
+		return
+	}
+	defer srv.removeConn(t)
+
+	conn.SetDeadline(time.Now().Add(srv.cfg.Network.HandshakeTimeout))
+	if err := t.negotiate(); err != nil {
+		conn.Close()
+		return
+	}
+	acct, authMethod, err := srv.promptLogin(t, conn, "telnet")
+	if err != nil {
+		log.Printf("Telnet login from %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("%q (account %s) connected from %s with %s over telnet", acct.Name,
+		acct.ID, conn.RemoteAddr(), authMethod)
+
+	term, mtts, cols, rows := t.terminal()
+	cols = clampSize(uint32(cols), defaultColumns)
+	rows = clampSize(uint32(rows), defaultRows)
+
+	var screen tcell.Screen
+	color := headlesstcell.TrueColorAuto
+	if mtts >= 0 && mtts&mttsTrueColor != 0 {
+		color = headlesstcell.TrueColorOn
+	}
+	lineMode := mtts >= 0 && (mtts&mttsScreenReader != 0 || mtts&(mttsANSI|mttsVT100) == 0)
+	if !lineMode {
+		charset := "UTF-8"
+		if mtts >= 0 && mtts&mttsUTF8 == 0 {
+			charset = "US-ASCII"
+		}
+		screen, err = srv.newScreen(t, term, cols, rows, headlesstcell.Options{
+			// Clients may send a bare LF for enter.
+			Modes:     headlesstcell.TermModes{headlesstcell.ModeICRNL: 1},
+			Charset:   charset,
+			TrueColor: screenColor(acct.Color, color),
+		})
+		if err != nil {
+			log.Printf("Failed to make a screen for %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		t.enter = '\r'
+		t.hideInput(true)
+	}
+
+	sess := newSession(srv, acct, authMethod, conn.RemoteAddr(), term, cols, rows, screen)
+	if screen == nil {
+		sess.text = &textConn{w: t, crlf: true}
+	}
+	sess.telnet = t
+	sess.gmcp = t.gmcp
+	sess.color = color
+	if !srv.startSession(sess) {
+		fmt.Fprint(t, "The server is shutting down.\r\n")
+		conn.Close()
+		return
+	}
+	if screen != nil {
+		if err := screen.Init(); err != nil {
+			srv.endSession(sess)
+			conn.Close()
+			return
+		}
+		t.setResize(func(cols, rows int) {
+			cols = clampSize(uint32(cols), defaultColumns)
+			rows = clampSize(uint32(rows), defaultRows)
+			if wr, ok := screen.(interface{ Winch(w, h int) }); ok {
+				wr.Winch(cols, rows)
+			}
+			sess.setSize(cols, rows)
+		})
+	}
+	srv.playSession(sess, t, func() {
+		t.endCompression()
+		conn.Close()
+	})
+	if sent, wire := t.compressionStats(); wire < sent {
+		log.Printf("Compressed %d bytes to %d (%.0f%%) for %s", sent, wire,
+			100*float64(wire)/float64(sent), conn.RemoteAddr())
+	}
+}
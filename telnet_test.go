@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// pipeConn is a client that sends its input, then hangs up, and records
+// what it's sent.
+type pipeConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+func (c *pipeConn) RemoteAddr() net.Addr        { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000} }
+
+func newTestTelnet(input string) (*telnetConn, *pipeConn) {
+	c := &pipeConn{in: strings.NewReader(input)}
+	return newTelnetConn(c, false), c
+}
+
+func TestTelnetRead(t *testing.T) {
+	const (
+		iac  = "\xff"
+		sb   = iac + "\xfa"
+		se   = iac + "\xf0"
+		naws = "\x1f"
+	)
+	tests := []struct {
+		name       string
+		in         string
+		want       string // data read
+		reply      string // what's sent back
+		cols, rows int
+	}{
+		{name: "plain", in: "look", want: "look"},
+		{name: "CR LF", in: "n\r\ns\r\n", want: "n\ns\n"},
+		{name: "CR NUL", in: "n\r\x00s", want: "n\ns"},
+		{name: "bare LF", in: "n\ns\n", want: "n\ns\n"},
+		{name: "bare CR", in: "n\rs", want: "n\ns"},
+		{name: "escaped IAC", in: "a" + iac + iac + "b", want: "a\xffb"},
+		{name: "IAC at the end", in: "a" + iac, want: "a"},
+		{name: "NOP and GA", in: "a" + iac + "\xf1b" + iac + "\xf9", want: "ab"},
+		{name: "NAWS", in: sb + naws + "\x00\x50\x00\x18" + se + "x", want: "x", cols: 80, rows: 24},
+		{
+			name: "NAWS with escaped IAC",
+			in:   sb + naws + "\x00" + iac + iac + "\x01" + iac + iac + se,
+			cols: 255, rows: 511,
+		},
+		{name: "NAWS too short", in: sb + naws + "\x00\x50\x00" + se + "x", want: "x"},
+		{name: "NAWS too long", in: sb + naws + "\x00\x50\x00\x18\x00" + se + "x", want: "x"},
+		{name: "truncated subnegotiation", in: "a" + sb + naws + "\x00\x50", want: "a"},
+		{name: "truncated after IAC", in: "a" + sb + naws + "\x00\x50\x00\x18" + iac, want: "a"},
+		{
+			// A command other than SE ends the subnegotiation, which
+			// is dropped.
+			name: "aborted subnegotiation",
+			in:   sb + naws + "\x00\x50\x00\x18" + iac + "\xf1" + "x",
+			want: "x",
+		},
+		{name: "empty subnegotiation", in: sb + se + "x", want: "x"},
+		{
+			// What's kept of it is still too long for NAWS.
+			name: "oversized subnegotiation",
+			in:   sb + naws + strings.Repeat("\x00\x50", maxSubnegotiation) + se + "y",
+			want: "y",
+		},
+		{name: "will NAWS", in: iac + "\xfb" + naws, reply: iac + "\xfd" + naws},
+		{name: "will unknown", in: iac + "\xfb\x2a", reply: iac + "\xfe\x2a"},
+		{name: "do unknown", in: iac + "\xfd\x2a", reply: iac + "\xfc\x2a"},
+		{name: "won't what we don't have", in: iac + "\xfc" + naws},
+		{name: "option at the end", in: iac + "\xfb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, c := newTestTelnet(tt.in)
+			got, err := io.ReadAll(tc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if c.out.String() != tt.reply {
+				t.Errorf("replied %q, want %q", c.out.String(), tt.reply)
+			}
+			if _, _, cols, rows := tc.terminal(); cols != tt.cols || rows != tt.rows {
+				t.Errorf("size %dx%d, want %dx%d", cols, rows, tt.cols, tt.rows)
+			}
+		})
+	}
+}
+
+func TestTelnetResize(t *testing.T) {
+	tc, _ := newTestTelnet("\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0\xff\xfa\x1f\x00\x84\x00\x2b\xff\xf0")
+	var sizes [][2]int
+	tc.setResize(func(cols, rows int) {
+		sizes = append(sizes, [2]int{cols, rows})
+	})
+	io.ReadAll(tc)
+	if len(sizes) != 2 || sizes[0] != [2]int{80, 24} || sizes[1] != [2]int{132, 43} {
+		t.Errorf("resized to %v", sizes)
+	}
+}
+
+func TestTelnetWrite(t *testing.T) {
+	tc, c := newTestTelnet("")
+	n, err := tc.Write([]byte("a\xffb\xff"))
+	if err != nil || n != 4 {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if got := c.out.String(); got != "a\xff\xffb\xff\xff" {
+		t.Errorf("sent %q", got)
+	}
+}
+
+// ttypeIs is a client's answer to a TTYPE SEND.
+func ttypeIs(name string) string {
+	return "\xff\xfa\x18\x00" + name + "\xff\xf0"
+}
+
+const ttypeSend = "\xff\xfa\x18\x01\xff\xf0"
+
+func TestTelnetTerminalType(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		term  string
+		mtts  int
+		sends int // TTYPE SENDs in reply
+	}{
+		{
+			name:  "MTTS",
+			in:    "\xff\xfb\x18" + ttypeIs("MUDLET") + ttypeIs("XTERM-256COLOR") + ttypeIs("MTTS 137"),
+			term:  "xterm-256color",
+			mtts:  137,
+			sends: 3,
+		},
+		{
+			// The client's name is taken as its terminal type only if
+			// it has nothing else to say.
+			name:  "repeated",
+			in:    "\xff\xfb\x18" + ttypeIs("XTERM") + ttypeIs("XTERM"),
+			term:  "xterm",
+			mtts:  -1,
+			sends: 2,
+		},
+		{
+			name:  "cycled back",
+			in:    "\xff\xfb\x18" + ttypeIs("TINTIN++") + ttypeIs("ANSI") + ttypeIs("TINTIN++"),
+			term:  "ansi",
+			mtts:  -1,
+			sends: 3,
+		},
+		{
+			name:  "MTTS first",
+			in:    "\xff\xfb\x18" + ttypeIs("MTTS 9"),
+			term:  "",
+			mtts:  9,
+			sends: 1,
+		},
+		{
+			name:  "bad MTTS",
+			in:    "\xff\xfb\x18" + ttypeIs("VT100") + ttypeIs("MTTS lots"),
+			term:  "vt100",
+			mtts:  -1,
+			sends: 2,
+		},
+		{
+			name: "SEND from the client",
+			in:   "\xff\xfa\x18\x01\xff\xf0",
+			mtts: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, c := newTestTelnet(tt.in)
+			io.ReadAll(tc)
+			term, mtts, _, _ := tc.terminal()
+			if term != tt.term || mtts != tt.mtts {
+				t.Errorf("terminal %q, MTTS %d, want %q, %d", term, mtts, tt.term, tt.mtts)
+			}
+			if n := strings.Count(c.out.String(), ttypeSend); n != tt.sends {
+				t.Errorf("asked for the terminal type %d times, want %d", n, tt.sends)
+			}
+		})
+	}
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	// The client agrees to everything we ask for, and asks us for
+	// SGA, which we've already offered.
+	tc, c := newTestTelnet("\xff\xfb\x18\xff\xfb\x1f\xff\xfd\x03")
+	if err := tc.negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(tc)
+	want := "\xff\xfd\x18\xff\xfd\x1f\xff\xfb\x03\xff\xfb\xc9" + ttypeSend
+	if c.out.String() != want {
+		t.Errorf("sent %q, want %q", c.out.String(), want)
+	}
+	if !tc.him[telnetOptTType] || !tc.him[telnetOptNAWS] || !tc.us[telnetOptSGA] {
+		t.Error("options not enabled")
+	}
+
+	// Hiding input offers ECHO once, and showing it withdraws it.
+	c.out.Reset()
+	tc.hideInput(true)
+	tc.hideInput(true)
+	tc.hideInput(false)
+	tc.hideInput(false)
+	if want := "\xff\xfb\x01\xff\xfc\x01"; c.out.String() != want {
+		t.Errorf("sent %q, want %q", c.out.String(), want)
+	}
+}
+
+func FuzzTelnetRead(f *testing.F) {
+	f.Add([]byte("look\r\n"))
+	f.Add([]byte("a\xff\xffb\r\x00"))
+	f.Add([]byte("\xff\xfa\x1f\x00\xff\xff\x00\x18\xff\xf0"))
+	f.Add([]byte("\xff\xfb\x18" + ttypeIs("MUDLET") + ttypeIs("MTTS 137")))
+	f.Add([]byte("\xff\xfa\x1f\x00\x50"))
+	f.Fuzz(func(t *testing.T, in []byte) {
+		tc, _ := newTestTelnet(string(in))
+		got, err := io.ReadAll(tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) > len(in) {
+			t.Fatalf("read %d bytes from %d", len(got), len(in))
+		}
+		if !bytes.ContainsAny(in, "\xff\r") && !bytes.Equal(got, in) {
+			t.Fatalf("read %q from %q, which has no commands", got, in)
+		}
+		if _, _, cols, rows := tc.terminal(); cols > 0xffff || rows > 0xffff || cols < 0 || rows < 0 {
+			t.Fatalf("size %dx%d", cols, rows)
+		}
+	})
+}
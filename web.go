@@ -0,0 +1,245 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/redbo/mudengine/headlesstcell"
+)
+
+// webFiles is the browser client: a page with a terminal that plays over
+// a WebSocket.
+//
+//go:embed web
+var webFiles embed.FS
+
+// webTerm is the terminal type the browser client emulates.
+const webTerm = "xterm-256color"
+
+// maxWebMessage limits the size of a message from the browser, which is
+// usually a keystroke or a paste.
+const maxWebMessage = 16384
+
+// webUpgrader upgrades requests to WebSockets.  Its default origin check
+// only lets our own page connect.
+var webUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// webControl is a control message from the browser, sent as a text
+// message; what's typed is sent as binary messages.
+type webControl struct {
+	Type string `json:"type"` // "resize"
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// webConn presents a WebSocket from the browser client as an
+// io.ReadWriter carrying the terminal's data.  Read handles control
+// messages as they arrive.
+type webConn struct {
+	ws *websocket.Conn
+	r  io.Reader // the rest of the current data message
+
+	// guarded by the mutex
+	onResize func(cols, rows int)
+	sync.Mutex
+
+	wmu sync.Mutex
+}
+
+func newWebConn(ws *websocket.Conn) *webConn {
+	ws.SetReadLimit(maxWebMessage)
+	return &webConn{ws: ws}
+}
+
+func (w *webConn) Read(p []byte) (int, error) {
+	for {
+		if w.r != nil {
+			n, err := w.r.Read(p)
+			if err == io.EOF {
+				w.r = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+		typ, r, err := w.ws.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		if typ == websocket.BinaryMessage {
+			w.r = r
+			continue
+		}
+		var msg webControl
+		if err := json.NewDecoder(r).Decode(&msg); err != nil {
+			return 0, fmt.Errorf("bad control message: %v", err)
+		}
+		if msg.Type == "resize" {
+			w.Lock()
+			fn := w.onResize
+			w.Unlock()
+			if fn != nil {
+				fn(msg.Cols, msg.Rows)
+			}
+		}
+	}
+}
+
+func (w *webConn) Write(p []byte) (int, error) {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if err := w.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close says goodbye to the browser and closes the WebSocket.
+func (w *webConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	w.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return w.ws.Close()
+}
+
+// setResize sets a function to call with each new window size.
+func (w *webConn) setResize(fn func(cols, rows int)) {
+	w.Lock()
+	w.onResize = fn
+	w.Unlock()
+}
+
+// readLine reads a line of input, for logging in.  The browser doesn't
+// echo what's typed, so we do, unless hide is set.
+func (w *webConn) readLine(hide bool) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := w.Read(b); err != nil {
+			return "", err
+		}
+		switch c := b[0]; c {
+		case '\r', '\n':
+			w.Write([]byte("\r\n"))
+			return string(line), nil
+		case 0x08, 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				if !hide {
+					w.Write([]byte("\b \b"))
+				}
+			}
+		default:
+			if c >= ' ' && len(line) < maxLineLength {
+				line = append(line, c)
+				if !hide {
+					w.Write(b)
+				}
+			}
+		}
+	}
+}
+
+// webHandler serves the browser client's files, and its WebSocket on
+// /ws.
+func (srv *server) webHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(files)))
+	mux.HandleFunc("/ws", srv.handleWebSocket)
+	return mux
+}
+
+// handleWebSocket admits a browser client and plays its session.  The
+// page gives its terminal size in the cols and rows parameters.
+func (srv *server) handleWebSocket(rw http.ResponseWriter, req *http.Request) {
+	ws, err := webUpgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		// Upgrade has replied with the error.
+		return
+	}
+	conn := ws.UnderlyingConn()
+	if err := srv.admit(conn); err != nil {
+		log.Printf("Refused connection from %s: %v", conn.RemoteAddr(), err)
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+	defer srv.release()
+	cols, _ := strconv.ParseUint(req.FormValue("cols"), 10, 32)
+	rows, _ := strconv.ParseUint(req.FormValue("rows"), 10, 32)
+	srv.handleWebConnection(newWebConn(ws), conn,
+		clampSize(uint32(cols), defaultColumns), clampSize(uint32(rows), defaultRows))
+}
+
+func (srv *server) handleWebConnection(w *webConn, conn net.Conn, cols, rows int) {
+	if !srv.addConn(w) {
+		w.Close()
+		return
+	}
+	defer srv.removeConn(w)
+
+	conn.SetDeadline(time.Now().Add(srv.cfg.Network.HandshakeTimeout))
+	acct, authMethod, err := srv.promptLogin(w, conn, "websocket")
+	if err != nil {
+		log.Printf("Browser login from %s failed: %v", conn.RemoteAddr(), err)
+		w.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("%q (account %s) connected from %s with %s over websocket", acct.Name,
+		acct.ID, conn.RemoteAddr(), authMethod)
+
+	// The browser's terminal does 24-bit color and all the attributes.
+	color := headlesstcell.TrueColorOn
+	screen, err := srv.newScreen(w, webTerm, cols, rows, headlesstcell.Options{
+		Charset:     "UTF-8",
+		TrueColor:   screenColor(acct.Color, color),
+		ExtendedSGR: true,
+	})
+	if err != nil {
+		log.Printf("Failed to make a screen for %s: %v", conn.RemoteAddr(), err)
+		w.Close()
+		return
+	}
+	sess := newSession(srv, acct, authMethod, conn.RemoteAddr(), webTerm, cols, rows, screen)
+	sess.color = color
+	if !srv.startSession(sess) {
+		fmt.Fprint(w, "The server is shutting down.\r\n")
+		w.Close()
+		return
+	}
+	if err := screen.Init(); err != nil {
+		srv.endSession(sess)
+		w.Close()
+		return
+	}
+	w.setResize(func(cols, rows int) {
+		cols = clampSize(uint32(cols), defaultColumns)
+		rows = clampSize(uint32(rows), defaultRows)
+		if wr, ok := screen.(interface{ Winch(w, h int) }); ok {
+			wr.Winch(cols, rows)
+		}
+		sess.setSize(cols, rows)
+	})
+	srv.playSession(sess, w, func() { w.Close() })
+}
@@ -0,0 +1,97 @@
+// Connects the terminal to the server's WebSocket.  What's typed goes as
+// binary messages; size changes go as JSON text messages.
+"use strict";
+
+(function () {
+	const el = document.getElementById("term");
+	const input = document.getElementById("input");
+
+	// size returns how many characters fit in the terminal element.
+	function size() {
+		const probe = document.createElement("span");
+		probe.textContent = "W".repeat(100);
+		probe.style.visibility = "hidden";
+		el.appendChild(probe);
+		const rect = probe.getBoundingClientRect();
+		el.removeChild(probe);
+		const style = getComputedStyle(el);
+		const width = el.clientWidth - parseFloat(style.paddingLeft) - parseFloat(style.paddingRight);
+		const height = el.clientHeight - parseFloat(style.paddingTop) - parseFloat(style.paddingBottom);
+		const lineHeight = parseFloat(style.lineHeight) || rect.height;
+		return {
+			cols: Math.max(20, Math.floor(width / (rect.width / 100))),
+			rows: Math.max(5, Math.floor(height / lineHeight)),
+		};
+	}
+
+	let { cols, rows } = size();
+	const term = new Terminal(el, cols, rows);
+	const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+	const ws = new WebSocket(scheme + "//" + location.host + "/ws?cols=" + cols + "&rows=" + rows);
+	ws.binaryType = "arraybuffer";
+	const encoder = new TextEncoder();
+	const decoder = new TextDecoder();
+
+	function send(s) {
+		if (ws.readyState === WebSocket.OPEN) {
+			ws.send(encoder.encode(s));
+		}
+	}
+	term.onData = send;
+
+	ws.onmessage = (e) => {
+		if (e.data instanceof ArrayBuffer) {
+			term.write(decoder.decode(e.data, { stream: true }));
+		}
+	};
+	ws.onclose = (e) => {
+		term.write("\x1b[0m\r\n\r\n[Disconnected" + (e.reason ? ": " + e.reason : "") + "]\r\n");
+	};
+
+	window.addEventListener("resize", () => {
+		const s = size();
+		if (s.cols === term.cols && s.rows === term.rows) {
+			return;
+		}
+		term.resize(s.cols, s.rows);
+		if (ws.readyState === WebSocket.OPEN) {
+			ws.send(JSON.stringify({ type: "resize", cols: s.cols, rows: s.rows }));
+		}
+	});
+
+	input.addEventListener("keydown", (e) => {
+		if (e.isComposing) {
+			return;
+		}
+		const s = term.key(e);
+		if (s !== null) {
+			e.preventDefault();
+			send(s);
+		}
+	});
+	// Phones and input methods type without useful keydowns.
+	input.addEventListener("input", (e) => {
+		if (!e.isComposing && input.value !== "") {
+			send(input.value);
+			input.value = "";
+		}
+	});
+	input.addEventListener("compositionend", () => {
+		send(input.value);
+		input.value = "";
+	});
+	input.addEventListener("paste", (e) => {
+		e.preventDefault();
+		send(term.paste(e.clipboardData.getData("text/plain")));
+	});
+
+	input.addEventListener("focus", () => el.classList.add("focused"));
+	input.addEventListener("blur", () => el.classList.remove("focused"));
+	el.addEventListener("mouseup", () => {
+		// Let a selection be copied before taking focus.
+		if (window.getSelection().toString() === "") {
+			input.focus();
+		}
+	});
+	input.focus();
+})();
@@ -0,0 +1,839 @@
+// A small terminal emulator: the part of xterm that the server's screens
+// use, drawn as rows of styled spans.
+"use strict";
+
+const ATTR_BOLD = 1;
+const ATTR_DIM = 2;
+const ATTR_ITALIC = 4;
+const ATTR_UNDERLINE = 8;
+const ATTR_BLINK = 16;
+const ATTR_REVERSE = 32;
+const ATTR_INVISIBLE = 64;
+const ATTR_STRIKE = 128;
+const ATTR_OVERLINE = 256;
+// How underlined text is underlined, with ATTR_UNDERLINE.
+const ATTR_DOUBLE = 512;
+const ATTR_CURLY = 1024;
+const ATTR_DOTTED = 2048;
+const ATTR_DASHED = 4096;
+const UNDERLINES = ATTR_UNDERLINE | ATTR_DOUBLE | ATTR_CURLY | ATTR_DOTTED | ATTR_DASHED;
+
+// The xterm 256 color palette.
+const PALETTE = (function () {
+	const p = [
+		"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+		"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+	];
+	const hex = (v) => v.toString(16).padStart(2, "0");
+	const steps = [0, 95, 135, 175, 215, 255];
+	for (let r = 0; r < 6; r++) {
+		for (let g = 0; g < 6; g++) {
+			for (let b = 0; b < 6; b++) {
+				p.push("#" + hex(steps[r]) + hex(steps[g]) + hex(steps[b]));
+			}
+		}
+	}
+	for (let i = 0; i < 24; i++) {
+		p.push("#" + hex(8 + i * 10).repeat(3));
+	}
+	return p;
+})();
+
+const DEFAULT_FG = "#d0d0d0";
+const DEFAULT_BG = "#000000";
+
+// isWide reports whether code point c takes two cells.
+function isWide(c) {
+	return c >= 0x1100 && (c <= 0x115f ||
+		(c >= 0x2e80 && c <= 0xa4cf && c !== 0x303f) ||
+		(c >= 0xac00 && c <= 0xd7a3) ||
+		(c >= 0xf900 && c <= 0xfaff) ||
+		(c >= 0xfe30 && c <= 0xfe4f) ||
+		(c >= 0xff00 && c <= 0xff60) ||
+		(c >= 0xffe0 && c <= 0xffe6) ||
+		(c >= 0x1f300 && c <= 0x1f64f) ||
+		(c >= 0x1f900 && c <= 0x1f9ff) ||
+		(c >= 0x20000 && c <= 0x3fffd));
+}
+
+// isCombining reports whether code point c joins the character before it.
+function isCombining(c) {
+	return (c >= 0x300 && c <= 0x36f) || (c >= 0x200b && c <= 0x200f) ||
+		(c >= 0xfe00 && c <= 0xfe0f) || (c >= 0x20d0 && c <= 0x20ff);
+}
+
+class Terminal {
+	constructor(el, cols, rows) {
+		this.el = el;
+		this.cols = cols;
+		this.rows = rows;
+		this.onData = null; // called with replies to queries
+		this.reset();
+	}
+
+	reset() {
+		this.fg = -1; // -1 for the default, a palette index, or "#rrggbb"
+		this.bg = -1;
+		this.ul = -1; // the underline color
+		this.attrs = 0;
+		this.x = 0;
+		this.y = 0;
+		this.wrapNext = false;
+		this.last = null; // the last character printed, for REP
+		this.saved = null;
+		this.top = 0;
+		this.bottom = this.rows - 1;
+		this.autowrap = true;
+		this.cursorVisible = true;
+		this.appCursor = false;
+		this.bracketedPaste = false;
+		this.state = "data";
+		this.params = "";
+		this.main = this.blankLines(this.rows);
+		this.alt = null;
+		this.lines = this.main;
+		this.buildRows();
+	}
+
+	blankCell() {
+		return { ch: " ", fg: -1, bg: this.bg, ul: -1, attrs: 0 };
+	}
+
+	blankLine() {
+		const line = [];
+		for (let i = 0; i < this.cols; i++) {
+			line.push(this.blankCell());
+		}
+		return line;
+	}
+
+	blankLines(n) {
+		const lines = [];
+		for (let i = 0; i < n; i++) {
+			lines.push(this.blankLine());
+		}
+		return lines;
+	}
+
+	buildRows() {
+		this.el.textContent = "";
+		this.rowEls = [];
+		for (let y = 0; y < this.rows; y++) {
+			const row = document.createElement("div");
+			row.className = "row";
+			this.el.appendChild(row);
+			this.rowEls.push(row);
+		}
+		this.dirty = new Set();
+		for (let y = 0; y < this.rows; y++) {
+			this.dirty.add(y);
+		}
+		this.scheduleRender();
+	}
+
+	// resize changes the size, keeping what fits.
+	resize(cols, rows) {
+		if (cols === this.cols && rows === this.rows) {
+			return;
+		}
+		this.cols = cols;
+		this.rows = rows;
+		const fit = (lines) => {
+			lines = lines.slice(0, rows);
+			for (const line of lines) {
+				line.length = Math.min(line.length, cols);
+				while (line.length < cols) {
+					line.push(this.blankCell());
+				}
+			}
+			while (lines.length < rows) {
+				lines.push(this.blankLine());
+			}
+			return lines;
+		};
+		const wasAlt = this.lines === this.alt;
+		this.main = fit(this.main);
+		if (this.alt) {
+			this.alt = fit(this.alt);
+		}
+		this.lines = wasAlt ? this.alt : this.main;
+		this.top = 0;
+		this.bottom = rows - 1;
+		this.x = Math.min(this.x, cols - 1);
+		this.y = Math.min(this.y, rows - 1);
+		this.wrapNext = false;
+		this.buildRows();
+	}
+
+	markDirty(y) {
+		this.dirty.add(y);
+		this.scheduleRender();
+	}
+
+	markAll(from, to) {
+		for (let y = from; y <= to; y++) {
+			this.dirty.add(y);
+		}
+		this.scheduleRender();
+	}
+
+	scheduleRender() {
+		if (!this.renderPending) {
+			this.renderPending = true;
+			requestAnimationFrame(() => this.render());
+		}
+	}
+
+	// write interprets s, a string of output from the server.
+	write(s) {
+		const oldY = this.y;
+		for (const ch of s) {
+			this.feed(ch);
+		}
+		this.markDirty(oldY);
+		this.markDirty(this.y);
+	}
+
+	feed(ch) {
+		const c = ch.codePointAt(0);
+		switch (this.state) {
+		case "esc":
+			this.escape(ch);
+			return;
+		case "charset":
+			this.state = "data";
+			return;
+		case "csi":
+			if (c >= 0x30 && c <= 0x3f) {
+				this.params += ch;
+			} else if (c >= 0x20 && c <= 0x2f) {
+				this.intermediate += ch;
+			} else if (c >= 0x40 && c <= 0x7e) {
+				this.state = "data";
+				this.csi(ch);
+			} else if (c === 0x1b) {
+				this.state = "esc";
+			}
+			return;
+		case "osc":
+			if (c === 0x07) {
+				this.state = "data";
+			} else if (c === 0x1b) {
+				this.state = "oscEsc";
+			}
+			return;
+		case "oscEsc":
+			this.state = ch === "\\" ? "data" : "osc";
+			return;
+		}
+		if (c < 0x20 || c === 0x7f) {
+			this.control(c);
+		} else if (isCombining(c)) {
+			const x = this.x > 0 ? this.x - 1 : 0;
+			this.lines[this.y][x].ch += ch;
+		} else {
+			this.put(ch, isWide(c) ? 2 : 1);
+		}
+	}
+
+	control(c) {
+		switch (c) {
+		case 0x08:
+			if (this.x > 0) {
+				this.x--;
+			}
+			this.wrapNext = false;
+			break;
+		case 0x09:
+			this.x = Math.min(this.cols - 1, (Math.floor(this.x / 8) + 1) * 8);
+			break;
+		case 0x0a:
+		case 0x0b:
+		case 0x0c:
+			this.lineFeed();
+			break;
+		case 0x0d:
+			this.x = 0;
+			this.wrapNext = false;
+			break;
+		case 0x1b:
+			this.state = "esc";
+			break;
+		}
+	}
+
+	put(ch, width) {
+		this.last = ch;
+		if (this.wrapNext) {
+			this.wrapNext = false;
+			this.x = 0;
+			this.lineFeed();
+		}
+		if (width === 2 && this.x === this.cols - 1) {
+			if (!this.autowrap) {
+				return;
+			}
+			this.lines[this.y][this.x] = this.blankCell();
+			this.x = 0;
+			this.lineFeed();
+		}
+		const line = this.lines[this.y];
+		line[this.x] = { ch: ch, fg: this.fg, bg: this.bg, ul: this.ul, attrs: this.attrs };
+		if (width === 2) {
+			line[this.x + 1] = { ch: "", fg: this.fg, bg: this.bg, ul: this.ul, attrs: this.attrs };
+		}
+		this.markDirty(this.y);
+		if (this.x + width >= this.cols) {
+			this.x = this.cols - 1;
+			this.wrapNext = this.autowrap;
+		} else {
+			this.x += width;
+		}
+	}
+
+	lineFeed() {
+		this.wrapNext = false;
+		if (this.y === this.bottom) {
+			this.scrollUp(1);
+		} else if (this.y < this.rows - 1) {
+			this.y++;
+		}
+	}
+
+	reverseIndex() {
+		if (this.y === this.top) {
+			this.scrollDown(1);
+		} else if (this.y > 0) {
+			this.y--;
+		}
+	}
+
+	// scrollUp scrolls the scroll region up n lines.
+	scrollUp(n, from) {
+		from = from === undefined ? this.top : from;
+		n = Math.min(n, this.bottom - from + 1);
+		this.lines.splice(from, n);
+		for (let i = 0; i < n; i++) {
+			this.lines.splice(this.bottom - n + 1 + i, 0, this.blankLine());
+		}
+		this.markAll(from, this.bottom);
+	}
+
+	// scrollDown scrolls the scroll region down n lines.
+	scrollDown(n, from) {
+		from = from === undefined ? this.top : from;
+		n = Math.min(n, this.bottom - from + 1);
+		this.lines.splice(this.bottom - n + 1, n);
+		for (let i = 0; i < n; i++) {
+			this.lines.splice(from, 0, this.blankLine());
+		}
+		this.markAll(from, this.bottom);
+	}
+
+	escape(ch) {
+		this.state = "data";
+		switch (ch) {
+		case "[":
+			this.state = "csi";
+			this.params = "";
+			this.intermediate = "";
+			break;
+		case "]":
+			this.state = "osc";
+			break;
+		case "(":
+		case ")":
+		case "*":
+		case "+":
+			this.state = "charset";
+			break;
+		case "7":
+			this.saveCursor();
+			break;
+		case "8":
+			this.restoreCursor();
+			break;
+		case "D":
+			this.lineFeed();
+			break;
+		case "E":
+			this.x = 0;
+			this.lineFeed();
+			break;
+		case "M":
+			this.reverseIndex();
+			break;
+		case "c":
+			this.reset();
+			break;
+		}
+		// ESC = and ESC > switch the keypad mode, which we don't have.
+	}
+
+	saveCursor() {
+		this.saved = { x: this.x, y: this.y, fg: this.fg, bg: this.bg, ul: this.ul, attrs: this.attrs };
+	}
+
+	restoreCursor() {
+		const s = this.saved;
+		if (s) {
+			this.x = Math.min(s.x, this.cols - 1);
+			this.y = Math.min(s.y, this.rows - 1);
+			this.fg = s.fg;
+			this.bg = s.bg;
+			this.ul = s.ul;
+			this.attrs = s.attrs;
+		}
+		this.wrapNext = false;
+	}
+
+	csi(final) {
+		const priv = this.params.startsWith("?");
+		const args = (priv ? this.params.slice(1) : this.params).split(";")
+			.map((v) => parseInt(v, 10));
+		const arg = (i, def) => (args[i] > 0 ? args[i] : def);
+		if (final === "b") {
+			// REP, which wraps like the characters it repeats
+			if (this.last !== null) {
+				const width = isWide(this.last.codePointAt(0)) ? 2 : 1;
+				for (let n = Math.min(arg(0, 1), this.cols * this.rows); n > 0; n--) {
+					this.put(this.last, width);
+				}
+			}
+			return;
+		}
+		const oldY = this.y;
+		this.wrapNext = false;
+		switch (final) {
+		case "A":
+			this.y = Math.max(this.y < this.top ? 0 : this.top, this.y - arg(0, 1));
+			break;
+		case "B":
+			this.y = Math.min(this.y > this.bottom ? this.rows - 1 : this.bottom, this.y + arg(0, 1));
+			break;
+		case "C":
+			this.x = Math.min(this.cols - 1, this.x + arg(0, 1));
+			break;
+		case "D":
+			this.x = Math.max(0, this.x - arg(0, 1));
+			break;
+		case "E":
+			this.x = 0;
+			this.y = Math.min(this.rows - 1, this.y + arg(0, 1));
+			break;
+		case "F":
+			this.x = 0;
+			this.y = Math.max(0, this.y - arg(0, 1));
+			break;
+		case "G":
+		case "`":
+			this.x = Math.min(this.cols - 1, arg(0, 1) - 1);
+			break;
+		case "d":
+			this.y = Math.min(this.rows - 1, arg(0, 1) - 1);
+			break;
+		case "H":
+		case "f":
+			this.y = Math.min(this.rows - 1, arg(0, 1) - 1);
+			this.x = Math.min(this.cols - 1, arg(1, 1) - 1);
+			break;
+		case "J":
+			this.eraseDisplay(args[0] || 0);
+			break;
+		case "K":
+			this.eraseLine(args[0] || 0);
+			break;
+		case "L":
+			if (this.y >= this.top && this.y <= this.bottom) {
+				this.scrollDown(arg(0, 1), this.y);
+			}
+			break;
+		case "M":
+			if (this.y >= this.top && this.y <= this.bottom) {
+				this.scrollUp(arg(0, 1), this.y);
+			}
+			break;
+		case "@":
+			this.insertChars(arg(0, 1));
+			break;
+		case "P":
+			this.deleteChars(arg(0, 1));
+			break;
+		case "X":
+			this.erase(this.y, this.x, Math.min(this.cols, this.x + arg(0, 1)));
+			break;
+		case "S":
+			this.scrollUp(arg(0, 1));
+			break;
+		case "T":
+			this.scrollDown(arg(0, 1));
+			break;
+		case "m":
+			this.sgr(this.params.split(";"));
+			break;
+		case "r":
+			this.setScrollRegion(arg(0, 1) - 1, arg(1, this.rows) - 1);
+			break;
+		case "s":
+			this.saveCursor();
+			break;
+		case "u":
+			this.restoreCursor();
+			break;
+		case "h":
+		case "l":
+			if (priv) {
+				for (const mode of args) {
+					this.setMode(mode, final === "h");
+				}
+			}
+			break;
+		case "n":
+			if (args[0] === 6 && this.onData) {
+				this.onData("\x1b[" + (this.y + 1) + ";" + (this.x + 1) + "R");
+			}
+			break;
+		case "c":
+			if (!priv && this.intermediate === "" && this.onData) {
+				this.onData("\x1b[?62;22c");
+			}
+			break;
+		}
+		this.markDirty(oldY);
+	}
+
+	setScrollRegion(top, bottom) {
+		bottom = Math.min(bottom, this.rows - 1);
+		if (top < bottom) {
+			this.top = top;
+			this.bottom = bottom;
+			this.x = 0;
+			this.y = 0;
+		}
+	}
+
+	setMode(mode, on) {
+		switch (mode) {
+		case 1:
+			this.appCursor = on;
+			break;
+		case 7:
+			this.autowrap = on;
+			break;
+		case 25:
+			this.cursorVisible = on;
+			break;
+		case 47:
+		case 1047:
+		case 1049:
+			if (on === (this.lines === this.alt)) {
+				break;
+			}
+			if (on) {
+				this.saveCursor();
+				this.alt = this.blankLines(this.rows);
+				this.lines = this.alt;
+			} else {
+				this.lines = this.main;
+				this.alt = null;
+				this.restoreCursor();
+			}
+			this.markAll(0, this.rows - 1);
+			break;
+		case 2004:
+			this.bracketedPaste = on;
+			break;
+		}
+	}
+
+	erase(y, from, to) {
+		const line = this.lines[y];
+		for (let x = from; x < to; x++) {
+			line[x] = this.blankCell();
+		}
+		this.markDirty(y);
+	}
+
+	eraseDisplay(mode) {
+		if (mode === 0) {
+			this.erase(this.y, this.x, this.cols);
+			for (let y = this.y + 1; y < this.rows; y++) {
+				this.erase(y, 0, this.cols);
+			}
+		} else if (mode === 1) {
+			for (let y = 0; y < this.y; y++) {
+				this.erase(y, 0, this.cols);
+			}
+			this.erase(this.y, 0, this.x + 1);
+		} else if (mode === 2 || mode === 3) {
+			for (let y = 0; y < this.rows; y++) {
+				this.erase(y, 0, this.cols);
+			}
+		}
+	}
+
+	eraseLine(mode) {
+		if (mode === 0) {
+			this.erase(this.y, this.x, this.cols);
+		} else if (mode === 1) {
+			this.erase(this.y, 0, this.x + 1);
+		} else if (mode === 2) {
+			this.erase(this.y, 0, this.cols);
+		}
+	}
+
+	insertChars(n) {
+		const line = this.lines[this.y];
+		n = Math.min(n, this.cols - this.x);
+		for (let i = 0; i < n; i++) {
+			line.splice(this.x, 0, this.blankCell());
+		}
+		line.length = this.cols;
+		this.markDirty(this.y);
+	}
+
+	deleteChars(n) {
+		const line = this.lines[this.y];
+		n = Math.min(n, this.cols - this.x);
+		line.splice(this.x, n);
+		for (let i = 0; i < n; i++) {
+			line.push(this.blankCell());
+		}
+		this.markDirty(this.y);
+	}
+
+	// sgr sets the attributes and colors of what's written next.  A field
+	// may have subparameters after colons, as in 4:3 for a curly underline
+	// and 58:2::255:0:0 for a red one.
+	sgr(fields) {
+		const UNDERLINE_STYLES = [0, ATTR_UNDERLINE, ATTR_DOUBLE, ATTR_CURLY, ATTR_DOTTED, ATTR_DASHED];
+		for (let i = 0; i < fields.length; i++) {
+			const sub = fields[i].split(":").map((v) => parseInt(v, 10));
+			const a = isNaN(sub[0]) ? 0 : sub[0];
+			if (a === 0) {
+				this.fg = -1;
+				this.bg = -1;
+				this.ul = -1;
+				this.attrs = 0;
+			} else if (a === 1) {
+				this.attrs |= ATTR_BOLD;
+			} else if (a === 2) {
+				this.attrs |= ATTR_DIM;
+			} else if (a === 3) {
+				this.attrs |= ATTR_ITALIC;
+			} else if (a === 4 || a === 21) {
+				const style = a === 21 ? 2 : sub.length > 1 ? sub[1] : 1;
+				this.attrs &= ~UNDERLINES;
+				if (style > 0) {
+					this.attrs |= ATTR_UNDERLINE | (UNDERLINE_STYLES[style] || 0);
+				}
+			} else if (a === 5 || a === 6) {
+				this.attrs |= ATTR_BLINK;
+			} else if (a === 7) {
+				this.attrs |= ATTR_REVERSE;
+			} else if (a === 8) {
+				this.attrs |= ATTR_INVISIBLE;
+			} else if (a === 9) {
+				this.attrs |= ATTR_STRIKE;
+			} else if (a === 22) {
+				this.attrs &= ~(ATTR_BOLD | ATTR_DIM);
+			} else if (a === 23) {
+				this.attrs &= ~ATTR_ITALIC;
+			} else if (a === 24) {
+				this.attrs &= ~UNDERLINES;
+			} else if (a === 25) {
+				this.attrs &= ~ATTR_BLINK;
+			} else if (a === 27) {
+				this.attrs &= ~ATTR_REVERSE;
+			} else if (a === 28) {
+				this.attrs &= ~ATTR_INVISIBLE;
+			} else if (a === 29) {
+				this.attrs &= ~ATTR_STRIKE;
+			} else if (a >= 30 && a <= 37) {
+				this.fg = a - 30;
+			} else if (a === 39) {
+				this.fg = -1;
+			} else if (a >= 40 && a <= 47) {
+				this.bg = a - 40;
+			} else if (a === 49) {
+				this.bg = -1;
+			} else if (a === 53) {
+				this.attrs |= ATTR_OVERLINE;
+			} else if (a === 55) {
+				this.attrs &= ~ATTR_OVERLINE;
+			} else if (a === 59) {
+				this.ul = -1;
+			} else if (a >= 90 && a <= 97) {
+				this.fg = a - 90 + 8;
+			} else if (a >= 100 && a <= 107) {
+				this.bg = a - 100 + 8;
+			} else if (a === 38 || a === 48 || a === 58) {
+				// Either 38;5;n and 38;2;r;g;b, or with colons, 38:5:n
+				// and 38:2:[colorspace]:r:g:b.
+				let p = sub.slice(1);
+				if (sub.length === 1) {
+					p = fields.slice(i + 1, i + 5).map((v) => parseInt(v, 10));
+					i += p[0] === 5 ? 2 : p[0] === 2 ? 4 : 0;
+				} else if (p[0] === 2 && p.length > 4) {
+					p.splice(1, 1);
+				}
+				let color = -1;
+				if (p[0] === 5) {
+					color = p[1] & 255;
+				} else if (p[0] === 2) {
+					const hex = (v) => ((v & 255) | 0).toString(16).padStart(2, "0");
+					color = "#" + hex(p[1]) + hex(p[2]) + hex(p[3]);
+				}
+				if (a === 38) {
+					this.fg = color;
+				} else if (a === 48) {
+					this.bg = color;
+				} else {
+					this.ul = color;
+				}
+			}
+		}
+	}
+
+	render() {
+		this.renderPending = false;
+		for (const y of this.dirty) {
+			if (y < this.rows) {
+				this.renderRow(y);
+			}
+		}
+		this.dirty.clear();
+	}
+
+	renderRow(y) {
+		const line = this.lines[y];
+		const row = this.rowEls[y];
+		row.textContent = "";
+		let style = null;
+		let text = "";
+		let cursor = false;
+		const flush = () => {
+			if (text === "") {
+				return;
+			}
+			const span = document.createElement("span");
+			span.style.cssText = style;
+			if (cursor) {
+				span.className = "cursor";
+			}
+			span.textContent = text;
+			row.appendChild(span);
+			text = "";
+		};
+		for (let x = 0; x < this.cols; x++) {
+			const cell = line[x];
+			const isCursor = this.cursorVisible && y === this.y && x === this.x;
+			const s = this.cellStyle(cell);
+			if (s !== style || isCursor || cursor) {
+				flush();
+				style = s;
+				cursor = isCursor;
+			}
+			text += cell.ch;
+		}
+		flush();
+	}
+
+	cellStyle(cell) {
+		const color = (c, def) => (c === -1 ? def : typeof c === "string" ? c : PALETTE[c]);
+		let fg = color(cell.fg, DEFAULT_FG);
+		let bg = color(cell.bg, DEFAULT_BG);
+		const a = cell.attrs;
+		if (a & ATTR_REVERSE) {
+			[fg, bg] = [bg, fg];
+		}
+		let s = "color:" + fg + ";background:" + bg;
+		if (a & ATTR_BOLD) {
+			s += ";font-weight:bold";
+		}
+		if (a & ATTR_DIM) {
+			s += ";opacity:0.6";
+		}
+		if (a & ATTR_ITALIC) {
+			s += ";font-style:italic";
+		}
+		if (a & (ATTR_UNDERLINE | ATTR_STRIKE | ATTR_OVERLINE)) {
+			s += ";text-decoration:" + (a & ATTR_UNDERLINE ? "underline " : "") +
+				(a & ATTR_OVERLINE ? "overline " : "") + (a & ATTR_STRIKE ? "line-through" : "");
+			const style = a & ATTR_DOUBLE ? "double" : a & ATTR_CURLY ? "wavy" :
+				a & ATTR_DOTTED ? "dotted" : a & ATTR_DASHED ? "dashed" : "";
+			if (style !== "") {
+				s += ";text-decoration-style:" + style;
+			}
+			if (cell.ul !== -1 && a & ATTR_UNDERLINE) {
+				s += ";text-decoration-color:" + color(cell.ul, fg);
+			}
+		}
+		if (a & ATTR_INVISIBLE) {
+			s += ";color:transparent";
+		}
+		return s;
+	}
+
+	// key returns what to send for a keydown event, or null to let the
+	// browser have it.
+	key(e) {
+		const app = this.appCursor;
+		const keys = {
+			Enter: "\r",
+			Backspace: "\x7f",
+			Tab: e.shiftKey ? "\x1b[Z" : "\t",
+			Escape: "\x1b",
+			ArrowUp: app ? "\x1bOA" : "\x1b[A",
+			ArrowDown: app ? "\x1bOB" : "\x1b[B",
+			ArrowRight: app ? "\x1bOC" : "\x1b[C",
+			ArrowLeft: app ? "\x1bOD" : "\x1b[D",
+			Home: app ? "\x1bOH" : "\x1b[H",
+			End: app ? "\x1bOF" : "\x1b[F",
+			Insert: "\x1b[2~",
+			Delete: "\x1b[3~",
+			PageUp: "\x1b[5~",
+			PageDown: "\x1b[6~",
+			F1: "\x1bOP",
+			F2: "\x1bOQ",
+			F3: "\x1bOR",
+			F4: "\x1bOS",
+			F5: "\x1b[15~",
+			F6: "\x1b[17~",
+			F7: "\x1b[18~",
+			F8: "\x1b[19~",
+			F9: "\x1b[20~",
+			F10: "\x1b[21~",
+			F11: "\x1b[23~",
+			F12: "\x1b[24~",
+		};
+		if (e.metaKey) {
+			return null;
+		}
+		if (keys[e.key] !== undefined) {
+			return keys[e.key];
+		}
+		if ([...e.key].length !== 1) {
+			return null;
+		}
+		if (e.ctrlKey && !e.altKey) {
+			const k = e.key.toLowerCase();
+			if (k === "v" || k === "c" && window.getSelection().toString() !== "") {
+				// Leave paste, and copying a selection, to the browser.
+				return null;
+			}
+			if (k >= "a" && k <= "z") {
+				return String.fromCharCode(k.charCodeAt(0) - 96);
+			}
+			const ctrl = { " ": "\x00", "@": "\x00", "[": "\x1b", "\\": "\x1c", "]": "\x1d", "^": "\x1e", "_": "\x1f" };
+			return ctrl[e.key] !== undefined ? ctrl[e.key] : null;
+		}
+		return e.altKey ? "\x1b" + e.key : e.key;
+	}
+
+	// paste returns what to send for pasted text.
+	paste(text) {
+		text = text.replace(/\r?\n/g, "\r");
+		return this.bracketedPaste ? "\x1b[200~" + text + "\x1b[201~" : text;
+	}
+}